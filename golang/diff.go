@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// diffStatWidth is the widest +/- bar printed by -stat.
+const diffStatWidth = 50
+
+// jsonDiff is the -output json form of subgit diff.
+type jsonDiff struct {
+	Commit string         `json:"commit"`
+	Files  []jsonFileDiff `json:"files"`
+}
+
+type jsonFileDiff struct {
+	Path        string `json:"path"`
+	Status      string `json:"status"`
+	LocalSha    string `json:"local_sha,omitempty"`
+	UpstreamSha string `json:"upstream_sha,omitempty"`
+	Binary      bool   `json:"binary,omitempty"`
+	Insertions  int    `json:"insertions"`
+	Deletions   int    `json:"deletions"`
+	Patch       string `json:"patch,omitempty"`
+}
+
+func printDiff(w io.Writer, result *subgit.DiffResult) {
+	for _, file := range result.Files {
+		io.WriteString(w, file.Patch)
+	}
+}
+
+func printDiffNameStatus(w io.Writer, result *subgit.DiffResult) {
+	for _, file := range result.Files {
+		fmt.Fprintf(w, "%s\t%s\n", file.Status, file.Path)
+	}
+}
+
+// printDiffStat prints a summary like git diff --stat.
+func printDiffStat(w io.Writer, result *subgit.DiffResult) {
+	if len(result.Files) == 0 {
+		return
+	}
+	pathWidth, countWidth, maxChanges := 0, 0, 0
+	insertions, deletions := 0, 0
+	for _, file := range result.Files {
+		changes := file.Insertions + file.Deletions
+		pathWidth = max(pathWidth, len(file.Path))
+		countWidth = max(countWidth, len(fmt.Sprint(changes)))
+		maxChanges = max(maxChanges, changes)
+		insertions += file.Insertions
+		deletions += file.Deletions
+	}
+
+	for _, file := range result.Files {
+		if file.Binary {
+			fmt.Fprintf(w, " %-*s | Bin\n", pathWidth, file.Path)
+			continue
+		}
+		plus, minus := file.Insertions, file.Deletions
+		if maxChanges > diffStatWidth {
+			plus = scaleStat(plus, maxChanges)
+			minus = scaleStat(minus, maxChanges)
+		}
+		fmt.Fprintf(w, " %-*s | %*d %s%s\n", pathWidth, file.Path, countWidth, file.Insertions+file.Deletions,
+			strings.Repeat("+", plus), strings.Repeat("-", minus))
+	}
+
+	summary := fmt.Sprintf(" %d %s changed", len(result.Files), plural(len(result.Files), "file", "files"))
+	if insertions > 0 || deletions == 0 {
+		summary += fmt.Sprintf(", %d %s(+)", insertions, plural(insertions, "insertion", "insertions"))
+	}
+	if deletions > 0 || insertions == 0 {
+		summary += fmt.Sprintf(", %d %s(-)", deletions, plural(deletions, "deletion", "deletions"))
+	}
+	fmt.Fprintln(w, summary)
+}
+
+// scaleStat scales n to the bar width, keeping at least one character for
+// any change.
+func scaleStat(n, maxChanges int) int {
+	if n == 0 {
+		return 0
+	}
+	return max(1, n*diffStatWidth/maxChanges)
+}
+
+func plural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+func printDiffJSON(w io.Writer, result *subgit.DiffResult) {
+	out := jsonDiff{Commit: result.Commit, Files: []jsonFileDiff{}}
+	for _, file := range result.Files {
+		out.Files = append(out.Files, jsonFileDiff{
+			Path:        file.Path,
+			Status:      file.Status,
+			LocalSha:    file.LocalSha,
+			UpstreamSha: file.UpstreamSha,
+			Binary:      file.Binary,
+			Insertions:  file.Insertions,
+			Deletions:   file.Deletions,
+			Patch:       file.Patch,
+		})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
@@ -1,17 +1,17 @@
-module subgit
+module github.com/pranjalya/subgit/golang
 
 go 1.23.6
 
 require (
 	github.com/cheggaaa/pb/v3 v3.1.6
-	golang.org/x/sync v0.11.0
+	github.com/mattn/go-isatty v0.0.20
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/VividCortex/ewma v1.2.0 // indirect
 	github.com/fatih/color v1.18.0 // indirect
 	github.com/mattn/go-colorable v0.1.14 // indirect
-	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.2.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// jsonCommit is an entry of subgit log -output json.
+type jsonCommit struct {
+	Sha     string    `json:"sha"`
+	Author  string    `json:"author"`
+	Date    time.Time `json:"date"`
+	Subject string    `json:"subject"`
+	URL     string    `json:"url,omitempty"`
+}
+
+func printLog(w io.Writer, commits []subgit.Commit) {
+	authorWidth := 0
+	for _, c := range commits {
+		authorWidth = max(authorWidth, len(c.Author))
+	}
+	for _, c := range commits {
+		fmt.Fprintf(w, "%s  %s  %-*s  %s\n", shortSha(c.Sha), c.Date.Format(time.DateOnly), authorWidth, c.Author, c.Subject)
+	}
+}
+
+func printLogJSON(w io.Writer, commits []subgit.Commit) {
+	out := []jsonCommit{}
+	for _, c := range commits {
+		out = append(out, jsonCommit{Sha: c.Sha, Author: c.Author, Date: c.Date, Subject: c.Subject, URL: c.URL})
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(out)
+}
+
+// printLogMarkdown prints the commits as a changelog to paste into a pull
+// request.
+func printLogMarkdown(w io.Writer, fetcher *subgit.GithubFetcher, commits []subgit.Commit, since string) {
+	repo := fetcher.RepoName
+	if fetcher.LocalRepo != "" {
+		repo = fetcher.LocalRepo
+	}
+	title := fmt.Sprintf("### Changes to `%s`", repo)
+	if fetcher.Subfolder != "" {
+		title = fmt.Sprintf("### Changes to `%s` in %s", fetcher.Subfolder, repo)
+	}
+	if since != "" {
+		title += fmt.Sprintf(" since `%s`", shortSha(since))
+	}
+	fmt.Fprintf(w, "%s\n\n", title)
+	if len(commits) == 0 {
+		fmt.Fprintln(w, "No changes.")
+		return
+	}
+	for _, c := range commits {
+		sha := "`" + shortSha(c.Sha) + "`"
+		if c.URL != "" {
+			sha = fmt.Sprintf("[%s](%s)", sha, c.URL)
+		}
+		fmt.Fprintf(w, "- %s %s (%s, %s)\n", sha, c.Subject, c.Author, c.Date.Format(time.DateOnly))
+	}
+}
+
+// shortSha abbreviates a commit SHA like git log --oneline; other refs are
+// returned as they are.
+func shortSha(ref string) string {
+	if len(ref) == 40 {
+		return ref[:7]
+	}
+	return ref
+}
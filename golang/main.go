@@ -2,22 +2,18 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
-	"net/http"
-	"net/url"
 	"os"
-	"path"
-	"path/filepath"
+	"os/signal"
 	"strings"
-	"sync"
+	"syscall"
+	"time"
 
-	"github.com/cheggaaa/pb/v3"
-	"golang.org/x/sync/semaphore"
+	"github.com/mattn/go-isatty"
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
 )
 
 var (
@@ -26,230 +22,622 @@ var (
 	date    = "unknown"
 )
 
-type GithubFetcher struct {
-	RepoName    string
-	Branch      string
-	Subfolder   string
-	RootDir     string
-	VerifySSL   bool
-	PATToken    string       // GitHub Personal Access Token
-	Client      *http.Client // Use http.Client directly
-	ProgressBar *pb.ProgressBar
-}
+func main() {
+	// "subgit update" refreshes a directory from the source recorded in its
+	// state file, merging local changes. "subgit patch refresh" rewrites the
+	// patch queue from the local changes. "subgit diff" compares a directory
+	// with upstream, and "subgit log" lists the commits that touched it.
+	// "subgit watch" keeps a directory in sync with its branch.
+	args := os.Args[1:]
+	update := len(args) > 0 && args[0] == "update"
+	refresh := len(args) > 1 && args[0] == "patch" && args[1] == "refresh"
+	diff := len(args) > 0 && args[0] == "diff"
+	showLog := len(args) > 0 && args[0] == "log"
+	watch := len(args) > 0 && args[0] == "watch"
+	if update || diff || showLog || watch {
+		args = args[1:]
+	} else if refresh {
+		args = args[2:]
+	}
 
-func NewGithubFetcher(repoName, branch, subfolder, rootDir string, verifySSL bool, patToken string) *GithubFetcher {
-	// Configure the HTTP client with TLS verification options.
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: !verifySSL, // Disable verification if verifySSL is false
+	githubURL := flag.String("url", "", "GitHub URL to the subdirectory (e.g., https://github.com/user/repo/tree/branch/subfolder), or a local repository as file:///path/repo.git#ref:subfolder")
+	rootDir := flag.String("root_dir", "", "Local directory to save the files")
+	noVerifySSL := flag.Bool("no-verify-ssl", false, "Disable SSL certificate verification (not recommended)")
+	patToken := flag.String("pat-token", "", "GitHub Personal Access Token (PAT); prefer -token-file or the environment")
+	tokenFile := flag.String("token-file", "", "Read the GitHub token from this file")
+	tokenStdin := flag.Bool("token-stdin", false, "Read the GitHub token from stdin")
+	appID := flag.String("app-id", "", "Authenticate as this GitHub App (requires -app-installation-id and -app-private-key)")
+	appInstallationID := flag.String("app-installation-id", "", "Installation ID of the GitHub App")
+	appPrivateKey := flag.String("app-private-key", "", "PEM private key file of the GitHub App")
+	apiURL := flag.String("api-url", "", "Override the REST API base URL (default https://api.github.com or https://<host>/api/v3)")
+	caBundle := flag.String("ca-bundle", "", "PEM file of extra CA certificates to trust, e.g. for a TLS-intercepting proxy")
+	clientCert := flag.String("client-cert", "", "PEM client certificate for mutual TLS")
+	clientKey := flag.String("client-key", "", "PEM private key for -client-cert (if not in the same file)")
+	proxy := flag.String("proxy", "", "Proxy URL (http://, https://, socks5://); defaults to HTTPS_PROXY/HTTP_PROXY, honors NO_PROXY")
+	at := flag.String("at", "", "Fetch the last commit on the branch at or before this time, e.g. 2026-03-01T00:00Z (UTC if no zone is given)")
+	failFast := flag.Bool("fail-fast", false, "Stop at the first file that fails to download")
+	connectTimeout := flag.Duration("connect-timeout", subgit.DefaultConnectTimeout, "Timeout for establishing a TCP connection (0 for none)")
+	tlsTimeout := flag.Duration("tls-timeout", subgit.DefaultTLSHandshakeTimeout, "Timeout for the TLS handshake (0 for none)")
+	headerTimeout := flag.Duration("header-timeout", subgit.DefaultResponseHeaderTimeout, "Timeout waiting for response headers (0 for none)")
+	stallTimeout := flag.Duration("stall-timeout", subgit.DefaultStallTimeout, "Abort a download that receives no data for this long (0 for none)")
+	deadline := flag.Duration("deadline", 0, "Overall time limit for the whole run, e.g. 10m (0 for none)")
+	jobs := flag.Int("jobs", subgit.DefaultJobs, "Number of concurrent downloads (starting point with -adaptive)")
+	maxJobs := flag.Int("max-jobs", subgit.DefaultMaxJobs, "Upper bound on concurrent downloads with -adaptive")
+	adaptive := flag.Bool("adaptive", false, "Adjust concurrency to latency and back off when throttled")
+	backend := flag.String("backend", subgit.BackendRaw, "How to download files: raw, or graphql to batch small text files through the GraphQL API (needs a token)")
+	copySymlinks := flag.Bool("copy-symlinks", false, "Copy symlink targets instead of creating symlinks")
+	archivePath := flag.String("o", "", "Write the files to a .tar, .tar.gz, .tgz or .zip archive instead of -root_dir; - for stdout")
+	archiveFormat := flag.String("archive-format", "", "Archive format for -o: tar, tar.gz or zip (default from the extension, tar for stdout)")
+	localChanges := flag.String("local-changes", subgit.PolicyAbort, "What to do with files changed locally since the last run: abort, skip, overwrite, backup or merge")
+	patchDir := flag.String("patches", "", "Directory of patches to apply in name order after fetching (remembered for later runs)")
+	diffStat := flag.Bool("stat", false, "subgit diff: print a diffstat instead of the diff")
+	diffNameStatus := flag.Bool("name-status", false, "subgit diff: print the status and path of each changed file")
+	sinceRef := flag.String("since-ref", "", "subgit log: list commits after this ref or SHA (default the commit recorded in -root_dir)")
+	templateMode := flag.Bool("template", false, "Render the subfolder as a project template into -root_dir")
+	templateValues := keyValueFlag{}
+	flag.Var(templateValues, "set", "Template variable as key=value (repeatable)")
+	answersFile := flag.String("answers", "", "YAML or JSON file of template variables")
+	var hooks listFlag
+	flag.Var(&hooks, "hook", "Shell command to run in -root_dir after a fetch that changed files (repeatable, remembered for later runs)")
+	interval := flag.Duration("interval", subgit.DefaultWatchInterval, "subgit watch: time between polls of the branch")
+	jitter := flag.Duration("jitter", 0, "subgit watch: add up to this much random time to each interval")
+	execCommand := flag.String("exec", "", "subgit watch: shell command to run after each sync")
+	output := flag.String("output", OutputText, "Output format: text, or json for newline-delimited JSON events; markdown for subgit log")
+	eventsFile := flag.String("events-file", "", "Write the -output json events to this file instead of stdout")
+	positional := parseArgs(args)
+
+	// Extra arguments are rejected rather than ignored, since they are
+	// usually misplaced flags.
+	maxArgs, usage := 1, "subgit [options] [url]"
+	if *githubURL != "" {
+		maxArgs, usage = 0, "subgit [options] -url <url>"
+	}
+	switch {
+	case diff:
+		maxArgs, usage = 2, "subgit diff [options] <url> <dir>"
+	case showLog:
+		maxArgs, usage = 1, "subgit log [options] [url]"
+	case update:
+		maxArgs, usage = 0, "subgit update [options]"
+	case refresh:
+		maxArgs, usage = 0, "subgit patch refresh [options]"
+	case watch:
+		maxArgs, usage = 0, "subgit watch [options]"
+	}
+	if len(positional) > maxArgs {
+		fmt.Fprintf(os.Stderr, "Unexpected argument %q.\nUsage: %s\n", positional[maxArgs], usage)
+		os.Exit(2)
 	}
 
-	// Create a transport with the TLS configuration.
-	transport := &http.Transport{
-		TLSClientConfig: tlsConfig,
+	if *output != OutputText && *output != OutputJSON && !(showLog && *output == OutputMarkdown) {
+		valid := "text or json"
+		if showLog {
+			valid = "text, json or markdown"
+		}
+		fmt.Fprintf(os.Stderr, "Unknown -output %q, use %s.\n", *output, valid)
+		os.Exit(1)
+	}
+	jsonToStdout := *output == OutputJSON && *eventsFile == ""
+	if jsonToStdout && *archivePath == "-" {
+		fmt.Fprintln(os.Stderr, "-output json needs -events-file when the archive is written to stdout.")
+		os.Exit(1)
 	}
 
-	// Create a new HTTP client using the transport.
-	client := &http.Client{
-		Transport: transport,
+	// subgit diff takes the URL and the directory as arguments, subgit log
+	// the URL.
+	if (diff || showLog) && len(positional) > 0 {
+		*githubURL = positional[0]
 	}
-	return &GithubFetcher{
-		RepoName:    repoName,
-		Branch:      branch,
-		Subfolder:   subfolder,
-		RootDir:     rootDir,
-		VerifySSL:   verifySSL,
-		PATToken:    patToken,
-		Client:      client,
-		ProgressBar: nil,
+	if diff && len(positional) > 1 {
+		*rootDir = positional[1]
+	}
+	// A fetch may also name its source as an argument.
+	if !(update || refresh || diff || showLog || watch) && *githubURL == "" && len(positional) > 0 {
+		*githubURL = positional[0]
 	}
-}
 
-func (gf *GithubFetcher) GetFileContent(filepath string) (string, error) {
-	url := fmt.Sprintf("https://raw.githubusercontent.com/%s/refs/heads/%s/%s", gf.RepoName, gf.Branch, filepath)
+	// Keep stdout clean when the archive, the events or a diff are streamed
+	// to it.
+	stdout := io.Writer(os.Stdout)
+	if *archivePath == "-" || jsonToStdout || diff || showLog {
+		stdout = os.Stderr
+	}
+	fmt.Fprintf(stdout, "subgit - Version: %s, Commit: %s, Date: %s\n", version, commit, date)
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return "", fmt.Errorf("error creating request: %w", err)
+	if update && (*rootDir == "" || *archivePath != "") {
+		fmt.Fprintln(stdout, "subgit update needs -root_dir and cannot write an archive.")
+		os.Exit(1)
+	}
+	if diff && (*githubURL == "" || *rootDir == "" || *archivePath != "") {
+		fmt.Fprintln(stdout, "Usage: subgit diff [options] <url> <dir>")
+		os.Exit(1)
+	}
+	if refresh && (*rootDir == "" || *archivePath != "") {
+		fmt.Fprintln(stdout, "subgit patch refresh needs -root_dir.")
+		os.Exit(1)
+	}
+	if watch && (*rootDir == "" || *archivePath != "") {
+		fmt.Fprintln(stdout, "subgit watch needs -root_dir and cannot write an archive.")
+		os.Exit(1)
+	}
+	if *templateMode && (update || refresh || diff || showLog || watch || *rootDir == "" || *archivePath != "" || *output == OutputJSON) {
+		fmt.Fprintln(stdout, "-template needs -root_dir and works without subcommands, -o and -output json.")
+		os.Exit(1)
+	}
+	var atTime time.Time
+	if *at != "" {
+		if watch || refresh || showLog {
+			fmt.Fprintln(stdout, "-at cannot be used with subgit watch, log or patch refresh.")
+			os.Exit(1)
+		}
+		var err error
+		atTime, err = parseTime(*at)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
+	}
+	if watch && (*interval <= 0 || *jitter < 0) {
+		fmt.Fprintln(stdout, "-interval must be positive and -jitter cannot be negative.")
+		os.Exit(1)
+	}
+	if update && isFlagSet("local-changes") {
+		fmt.Fprintln(stdout, "subgit update always merges local changes; -local-changes cannot be used with it.")
+		os.Exit(1)
+	}
+	if showLog && (*githubURL == "" && *rootDir == "" || *archivePath != "") {
+		fmt.Fprintln(stdout, "Usage: subgit log [options] <url>")
+		os.Exit(1)
 	}
-	if gf.PATToken != "" {
-		req.Header.Set("Authorization", "token "+gf.PATToken)
+	if showLog && *rootDir != "" && *sinceRef == "" {
+		state, err := subgit.LoadState(*rootDir)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
+		if state != nil {
+			*sinceRef = state.Commit
+		}
+	}
+	if (update || refresh || showLog || watch) && *githubURL == "" {
+		state, err := subgit.LoadState(*rootDir)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
+		if state == nil {
+			fmt.Fprintf(stdout, "No %s in %s; fetch it with -url first.\n", subgit.StateFileName, *rootDir)
+			os.Exit(1)
+		}
+		*githubURL = state.URL()
+	}
+	if *githubURL == "" || (*rootDir == "" && *archivePath == "" && !showLog) {
+		fmt.Fprintln(stdout, "Please provide -url and either -root_dir or -o.")
+		flag.Usage()
+		os.Exit(1)
+	}
+	if *jobs < 1 || *maxJobs < 1 {
+		fmt.Fprintln(stdout, "-jobs and -max-jobs must be at least 1.")
+		os.Exit(1)
 	}
 
-	resp, err := gf.Client.Do(req)
+	var host, repoName, localRepo, branch, subfolder string
+	var err error
+	if subgit.IsLocalURL(*githubURL) {
+		localRepo, branch, subfolder, err = subgit.ParseLocalURL(*githubURL)
+	} else {
+		host, repoName, branch, subfolder, err = subgit.ParseGithubURL(*githubURL)
+	}
 	if err != nil {
-		return "", fmt.Errorf("error fetching %s: %w", url, err)
+		fmt.Fprintln(stdout, err)
+		os.Exit(1)
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error %d for %s", resp.StatusCode, url)
+	clientOpts := subgit.ClientOptions{
+		VerifySSL:             !*noVerifySSL,
+		CABundle:              *caBundle,
+		ClientCert:            *clientCert,
+		ClientKey:             *clientKey,
+		Proxy:                 *proxy,
+		ConnectTimeout:        *connectTimeout,
+		TLSHandshakeTimeout:   *tlsTimeout,
+		ResponseHeaderTimeout: *headerTimeout,
+		StallTimeout:          *stallTimeout,
 	}
 
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading body from %s: %w", url, err)
+	useApp := *appID != "" || *appInstallationID != "" || *appPrivateKey != ""
+	if useApp && (*appID == "" || *appInstallationID == "" || *appPrivateKey == "") {
+		fmt.Fprintln(stdout, "-app-id, -app-installation-id and -app-private-key must be used together.")
+		os.Exit(1)
+	}
+	if useApp && localRepo != "" {
+		fmt.Fprintln(stdout, "A local repository needs no GitHub App authentication.")
+		os.Exit(1)
 	}
 
-	return string(bodyBytes), nil
-}
+	// A local repository is read without tokens.
+	var credential *subgit.Credential
+	if !useApp && localRepo == "" {
+		credOpts := subgit.CredentialOptions{Token: *patToken, TokenFile: *tokenFile}
+		if *tokenStdin {
+			credOpts.TokenStdin = os.Stdin
+		}
+		credential, err = subgit.ResolveCredential(host, credOpts)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
+	}
 
-func (gf *GithubFetcher) SaveFileContent(filepath_ string, content string) error {
-	fullPath := filepath.Join(gf.RootDir, filepath_)
-	dir := filepath.Dir(fullPath)
+	opts := subgit.Options{
+		Host:          host,
+		APIBase:       *apiURL,
+		RepoName:      repoName,
+		LocalRepo:     localRepo,
+		Branch:        branch,
+		Subfolder:     subfolder,
+		RootDir:       *rootDir,
+		At:            atTime,
+		Credential:    credential,
+		ClientOptions: clientOpts,
+		Deadline:      *deadline,
+		CopySymlinks:  *copySymlinks,
+		FailFast:      *failFast,
+		Jobs:          *jobs,
+		MaxJobs:       *maxJobs,
+		Adaptive:      *adaptive,
+		LocalChanges:  *localChanges,
+		Backend:       *backend,
+		PatchDir:      *patchDir,
+		Hooks:         hooks,
+		HookOutput:    stdout,
+	}
+	if update {
+		opts.LocalChanges = subgit.PolicyMerge
+		opts.WriteConflicts = true
+	}
 
-	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
-		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	if *archivePath != "" {
+		opts.Archive, err = subgit.NewArchiveWriter(*archivePath, *archiveFormat)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
 	}
 
-	file, err := os.Create(fullPath)
-	if err != nil {
-		return fmt.Errorf("error creating file %s: %w", fullPath, err)
+	var progress *progressReporter
+	var events *eventWriter
+	switch {
+	case diff, showLog, *templateMode:
+		// Nothing to report while the differing files are downloaded.
+	case *output == OutputJSON:
+		eventsOut := io.Writer(os.Stdout)
+		if *eventsFile != "" {
+			file, err := os.Create(*eventsFile)
+			if err != nil {
+				fmt.Fprintf(stdout, "error creating events file: %v\n", err)
+				os.Exit(1)
+			}
+			defer file.Close()
+			eventsOut = file
+		}
+		events = newEventWriter(eventsOut)
+		opts.Progress = events.Event
+	case watch:
+		// One line per sync rather than a progress bar each time.
+	default:
+		progress = newProgressReporter(os.Stderr)
+		opts.Progress = progress.Event
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(content)
+	fetcher, err := subgit.NewGithubFetcher(opts)
 	if err != nil {
-		return fmt.Errorf("error writing to file %s: %w", fullPath, err)
+		fmt.Fprintln(stdout, err)
+		os.Exit(1)
 	}
+	defer fetcher.Close()
 
-	return nil
-}
-
-func (gf *GithubFetcher) ProcessFile(filepath string, wg *sync.WaitGroup, sem *semaphore.Weighted) {
-	defer wg.Done()
+	if useApp {
+		keyPEM, err := os.ReadFile(*appPrivateKey)
+		if err != nil {
+			fmt.Fprintf(stdout, "error reading GitHub App private key: %v\n", err)
+			os.Exit(1)
+		}
+		fetcher.Credential, err = subgit.NewAppCredential(host, fetcher.APIURL(), *appID, *appInstallationID, keyPEM, fetcher.Client)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(1)
+		}
+	}
+	if fetcher.Credential != nil {
+		fmt.Fprintf(stdout, "Using token for %s from %s\n", fetcher.Credential.Host, fetcher.Credential.Source)
+	}
 
-	err := sem.Acquire(context.Background(), 1)
-	if err != nil {
-		log.Printf("Failed to acquire semaphore: %v\n", err)
+	// The first SIGINT or SIGTERM cancels the run gracefully, a second one
+	// kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	if diff {
+		result, err := fetcher.Diff(ctx)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(subgit.ExitCode(err))
+		}
+		switch {
+		case *output == OutputJSON:
+			printDiffJSON(os.Stdout, result)
+		case *diffStat:
+			printDiffStat(os.Stdout, result)
+		case *diffNameStatus:
+			printDiffNameStatus(os.Stdout, result)
+		default:
+			printDiff(os.Stdout, result)
+		}
 		return
 	}
-	defer sem.Release(1)
 
-	content, err := gf.GetFileContent(filepath)
-	if err != nil {
-		log.Println(err) // Log the error, but continue processing other files.
+	if showLog {
+		commits, err := fetcher.Log(ctx, *sinceRef)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(subgit.ExitCode(err))
+		}
+		switch *output {
+		case OutputJSON:
+			printLogJSON(os.Stdout, commits)
+		case OutputMarkdown:
+			printLogMarkdown(os.Stdout, fetcher, commits, *sinceRef)
+		default:
+			printLog(os.Stdout, commits)
+		}
 		return
 	}
 
-	if err := gf.SaveFileContent(filepath, content); err != nil {
-		log.Println(err)
+	if *templateMode {
+		values := map[string]string{}
+		if *answersFile != "" {
+			values, err = subgit.ReadTemplateAnswers(*answersFile)
+			if err != nil {
+				fmt.Fprintln(stdout, err)
+				os.Exit(1)
+			}
+		}
+		for key, value := range templateValues {
+			values[key] = value
+		}
+		templateOpts := subgit.TemplateOptions{Values: values}
+		if isatty.IsTerminal(os.Stdin.Fd()) && !*tokenStdin {
+			templateOpts.Prompt = newPrompter(os.Stdin, stdout)
+		}
+		result, err := fetcher.RenderTemplate(ctx, templateOpts)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(subgit.ExitCode(err))
+		}
+		fmt.Fprintf(stdout, "Rendered %d of %d files from commit %s into %s.\n", result.Rendered, len(result.Files), shortSha(result.Commit), *rootDir)
 		return
 	}
 
-	gf.ProgressBar.Increment()
-}
-
-func (gf *GithubFetcher) FetchFiles() error {
-	url := fmt.Sprintf("https://api.github.com/repos/%s/git/trees/%s?recursive=1", gf.RepoName, gf.Branch)
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		return fmt.Errorf("error creating request: %w", err)
-	}
-	if gf.PATToken != "" {
-		req.Header.Set("Authorization", "token "+gf.PATToken)
+	if watch {
+		fmt.Fprintf(stdout, "Watching %s every %s\n", *githubURL, *interval)
+		err := fetcher.Watch(ctx, subgit.WatchOptions{
+			Interval: *interval,
+			Jitter:   *jitter,
+			OnSync: func(result *subgit.Result, err error) {
+				printLocalChanges(stdout, result)
+				printPatches(stdout, result)
+				if events != nil {
+					events.Summary(result, err)
+				}
+				var hookErr *subgit.HookError
+				if err != nil && !errors.As(err, &hookErr) {
+					fmt.Fprintf(stdout, "Sync failed: %v\n", err)
+					return
+				}
+				printSync(stdout, result)
+				if err != nil {
+					fmt.Fprintln(stdout, err)
+					return
+				}
+				// The first sync may find nothing to do.
+				if *execCommand != "" && len(result.Changed) > 0 {
+					if err := runCommand(ctx, stdout, *execCommand, *rootDir, result.Commit); err != nil {
+						fmt.Fprintf(stdout, "-exec: %v\n", err)
+					}
+				}
+			},
+			OnError: func(err error) {
+				fmt.Fprintln(stdout, err)
+			},
+		})
+		if errors.Is(err, context.Canceled) {
+			return
+		}
+		fmt.Fprintln(stdout, err)
+		os.Exit(subgit.ExitCode(err))
 	}
 
-	resp, err := gf.Client.Do(req)
-
-	if err != nil {
-		return fmt.Errorf("error fetching tree: %w", err)
+	if refresh {
+		patchPath, err := fetcher.RefreshPatches(ctx)
+		if err != nil {
+			fmt.Fprintln(stdout, err)
+			os.Exit(subgit.ExitCode(err))
+		}
+		if patchPath == "" {
+			fmt.Fprintln(stdout, "No local changes.")
+		} else {
+			fmt.Fprintf(stdout, "Wrote %s\n", patchPath)
+		}
+		return
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("error %d for %s", resp.StatusCode, url)
+	result, err := fetcher.Fetch(ctx)
+	if progress != nil {
+		progress.Finish()
 	}
-
-	bodyBytes, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fmt.Errorf("error reading body: %w", err)
+	printLocalChanges(stdout, result)
+	printPatches(stdout, result)
+	if err == nil {
+		err = fetcher.RunHooks(ctx, result)
 	}
-
-	var treeResponse struct {
-		Tree []struct {
-			Path string `json:"path"`
-			Type string `json:"type"`
-		} `json:"tree"`
+	if err != nil {
+		if events != nil {
+			events.Summary(result, err)
+		}
+		var localErr *subgit.LocalChangesError
+		if errors.As(err, &localErr) {
+			fmt.Fprintln(stdout, "Files changed locally:")
+			for _, path := range localErr.Paths {
+				fmt.Fprintf(stdout, "  %s\n", path)
+			}
+			fmt.Fprintln(stdout, "Nothing was written. Use -local-changes skip, overwrite, backup or merge to choose what to do with them.")
+		}
+		var fetchErr *subgit.FetchError
+		if errors.As(err, &fetchErr) {
+			if len(fetchErr.Failed) > 0 {
+				fmt.Fprintln(stdout, "Failed files:")
+			}
+			for _, failure := range fetchErr.Failed {
+				fmt.Fprintf(stdout, "  %s\n", failure)
+			}
+			if fetchErr.TimedOut {
+				fmt.Fprintf(stdout, "Deadline exceeded: %d of %d files downloaded, %d remaining.\n", fetchErr.Completed(), fetchErr.Total, fetchErr.Skipped)
+			}
+			if fetchErr.Interrupted {
+				fmt.Fprintf(stdout, "Interrupted: %d of %d files downloaded, %d remaining.\n", fetchErr.Completed(), fetchErr.Total, fetchErr.Skipped)
+				fmt.Fprintln(stdout, "Run the same command again to resume; files already downloaded are skipped.")
+			}
+		}
+		fmt.Fprintln(stdout, err)
+		os.Exit(subgit.ExitCode(err))
 	}
 
-	if err := json.Unmarshal(bodyBytes, &treeResponse); err != nil {
-		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	if len(result.Files) == 0 {
+		if events != nil {
+			events.Summary(result, nil)
+		}
+		fmt.Fprintln(stdout, "No files found matching the criteria.")
+		return
 	}
 
-	filesToFetch := []string{}
-	for _, item := range treeResponse.Tree {
-		if strings.HasPrefix(item.Path, gf.Subfolder) && item.Type == "blob" {
-			filesToFetch = append(filesToFetch, item.Path)
+	if fetcher.Archive != nil {
+		if err := fetcher.Archive.Close(); err != nil {
+			if events != nil {
+				events.Summary(result, err)
+			}
+			fmt.Fprintln(stdout, err)
+			os.Exit(subgit.ExitError)
 		}
 	}
-
-	totalFiles := len(filesToFetch)
-	if totalFiles == 0 {
-		fmt.Println("No files found matching the criteria.")
-		return nil
+	if events != nil {
+		events.Summary(result, nil)
 	}
 
-	gf.ProgressBar = pb.StartNew(totalFiles)
-	gf.ProgressBar.Set(pb.SIBytesPrefix, true)
-
-	var wg sync.WaitGroup
-	sem := semaphore.NewWeighted(8) // Limit concurrency to 8 (adjust as needed)
-	for _, filepath := range filesToFetch {
-		wg.Add(1)
-		go gf.ProcessFile(filepath, &wg, sem)
+	if !atTime.IsZero() {
+		fmt.Fprintf(stdout, "Fetched commit %s, the last on %s at or before %s.\n", result.Commit, branch, atTime.Format(time.RFC3339))
 	}
+	fmt.Fprintln(stdout, "Files downloaded successfully!")
+}
 
-	wg.Wait()
-	gf.ProgressBar.Finish()
+// parseArgs parses the flags in args, including those that follow an
+// argument, as in "subgit log <url> -since-ref v1", and returns the
+// arguments. Everything after "--" is an argument.
+func parseArgs(args []string) []string {
+	var positional []string
+	for {
+		flag.CommandLine.Parse(args)
+		rest := flag.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
 
-	return nil
+// parseTime parses the -at flag: RFC 3339 with optional seconds, or a
+// date. Times without a zone are in UTC.
+func parseTime(value string) (time.Time, error) {
+	layouts := []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02T15:04:05", "2006-01-02T15:04", time.DateOnly}
+	for _, layout := range layouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid -at %q, use a time like 2026-03-01T00:00Z or a date", value)
 }
 
-func ParseGithubURL(githubURL string) (string, string, string, error) {
-	parsedURL, err := url.Parse(githubURL)
-	if err != nil {
-		return "", "", "", fmt.Errorf("error parsing URL: %w", err)
+// printLocalChanges lists the files that were changed locally and how they
+// were handled.
+func printLocalChanges(w io.Writer, result *subgit.Result) {
+	if result == nil {
+		return
+	}
+	conflicts := []subgit.FileResult{}
+	labels := map[string]string{
+		subgit.PolicySkip:   "Kept local changes",
+		subgit.PolicyBackup: "Backed up local changes to .orig",
+		subgit.PolicyMerge:  "Merged local changes",
+	}
+	for _, file := range result.Files {
+		if file.Conflicts > 0 {
+			conflicts = append(conflicts, file)
+		} else if file.Local != "" {
+			fmt.Fprintf(w, "%s: %s\n", labels[file.Local], file.Path)
+		}
 	}
 
-	pathParts := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
-	if len(pathParts) < 4 {
-		return "", "", "", fmt.Errorf("invalid GitHub URL format")
+	if len(conflicts) > 0 {
+		fmt.Fprintln(w, "Merged with conflicts, resolve the conflict markers in:")
+		for _, file := range conflicts {
+			fmt.Fprintf(w, "  %s (%d)\n", file.Path, file.Conflicts)
+		}
 	}
+}
 
-	repoName := path.Join(pathParts[0], pathParts[1])
-	branch := pathParts[3]
-	subfolder := strings.Join(pathParts[4:], "/")
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
 
-	return repoName, branch, subfolder, nil
+func (f *listFlag) String() string {
+	return strings.Join(*f, ", ")
 }
 
-func main() {
-	fmt.Printf("subgit - Version: %s, Commit: %s, Date: %s\n", version, commit, date)
-
-	githubURL := flag.String("url", "", "GitHub URL to the subdirectory (e.g., https://github.com/user/repo/tree/branch/subfolder)")
-	rootDir := flag.String("root_dir", "", "Local directory to save the files")
-	noVerifySSL := flag.Bool("no-verify-ssl", false, "Disable SSL certificate verification (not recommended)")
-	patToken := flag.String("pat-token", "", "GitHub Personal Access Token (PAT)")
-	flag.Parse()
+func (f *listFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
 
-	if *githubURL == "" || *rootDir == "" {
-		fmt.Println("Please provide both -url and -root_dir arguments.")
-		flag.Usage()
-		os.Exit(1)
-	}
+// isFlagSet reports whether the named flag was given on the command line.
+func isFlagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
 
-	repoName, branch, subfolder, err := ParseGithubURL(*githubURL)
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+// printPatches reports the patches applied from the patch directory.
+func printPatches(w io.Writer, result *subgit.Result) {
+	if result == nil {
+		return
 	}
-
-	fetcher := NewGithubFetcher(repoName, branch, subfolder, *rootDir, !*noVerifySSL, *patToken)
-
-	if err := fetcher.FetchFiles(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+	for _, patch := range result.Patches {
+		if len(patch.Failed) == 0 {
+			fmt.Fprintf(w, "Applied patch %s\n", patch.Name)
+			continue
+		}
+		fmt.Fprintf(w, "Patch %s did not apply cleanly:\n", patch.Name)
+		for _, failure := range patch.Failed {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
 	}
-
-	fmt.Println("Files downloaded successfully!")
 }
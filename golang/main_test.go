@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// The tests run the CLI by starting the test binary again with
+// SUBGIT_TEST_MAIN set, which makes it run main instead of the tests.
+func TestMain(m *testing.M) {
+	if os.Getenv("SUBGIT_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runSubgit runs the CLI with args and returns its combined output and
+// exit code.
+func runSubgit(t *testing.T, args ...string) (string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "SUBGIT_TEST_MAIN=1")
+	out, err := cmd.CombinedOutput()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// testRepo is a git repository in a temporary directory.
+type testRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	r := &testRepo{t: t, dir: t.TempDir()}
+	r.git("init", "-q", "-b", "main")
+	return r
+}
+
+func (r *testRepo) git(args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files, relative to the repository, and commits them.
+func (r *testRepo) commit(files map[string]string) {
+	r.t.Helper()
+	for name, content := range files {
+		writeFile(r.t, filepath.Join(r.dir, name), content)
+	}
+	r.git("add", "-A")
+	r.git("commit", "-q", "-m", "update")
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestUpdateWritesConflicts(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{
+		"lib/clean.txt":    "1\n2\n3\n4\n5\n",
+		"lib/conflict.txt": "1\n2\n3\n",
+		"README":           "outside the subfolder\n",
+	})
+	rootDir := filepath.Join(t.TempDir(), "vendor")
+	if out, code := runSubgit(t, "-root_dir", rootDir, subgit.LocalURL(repo.dir, "main", "lib")); code != 0 {
+		t.Fatalf("fetch exited with %d:\n%s", code, out)
+	}
+
+	writeFile(t, filepath.Join(rootDir, "lib", "clean.txt"), "1\nlocal\n3\n4\n5\n")
+	writeFile(t, filepath.Join(rootDir, "lib", "conflict.txt"), "1\nlocal\n3\n")
+	repo.commit(map[string]string{
+		"lib/clean.txt":    "1\n2\n3\n4\nupstream\n",
+		"lib/conflict.txt": "1\nupstream\n3\n",
+	})
+
+	out, code := runSubgit(t, "update", "-root_dir", rootDir)
+	if code != subgit.ExitConflicts {
+		t.Fatalf("update exited with %d, want %d:\n%s", code, subgit.ExitConflicts, out)
+	}
+	if !strings.Contains(out, "lib/conflict.txt has merge conflicts") {
+		t.Errorf("output does not name the conflicting file:\n%s", out)
+	}
+	if got, want := readFile(t, filepath.Join(rootDir, "lib", "clean.txt")), "1\nlocal\n3\n4\nupstream\n"; got != want {
+		t.Errorf("clean.txt = %q, want %q", got, want)
+	}
+	want := "1\n<<<<<<< local\nlocal\n=======\nupstream\n>>>>>>> upstream\n3\n"
+	if got := readFile(t, filepath.Join(rootDir, "lib", "conflict.txt")); got != want {
+		t.Errorf("conflict.txt = %q, want %q", got, want)
+	}
+
+	// The merged files are recorded as based on the new commit, so
+	// resolving the conflict and updating again is clean.
+	writeFile(t, filepath.Join(rootDir, "lib", "conflict.txt"), "1\nresolved\n3\n")
+	if out, code := runSubgit(t, "update", "-root_dir", rootDir); code != 0 {
+		t.Fatalf("second update exited with %d:\n%s", code, out)
+	}
+	if got := readFile(t, filepath.Join(rootDir, "lib", "conflict.txt")); got != "1\nresolved\n3\n" {
+		t.Errorf("conflict.txt = %q after the second update, want the resolution kept", got)
+	}
+}
+
+func TestLogFlagsAfterURL(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"lib/a.txt": "1\n"})
+	first := repo.git("rev-parse", "HEAD")
+	repo.commit(map[string]string{"lib/a.txt": "2\n"})
+	second := repo.git("rev-parse", "HEAD")
+	url := subgit.LocalURL(repo.dir, "main", "lib")
+
+	out, code := runSubgit(t, "log", url, "-since-ref", first, "-output", "json")
+	if code != 0 {
+		t.Fatalf("log exited with %d:\n%s", code, out)
+	}
+	if !strings.Contains(out, `"sha": "`+second+`"`) || strings.Contains(out, first) {
+		t.Errorf("log did not honor the flags after the URL:\n%s", out)
+	}
+
+	out, code = runSubgit(t, "log", url, "-output", "html")
+	if code != 1 || !strings.Contains(out, "use text, json or markdown") {
+		t.Errorf("log with an unknown output format exited with %d:\n%s", code, out)
+	}
+	out, code = runSubgit(t, "-output", "markdown", url)
+	if code != 1 || !strings.Contains(out, "use text or json") {
+		t.Errorf("fetch with markdown output exited with %d:\n%s", code, out)
+	}
+
+	out, code = runSubgit(t, "log", url, "extra")
+	if code != 2 || !strings.Contains(out, `Unexpected argument "extra"`) {
+		t.Errorf("log with an extra argument exited with %d:\n%s", code, out)
+	}
+	out, code = runSubgit(t, "update", "-root_dir", t.TempDir(), "extra")
+	if code != 2 || !strings.Contains(out, `Unexpected argument "extra"`) {
+		t.Errorf("update with an argument exited with %d:\n%s", code, out)
+	}
+}
+
+func TestDiffFlagsAfterArguments(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"lib/a.txt": "1\n2\n", "lib/b.txt": "b\n"})
+	url := subgit.LocalURL(repo.dir, "main", "lib")
+	rootDir := t.TempDir()
+	if out, code := runSubgit(t, "-root_dir", rootDir, url); code != 0 {
+		t.Fatalf("fetch exited with %d:\n%s", code, out)
+	}
+	writeFile(t, filepath.Join(rootDir, "lib", "a.txt"), "1\nlocal\n")
+
+	tests := []struct {
+		flags []string
+		want  string
+	}{
+		{[]string{"--stat"}, "1 file changed, 1 insertion(+), 1 deletion(-)"},
+		{[]string{"--name-status"}, "M\tlib/a.txt"},
+		{[]string{"-output", "json"}, `"status": "M"`},
+	}
+	for _, tt := range tests {
+		out, code := runSubgit(t, append([]string{"diff", url, rootDir}, tt.flags...)...)
+		if code != 0 || !strings.Contains(out, tt.want) {
+			t.Errorf("diff %s exited with %d, want output containing %q:\n%s", strings.Join(tt.flags, " "), code, tt.want, out)
+		}
+	}
+
+	out, code := runSubgit(t, "diff", url, rootDir, "extra")
+	if code != 2 || !strings.Contains(out, `Unexpected argument "extra"`) {
+		t.Errorf("diff with an extra argument exited with %d:\n%s", code, out)
+	}
+}
+
+func TestFetchFlagsAfterURL(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"lib/a.txt": "a\n"})
+	url := subgit.LocalURL(repo.dir, "main", "lib")
+	rootDir := t.TempDir()
+
+	if out, code := runSubgit(t, url, "-root_dir", rootDir); code != 0 {
+		t.Fatalf("fetch exited with %d:\n%s", code, out)
+	}
+	if got := readFile(t, filepath.Join(rootDir, "lib", "a.txt")); got != "a\n" {
+		t.Errorf("a.txt = %q, want %q", got, "a\n")
+	}
+
+	for _, args := range [][]string{
+		{url, "-root_dir", rootDir, "extra"},
+		{"-url", url, "-root_dir", rootDir, "extra"},
+	} {
+		out, code := runSubgit(t, args...)
+		if code != 2 || !strings.Contains(out, `Unexpected argument "extra"`) {
+			t.Errorf("subgit %s exited with %d:\n%s", strings.Join(args, " "), code, out)
+		}
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	want := time.Date(2026, 3, 1, 12, 30, 0, 0, time.UTC)
+	for _, value := range []string{
+		"2026-03-01T12:30:00Z",
+		"2026-03-01T14:30:00+02:00",
+		"2026-03-01T12:30Z",
+		"2026-03-01T07:30-05:00",
+		"2026-03-01T12:30:00",
+		"2026-03-01T12:30",
+	} {
+		if got, err := parseTime(value); err != nil || !got.Equal(want) {
+			t.Errorf("parseTime(%s) = %v, %v, want %v", value, got, err, want)
+		}
+	}
+	if got, err := parseTime("2026-03-01"); err != nil || !got.Equal(time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("parseTime(2026-03-01) = %v, %v, want midnight UTC", got, err)
+	}
+	for _, value := range []string{"", "yesterday", "03/01/2026", "2026-03-01 12:30", "2026-13-01"} {
+		if _, err := parseTime(value); err == nil || !strings.Contains(err.Error(), "invalid -at") {
+			t.Errorf("parseTime(%q) = %v, want an error", value, err)
+		}
+	}
+}
+
+func TestAtBeforeFirstCommit(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"lib/a.txt": "1\n"})
+	url := subgit.LocalURL(repo.dir, "main", "lib")
+
+	rootDir := t.TempDir()
+	out, code := runSubgit(t, "-root_dir", rootDir, "-at", "2000-01-01", url)
+	if code != subgit.ExitNotFound || !strings.Contains(out, "no commit on main at or before 2000-01-01T00:00:00Z") {
+		t.Errorf("fetch before the first commit exited with %d, want %d:\n%s", code, subgit.ExitNotFound, out)
+	}
+	if _, err := os.Stat(filepath.Join(rootDir, "lib", "a.txt")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("lib/a.txt was written: %v", err)
+	}
+
+	if out, code := runSubgit(t, "-root_dir", rootDir, "-at", "2100-01-01T00:00Z", url); code != 0 {
+		t.Fatalf("fetch at a later time exited with %d:\n%s", code, out)
+	}
+	if got := readFile(t, filepath.Join(rootDir, "lib", "a.txt")); got != "1\n" {
+		t.Errorf("lib/a.txt = %q, want the head", got)
+	}
+}
+
+// readEvents decodes the -output json events in the file at path.
+func readEvents(t *testing.T, path string) []map[string]any {
+	t.Helper()
+	events := []map[string]any{}
+	for _, line := range strings.Split(strings.TrimSuffix(readFile(t, path), "\n"), "\n") {
+		var event map[string]any
+		if err := json.Unmarshal([]byte(line), &event); err != nil {
+			t.Fatalf("event %q: %v", line, err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestJSONEvents(t *testing.T) {
+	repo := newTestRepo(t)
+	repo.commit(map[string]string{"lib/a.txt": "a\n", "lib/b.txt": "bb\n", "other/c.txt": "c\n"})
+	head := repo.git("rev-parse", "HEAD")
+	url := subgit.LocalURL(repo.dir, "main", "lib")
+	rootDir := t.TempDir()
+	eventsFile := filepath.Join(t.TempDir(), "events.ndjson")
+	fetch := func(extra ...string) []map[string]any {
+		t.Helper()
+		out, _ := runSubgit(t, append([]string{"-root_dir", rootDir, "-output", "json", "-events-file", eventsFile, url}, extra...)...)
+		events := readEvents(t, eventsFile)
+		if len(events) < 2 {
+			t.Fatalf("events = %v, output:\n%s", events, out)
+		}
+		return events
+	}
+
+	events := fetch()
+	if events[0]["event"] != subgit.EventListStart || events[1]["event"] != subgit.EventListDone || events[1]["total"] != 2.0 || events[1]["size"] != 5.0 {
+		t.Errorf("events start with %v, %v, want the listing of 2 files and 5 bytes", events[0], events[1])
+	}
+	started := map[string]bool{}
+	completed := []string{}
+	for _, event := range events[2 : len(events)-1] {
+		path, _ := event["path"].(string)
+		switch event["event"] {
+		case subgit.EventFileStart:
+			started[path] = true
+		case subgit.EventFileDone:
+			if !started[path] {
+				t.Errorf("%s completed before it started", path)
+			}
+			completed = append(completed, path)
+		case subgit.EventFileBytes:
+			t.Errorf("file_bytes event written: %v", event)
+		default:
+			t.Errorf("unexpected event %v", event)
+		}
+	}
+	if len(completed) != 2 {
+		t.Errorf("completed files = %q, want lib/a.txt and lib/b.txt", completed)
+	}
+	summary := events[len(events)-1]
+	for key, want := range map[string]any{"event": "summary", "commit": head, "files": 2.0, "changed": 2.0, "up_to_date": 0.0, "failed": 0.0, "exit_code": 0.0} {
+		if summary[key] != want {
+			t.Errorf("summary %s = %v, want %v", key, summary[key], want)
+		}
+	}
+
+	// Fetching again finds both files up to date.
+	events = fetch()
+	for _, event := range events[2 : len(events)-1] {
+		if event["event"] == subgit.EventFileDone && event["up_to_date"] != true {
+			t.Errorf("event %v, want only up to date files", event)
+		}
+	}
+	if summary := events[len(events)-1]; summary["up_to_date"] != 2.0 || summary["changed"] != 0.0 {
+		t.Errorf("summary = %v, want 2 files up to date and none changed", summary)
+	}
+
+	// A fetch that fails still ends with a summary, with the exit code.
+	events = fetch("-at", "2000-01-01")
+	summary = events[len(events)-1]
+	if summary["event"] != "summary" || summary["exit_code"] != float64(subgit.ExitNotFound) || !strings.Contains(fmt.Sprint(summary["error"]), "no commit on main") {
+		t.Errorf("summary = %v, want exit code %d and the error", summary, subgit.ExitNotFound)
+	}
+}
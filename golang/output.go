@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// Values of -output.
+const (
+	OutputText     = "text"
+	OutputJSON     = "json"
+	OutputMarkdown = "markdown" // subgit log only
+)
+
+// jsonEvent is one line of the -output json stream.
+type jsonEvent struct {
+	Time        time.Time `json:"time"`
+	Event       string    `json:"event"`
+	Path        string    `json:"path,omitempty"`
+	Sha         string    `json:"sha,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Total       int       `json:"total,omitempty"`
+	Attempt     int       `json:"attempt,omitempty"`
+	DurationMS  int64     `json:"duration_ms,omitempty"`
+	DelayMS     int64     `json:"delay_ms,omitempty"`
+	RateLimited bool      `json:"rate_limited,omitempty"`
+	UpToDate    bool      `json:"up_to_date,omitempty"`
+	Local       string    `json:"local,omitempty"`
+	Conflicts   int       `json:"conflicts,omitempty"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// jsonSummary is the last line of the -output json stream.
+type jsonSummary struct {
+	Time       time.Time `json:"time"`
+	Event      string    `json:"event"`
+	Commit     string    `json:"commit,omitempty"`
+	Tree       string    `json:"tree,omitempty"`
+	Files      int       `json:"files"`
+	UpToDate   int       `json:"up_to_date"`
+	Changed    int       `json:"changed"`
+	Failed     int       `json:"failed"`
+	Skipped    int       `json:"skipped"`
+	Conflicts  int       `json:"conflicts"`
+	Bytes      int64     `json:"bytes"`
+	DurationMS int64     `json:"duration_ms"`
+	ExitCode   int       `json:"exit_code"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// eventWriter writes fetch events as newline-delimited JSON.
+type eventWriter struct {
+	enc   *json.Encoder
+	start time.Time
+}
+
+func newEventWriter(w io.Writer) *eventWriter {
+	return &eventWriter{enc: json.NewEncoder(w), start: time.Now()}
+}
+
+func (ew *eventWriter) Event(event subgit.Event) {
+	if event.Type == subgit.EventFileBytes {
+		return // Too chatty for a log; file_completed has the size
+	}
+	if event.Type == subgit.EventListStart {
+		ew.start = time.Now() // Each sync of subgit watch has its own summary
+	}
+	line := jsonEvent{
+		Time:        time.Now().UTC(),
+		Event:       event.Type,
+		Path:        event.Path,
+		Sha:         event.Sha,
+		Size:        event.Size,
+		Total:       event.Total,
+		Attempt:     event.Attempt,
+		DurationMS:  event.Duration.Milliseconds(),
+		DelayMS:     event.Delay.Milliseconds(),
+		RateLimited: event.RateLimited,
+		UpToDate:    event.UpToDate,
+		Local:       event.Local,
+		Conflicts:   event.Conflicts,
+	}
+	if event.Err != nil {
+		line.Error = event.Err.Error()
+	}
+	ew.enc.Encode(line)
+}
+
+// Summary writes the final line; result may be nil if the tree could not
+// be listed.
+func (ew *eventWriter) Summary(result *subgit.Result, err error) {
+	summary := jsonSummary{
+		Time:       time.Now().UTC(),
+		Event:      "summary",
+		DurationMS: time.Since(ew.start).Milliseconds(),
+		ExitCode:   subgit.ExitCode(err),
+	}
+	if result != nil {
+		summary.Commit = result.Commit
+		summary.Tree = result.Tree
+		summary.Files = len(result.Files)
+		summary.Changed = len(result.Changed)
+		summary.Failed = len(result.Failed)
+		summary.Skipped = result.Skipped
+		summary.Bytes = result.Bytes
+		for _, file := range result.Files {
+			if file.UpToDate {
+				summary.UpToDate++
+			}
+			if file.Conflicts > 0 {
+				summary.Conflicts++
+			}
+		}
+	}
+	if err != nil {
+		summary.Error = err.Error()
+	}
+	ew.enc.Encode(summary)
+}
@@ -0,0 +1,243 @@
+package subgit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archive formats accepted by -archive-format.
+const (
+	FormatTar   = "tar"
+	FormatTarGz = "tar.gz"
+	FormatZip   = "zip"
+)
+
+// archiveModTime is stamped on every entry so that the same tree always
+// produces the same bytes. Zip cannot represent anything before 1980.
+var archiveModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ArchiveFormatFromName guesses the format from the extension of name,
+// defaulting to tar, e.g. for stdout.
+func ArchiveFormatFromName(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return FormatTarGz
+	case strings.HasSuffix(lower, ".zip"):
+		return FormatZip
+	}
+	return FormatTar
+}
+
+type archiveEntry struct {
+	content    string
+	mode       os.FileMode
+	linkTarget string
+}
+
+// ArchiveWriter collects fetched files in memory and writes them as a
+// reproducible archive on Close: entries sorted by name, fixed mtimes,
+// uid/gid 0 and the modes from git. Paths are relative to the subfolder,
+// so the archive can be used directly as e.g. a Docker build context.
+type ArchiveWriter struct {
+	Path   string // Destination file, "-" for stdout
+	Format string
+
+	mu      sync.Mutex
+	entries map[string]archiveEntry
+}
+
+func NewArchiveWriter(path, format string) (*ArchiveWriter, error) {
+	if format == "" {
+		format = ArchiveFormatFromName(path)
+	}
+	switch format {
+	case FormatTar, FormatTarGz, FormatZip:
+	default:
+		return nil, fmt.Errorf("unsupported archive format %q (use tar, tar.gz or zip)", format)
+	}
+
+	return &ArchiveWriter{
+		Path:    path,
+		Format:  format,
+		entries: map[string]archiveEntry{},
+	}, nil
+}
+
+func (aw *ArchiveWriter) AddFile(name string, content string, mode os.FileMode) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.entries[name] = archiveEntry{content: content, mode: mode}
+}
+
+func (aw *ArchiveWriter) AddSymlink(name string, target string) {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	aw.entries[name] = archiveEntry{mode: os.ModeSymlink | 0777, linkTarget: target}
+}
+
+// CopyEntries adds the file at src, or every entry below the directory at
+// src, under dst. It is the archive counterpart of CopySymlinkTarget.
+func (aw *ArchiveWriter) CopyEntries(dst string, src string) error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if entry, ok := aw.entries[src]; ok {
+		aw.entries[dst] = entry
+		return nil
+	}
+
+	copied := map[string]archiveEntry{}
+	for name, entry := range aw.entries {
+		if rel, ok := strings.CutPrefix(name, src+"/"); ok {
+			copied[path.Join(dst, rel)] = entry
+		}
+	}
+	if len(copied) == 0 {
+		return fmt.Errorf("error copying symlink %s: target %s was not fetched", dst, src)
+	}
+	for name, entry := range copied {
+		aw.entries[name] = entry
+	}
+	return nil
+}
+
+// Close writes the archive. Nothing is written to a file destination until
+// then, so a failed run does not leave a truncated archive behind.
+func (aw *ArchiveWriter) Close() error {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+
+	if aw.Path == "-" {
+		return aw.writeTo(os.Stdout)
+	}
+
+	var buf bytes.Buffer
+	if err := aw.writeTo(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(aw.Path, buf.Bytes(), 0644)
+}
+
+// sortedNames returns the entry names plus every parent directory, sorted
+// so that directories come before their contents.
+func (aw *ArchiveWriter) sortedNames() ([]string, map[string]bool) {
+	dirs := map[string]bool{}
+	names := []string{}
+	for name := range aw.entries {
+		names = append(names, name)
+		for dir := path.Dir(name); dir != "." && !dirs[dir]; dir = path.Dir(dir) {
+			dirs[dir] = true
+		}
+	}
+	for dir := range dirs {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	return names, dirs
+}
+
+func (aw *ArchiveWriter) writeTo(w io.Writer) error {
+	var err error
+	switch aw.Format {
+	case FormatZip:
+		err = aw.writeZip(w)
+	case FormatTarGz:
+		gz := gzip.NewWriter(w) // Zero header: no name and no mtime
+		if err = aw.writeTar(gz); err == nil {
+			err = gz.Close()
+		}
+	default:
+		err = aw.writeTar(w)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing archive %s: %w", aw.Path, err)
+	}
+	return nil
+}
+
+func (aw *ArchiveWriter) writeTar(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	names, dirs := aw.sortedNames()
+	for _, name := range names {
+		header := &tar.Header{
+			Name:    name,
+			ModTime: archiveModTime,
+			Uid:     0,
+			Gid:     0,
+		}
+
+		entry := aw.entries[name]
+		switch {
+		case dirs[name]:
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+			header.Mode = 0755
+		case entry.mode&os.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.linkTarget
+			header.Mode = 0777
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Mode = int64(entry.mode.Perm())
+			header.Size = int64(len(entry.content))
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if _, err := io.WriteString(tw, entry.content); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func (aw *ArchiveWriter) writeZip(w io.Writer) error {
+	zw := zip.NewWriter(w)
+	names, dirs := aw.sortedNames()
+	for _, name := range names {
+		header := &zip.FileHeader{
+			Name:     name,
+			Method:   zip.Deflate,
+			Modified: archiveModTime,
+		}
+
+		entry := aw.entries[name]
+		content := entry.content
+		switch {
+		case dirs[name]:
+			header.Name += "/"
+			header.Method = zip.Store
+			header.SetMode(os.ModeDir | 0755)
+		case entry.mode&os.ModeSymlink != 0:
+			// Unzip tools recreate links from the mode and the target
+			// stored as the content.
+			header.SetMode(os.ModeSymlink | 0777)
+			content = entry.linkTarget
+		default:
+			header.SetMode(entry.mode.Perm())
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(fw, content); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
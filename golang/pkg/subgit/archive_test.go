@@ -0,0 +1,163 @@
+package subgit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// archiveFiles is the tree written by the archive tests, below the
+// subfolder lib.
+var archiveFiles = map[string]string{
+	"lib/b.txt":       "b\n",
+	"lib/a.txt":       "a\n",
+	"lib/run.sh":      "#!/bin/sh\n",
+	"lib/dir/c.txt":   "c\n",
+	"lib/dir/sub/d":   "d\n",
+	"lib/link":        "a.txt",
+	"other/ignored.c": "x\n",
+}
+
+// wantArchive lists the archive entries and their modes, in order.
+var wantArchive = []struct {
+	name string
+	mode os.FileMode
+}{
+	{"a.txt", 0644},
+	{"b.txt", 0644},
+	{"dir/", os.ModeDir | 0755},
+	{"dir/c.txt", 0644},
+	{"dir/sub/", os.ModeDir | 0755},
+	{"dir/sub/d", 0644},
+	{"link", os.ModeSymlink | 0777},
+	{"run.sh", 0755},
+}
+
+// writeArchive fetches lib from f into an archive in format and returns
+// its bytes.
+func writeArchive(t *testing.T, f *fakeGitHub, format string, jobs int) []byte {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "out."+format)
+	aw, err := NewArchiveWriter(name, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := f.options("")
+	opts.Subfolder = "lib"
+	opts.Archive = aw
+	opts.Jobs = jobs
+	if _, err := f.fetch(t, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := aw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// TestArchiveReproducible writes the same commit twice, with a different
+// number of workers so that files arrive in another order, and checks
+// that the archives are identical and normalized.
+func TestArchiveReproducible(t *testing.T) {
+	f := newFakeGitHub(t, archiveFiles)
+	f.setMode("lib/run.sh", ModeExecutable)
+	f.setMode("lib/link", ModeSymlink)
+
+	t.Run(FormatTarGz, func(t *testing.T) {
+		first := writeArchive(t, f, FormatTarGz, 1)
+		if second := writeArchive(t, f, FormatTarGz, 8); !bytes.Equal(first, second) {
+			t.Fatal("archives of the same commit differ")
+		}
+
+		gz, err := gzip.NewReader(bytes.NewReader(first))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !gz.ModTime.IsZero() || gz.Name != "" {
+			t.Errorf("gzip header has mtime %v and name %q, want neither", gz.ModTime, gz.Name)
+		}
+		tr := tar.NewReader(gz)
+		for i := 0; ; i++ {
+			header, err := tr.Next()
+			if errors.Is(err, io.EOF) {
+				if i != len(wantArchive) {
+					t.Errorf("%d entries, want %d", i, len(wantArchive))
+				}
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if i >= len(wantArchive) {
+				t.Fatalf("unexpected entry %s", header.Name)
+			}
+			want := wantArchive[i]
+			if header.Name != want.name || header.FileInfo().Mode() != want.mode {
+				t.Errorf("entry %d = %s %v, want %s %v", i, header.Name, header.FileInfo().Mode(), want.name, want.mode)
+			}
+			if !header.ModTime.Equal(archiveModTime) {
+				t.Errorf("%s has mtime %v, want %v", header.Name, header.ModTime, archiveModTime)
+			}
+			if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+				t.Errorf("%s is owned by %d:%d (%q:%q), want 0:0 and no names", header.Name, header.Uid, header.Gid, header.Uname, header.Gname)
+			}
+			if header.Name == "link" && header.Linkname != "a.txt" {
+				t.Errorf("link points to %q, want a.txt", header.Linkname)
+			}
+		}
+	})
+
+	t.Run(FormatZip, func(t *testing.T) {
+		first := writeArchive(t, f, FormatZip, 1)
+		if second := writeArchive(t, f, FormatZip, 8); !bytes.Equal(first, second) {
+			t.Fatal("archives of the same commit differ")
+		}
+
+		zr, err := zip.NewReader(bytes.NewReader(first), int64(len(first)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []string{}
+		for _, file := range zr.File {
+			names = append(names, file.Name)
+			if !file.Modified.Equal(archiveModTime) {
+				t.Errorf("%s has mtime %v, want %v", file.Name, file.Modified, archiveModTime)
+			}
+		}
+		if !sort.StringsAreSorted(names) {
+			t.Errorf("entries %v are not sorted", names)
+		}
+		if len(zr.File) != len(wantArchive) {
+			t.Fatalf("entries = %v, want %d", names, len(wantArchive))
+		}
+		for i, want := range wantArchive {
+			if file := zr.File[i]; file.Name != want.name || file.Mode() != want.mode {
+				t.Errorf("entry %d = %s %v, want %s %v", i, file.Name, file.Mode(), want.name, want.mode)
+			}
+		}
+	})
+}
+
+func TestArchiveFormatFromName(t *testing.T) {
+	for name, want := range map[string]string{
+		"out.tar.gz": FormatTarGz,
+		"OUT.TGZ":    FormatTarGz,
+		"out.zip":    FormatZip,
+		"out.tar":    FormatTar,
+		"-":          FormatTar,
+	} {
+		if got := ArchiveFormatFromName(name); got != want {
+			t.Errorf("ArchiveFormatFromName(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
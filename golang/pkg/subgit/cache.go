@@ -0,0 +1,67 @@
+package subgit
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlobCache keeps blob contents by their git SHA. Blobs are immutable, so
+// a cached entry never goes stale.
+type BlobCache interface {
+	Get(sha string) ([]byte, bool)
+	Put(sha string, content []byte)
+}
+
+// MemoryCache is a BlobCache held in memory for the life of the process.
+type MemoryCache struct {
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{blobs: map[string][]byte{}}
+}
+
+func (c *MemoryCache) Get(sha string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	content, ok := c.blobs[sha]
+	return content, ok
+}
+
+func (c *MemoryCache) Put(sha string, content []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.blobs[sha] = content
+}
+
+// DirCache is a BlobCache stored below Dir, laid out like git's loose
+// objects, so that it can be shared between runs. Entries are checked
+// against their SHA on read, and write errors are ignored since the cache
+// is only an optimization.
+type DirCache struct {
+	Dir string
+}
+
+func (c DirCache) path(sha string) string {
+	return filepath.Join(c.Dir, sha[:2], sha[2:])
+}
+
+func (c DirCache) Get(sha string) ([]byte, bool) {
+	if len(sha) < 3 {
+		return nil, false
+	}
+	content, err := os.ReadFile(c.path(sha))
+	if err != nil || GitBlobSHA(content) != sha {
+		return nil, false
+	}
+	return content, true
+}
+
+func (c DirCache) Put(sha string, content []byte) {
+	if len(sha) < 3 {
+		return
+	}
+	writeFileAtomic(c.path(sha), content, 0644)
+}
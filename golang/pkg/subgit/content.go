@@ -0,0 +1,297 @@
+package subgit
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Ways of downloading file contents, in the order they are tried. Raw
+// downloads are cheapest, but some private repositories and fine-grained
+// tokens only work with the API.
+const (
+	strategyRaw      = iota // The raw content host
+	strategyBlob            // The git blobs API, by SHA
+	strategyContents        // The contents API, by path
+)
+
+// blobStreamSize is the size above which blobs are decoded while they
+// download rather than after.
+const blobStreamSize = 1 << 20
+
+// getFileContent downloads entry as of the commit Fetch resolved Branch
+// to, or the head of Branch outside of Fetch.
+func (gf *GithubFetcher) getFileContent(ctx context.Context, entry TreeEntry) (string, error) {
+	ref := "refs/heads/" + gf.Branch
+	if gf.local != nil {
+		ref = gf.Branch
+	}
+	if gf.commit != "" {
+		ref = gf.commit
+	}
+	return gf.getContent(ctx, ref, entry)
+}
+
+// getContent downloads entry as of ref. It starts with the strategy that
+// last worked and falls back to the next one when the server denies or
+// does not find the file, remembering the one that works for the rest of
+// the run. The blob strategy is skipped if entry has no SHA.
+func (gf *GithubFetcher) getContent(ctx context.Context, ref string, entry TreeEntry) (string, error) {
+	if gf.local != nil {
+		return gf.getLocalContent(ref, entry)
+	}
+
+	gf.mu.Lock()
+	first := gf.strategy
+	gf.mu.Unlock()
+
+	var firstErr error
+	for strategy := first; strategy <= strategyContents; strategy++ {
+		var content string
+		var err error
+		switch strategy {
+		case strategyRaw:
+			content, err = gf.getRaw(ctx, ref, entry.Path)
+		case strategyBlob:
+			if entry.Sha == "" {
+				continue
+			}
+			content, err = gf.getBlob(ctx, entry)
+		case strategyContents:
+			content, err = gf.getContents(ctx, ref, entry.Path)
+		}
+		if err == nil {
+			gf.mu.Lock()
+			gf.strategy = max(gf.strategy, strategy)
+			gf.mu.Unlock()
+			return content, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if !deniedOrMissing(err) {
+			return "", err
+		}
+	}
+	return "", firstErr
+}
+
+// deniedOrMissing reports whether err is a response another strategy may
+// not get.
+func deniedOrMissing(err error) bool {
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.RateLimited {
+		return false
+	}
+	switch httpErr.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// getBlob downloads entry through the git blobs API, streaming large blobs.
+func (gf *GithubFetcher) getBlob(ctx context.Context, entry TreeEntry) (string, error) {
+	if entry.Size > blobStreamSize {
+		return gf.streamBlob(ctx, entry)
+	}
+	content, err := gf.GetBlob(ctx, entry.Sha)
+	if err != nil {
+		return "", err
+	}
+	gf.emit(Event{Type: EventFileBytes, Path: entry.Path, Size: int64(len(content))})
+	return content, nil
+}
+
+// streamBlob is GetBlob for large blobs: the base64 content is decoded as
+// it arrives, so the encoded response is never held in memory. The
+// result is checked against the SHA, since the encoding is not.
+func (gf *GithubFetcher) streamBlob(ctx context.Context, entry TreeEntry) (string, error) {
+	url := fmt.Sprintf("%s/repos/%s/git/blobs/%s", gf.APIURL(), gf.RepoName, entry.Sha)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	if err := gf.authorize(req); err != nil {
+		return "", err
+	}
+
+	resp, err := gf.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPError(resp, url)
+	}
+	var body io.Reader = resp.Body
+	if gf.ClientOptions.StallTimeout > 0 {
+		sr := newStallReader(resp.Body, gf.ClientOptions.StallTimeout, url, cancel)
+		defer sr.Stop()
+		body = sr
+	}
+
+	encoded, err := blobContentReader(bufio.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("error decoding blob %s: %w", entry.Sha, gf.classifyTimeout(err, url))
+	}
+	var decoded io.Reader = base64.NewDecoder(base64.StdEncoding, encoded)
+	if gf.Progress != nil {
+		decoded = &progressReader{ReadCloser: io.NopCloser(decoded), gf: gf, path: entry.Path}
+	}
+	var content strings.Builder
+	content.Grow(int(entry.Size))
+	if _, err := io.Copy(&content, decoded); err != nil {
+		return "", fmt.Errorf("error decoding blob %s: %w", entry.Sha, gf.classifyTimeout(err, url))
+	}
+	if GitBlobSHA([]byte(content.String())) != entry.Sha {
+		return "", fmt.Errorf("error decoding blob %s: content does not match", entry.Sha)
+	}
+	return content.String(), nil
+}
+
+// blobContentReader skips to the content of a blobs API response and
+// returns a reader of the base64 text in that JSON string.
+func blobContentReader(r *bufio.Reader) (io.Reader, error) {
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		key, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if key != "content" {
+			var value json.RawMessage
+			if err := dec.Decode(&value); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// The decoder stops before the colon; read the string from there.
+		rest := bufio.NewReader(io.MultiReader(dec.Buffered(), r))
+		for {
+			c, err := rest.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			if c == '"' {
+				return &jsonStringReader{r: rest}, nil
+			}
+			if c != ':' && c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				return nil, fmt.Errorf("content is not a string")
+			}
+		}
+	}
+	return nil, fmt.Errorf("no content in response")
+}
+
+// jsonStringReader reads a JSON string up to its closing quote, undoing
+// the escapes base64 text may contain.
+type jsonStringReader struct {
+	r    *bufio.Reader
+	done bool
+}
+
+func (sr *jsonStringReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) && !sr.done {
+		c, err := sr.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return n, err
+		}
+		switch c {
+		case '"':
+			sr.done = true
+			continue
+		case '\\':
+			if c, err = sr.r.ReadByte(); err != nil {
+				return n, io.ErrUnexpectedEOF
+			}
+			switch c {
+			case 'n', 'r':
+				c = '\n' // Ignored by the base64 decoder
+			case '/', '\\':
+			case 'u':
+				// Encoders may escape any character, such as + and =.
+				var hex [4]byte
+				if _, err := io.ReadFull(sr.r, hex[:]); err != nil {
+					return n, io.ErrUnexpectedEOF
+				}
+				code, err := strconv.ParseUint(string(hex[:]), 16, 16)
+				if err != nil || code >= 0x80 {
+					return n, fmt.Errorf("unexpected escape \\u%s in base64 content", hex[:])
+				}
+				c = byte(code)
+			default:
+				return n, fmt.Errorf("unexpected escape \\%c in base64 content", c)
+			}
+		}
+		p[n] = c
+		n++
+	}
+	if n == 0 && sr.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+// getContents downloads the file at filepath as of ref through the
+// contents API, which serves files up to 100 MB.
+func (gf *GithubFetcher) getContents(ctx context.Context, ref string, filepath string) (string, error) {
+	segments := strings.Split(filepath, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	query := url.Values{}
+	query.Set("ref", ref)
+	contentsURL := fmt.Sprintf("%s/repos/%s/contents/%s?%s", gf.APIURL(), gf.RepoName, strings.Join(segments, "/"), query.Encode())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", contentsURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Accept", "application/vnd.github.raw")
+	if err := gf.authorize(req); err != nil {
+		return "", err
+	}
+
+	resp, err := gf.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", contentsURL, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPError(resp, contentsURL)
+	}
+	if gf.Progress != nil {
+		resp.Body = &progressReader{ReadCloser: resp.Body, gf: gf, path: filepath}
+	}
+
+	bodyBytes, err := gf.readBody(resp, contentsURL, cancel)
+	if err != nil {
+		return "", fmt.Errorf("error reading body from %s: %w", contentsURL, gf.classifyTimeout(err, contentsURL))
+	}
+	return string(bodyBytes), nil
+}
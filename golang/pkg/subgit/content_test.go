@@ -0,0 +1,172 @@
+package subgit
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// refuse makes the fake server answer requests whose path starts with one
+// of prefixes with 404.
+func refuse(f *fakeGitHub, prefixes ...string) {
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				http.NotFound(w, r)
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func TestGetContentFallback(t *testing.T) {
+	files := map[string]string{"a.txt": "a\n", "b.txt": "b\n", "c.txt": "c\n"}
+	tests := []struct {
+		name                 string
+		refused              []string
+		raw, blobs, contents int // Requests expected for each API
+	}{
+		{name: "raw", raw: 3},
+		{name: "blobs", refused: []string{"/raw/"}, raw: 1, blobs: 3},
+		{name: "contents", refused: []string{"/raw/", "/repos/o/r/git/blobs/"}, raw: 1, blobs: 1, contents: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGitHub(t, files)
+			refuse(f, tt.refused...)
+			rootDir := t.TempDir()
+			opts := f.options(rootDir)
+			opts.Jobs = 1 // So that only the first file tries what failed
+			if _, err := f.fetch(t, opts); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, rootDir, files)
+
+			raw, blobs, contents := 0, 0, 0
+			for name, content := range files {
+				raw += f.requests("/raw/o/r/" + f.commit + "/" + name)
+				blobs += f.requests("/repos/o/r/git/blobs/" + GitBlobSHA([]byte(content)))
+				contents += f.requests("/repos/o/r/contents/" + name)
+			}
+			if raw != tt.raw || blobs != tt.blobs || contents != tt.contents {
+				t.Errorf("%d raw, %d blob and %d contents requests, want %d, %d and %d", raw, blobs, contents, tt.raw, tt.blobs, tt.contents)
+			}
+		})
+	}
+}
+
+// TestGetContentNotFound checks that a file no strategy finds fails with
+// the error of the first one, which is not treated as an auth failure.
+func TestGetContentNotFound(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	refuse(f, "/raw/", "/repos/o/r/git/blobs/", "/repos/o/r/contents/")
+	result, err := f.fetch(t, f.options(t.TempDir()))
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || len(result.Failed) != 1 || !strings.Contains(result.Failed[0].Err.Error(), "/raw/") {
+		t.Fatalf("Fetch = %v, want the raw download's error", err)
+	}
+	if code := ExitCode(err); code != ExitPartialFailure {
+		t.Errorf("ExitCode = %d, want %d", code, ExitPartialFailure)
+	}
+}
+
+func TestDeniedOrMissing(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&HTTPError{StatusCode: http.StatusUnauthorized}, true},
+		{&HTTPError{StatusCode: http.StatusForbidden}, true},
+		{fmt.Errorf("wrapped: %w", &HTTPError{StatusCode: http.StatusNotFound}), true},
+		{&HTTPError{StatusCode: http.StatusForbidden, RateLimited: true}, false},
+		{&HTTPError{StatusCode: http.StatusInternalServerError}, false},
+		{errors.New("connection reset"), false},
+	}
+	for _, tt := range tests {
+		if got := deniedOrMissing(tt.err); got != tt.want {
+			t.Errorf("deniedOrMissing(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+// TestStreamBlob fetches a blob above blobStreamSize, escaped the way some
+// JSON encoders do, through the blobs API.
+func TestStreamBlob(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	large := make([]byte, blobStreamSize+12345)
+	rng.Read(large)
+	f := newFakeGitHub(t, map[string]string{"large.bin": string(large), "small.txt": "small\n"})
+
+	sha := GitBlobSHA(large)
+	escaped := strings.NewReplacer("+", `\u002b`, "=", `\u003D`, "/", `\/`, `\n`, `\r\n`).Replace(wrapBase64(string(large)))
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/raw/"):
+			http.NotFound(w, r)
+		case r.URL.Path == "/repos/o/r/git/blobs/"+sha:
+			fmt.Fprintf(w, `{"sha": %q, "size": %d, "url": "x", "content" : "%s", "encoding": "base64"}`, sha, len(large), escaped)
+		default:
+			return false
+		}
+		return true
+	}
+
+	rootDir := t.TempDir()
+	var streamed int64
+	opts := f.options(rootDir)
+	opts.Progress = func(event Event) {
+		if event.Type == EventFileBytes && event.Path == "large.bin" {
+			streamed += event.Size
+		}
+	}
+	if _, err := f.fetch(t, opts); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, rootDir, map[string]string{"large.bin": string(large), "small.txt": "small\n"})
+	if streamed != int64(len(large)) {
+		t.Errorf("progress reported %d bytes of large.bin, want %d", streamed, len(large))
+	}
+}
+
+func TestBlobContentReader(t *testing.T) {
+	content := "subgit streams blobs??>>"
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	tests := []struct {
+		body    string
+		wantErr bool
+	}{
+		{body: `{"content": "` + encoded + `"}`},
+		{body: `{"sha": "x", "nested": {"content": "no"}, "content":"` + encoded + `", "encoding": "base64"}`},
+		{body: `{"content": "` + strings.ReplaceAll(encoded, "/", `\/`) + `"}`},
+		{body: `{"content": "` + strings.ReplaceAll(encoded, "+", `\u002b`) + `"}`},
+		{body: `{"content": "` + encoded[:8] + `\n` + encoded[8:] + `"}`},
+		{body: `{"content": "` + encoded[:8] + `\u00e9` + encoded[8:] + `"}`, wantErr: true},
+		{body: `{"content": "` + encoded[:8] + `\u00zz` + encoded[8:] + `"}`, wantErr: true},
+		{body: `{"content": "` + encoded[:8] + `\t` + encoded[8:] + `"}`, wantErr: true},
+		{body: `{"content": "` + encoded[:8] + `\u00`, wantErr: true},
+		{body: `{"content": "` + encoded, wantErr: true},
+		{body: `{"content": 12}`, wantErr: true},
+		{body: `{"sha": "x"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		var got []byte
+		r, err := blobContentReader(bufio.NewReader(strings.NewReader(tt.body)))
+		if err == nil {
+			got, err = io.ReadAll(base64.NewDecoder(base64.StdEncoding, r))
+		}
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("reading %s = %q, want an error", tt.body, got)
+			}
+		} else if err != nil || string(got) != content {
+			t.Errorf("reading %s = %q, %v, want %q", tt.body, got, err, content)
+		}
+	}
+}
@@ -0,0 +1,321 @@
+package subgit
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultHost = "github.com"
+
+// gitCredentialTimeout bounds `git credential fill`, whose helpers may try
+// to reach a keychain or a network service.
+const gitCredentialTimeout = 10 * time.Second
+
+// Credential is a token together with the host it was issued for. It is
+// only ever sent to that host, so that a GitHub Enterprise token never
+// leaks to github.com or the other way round.
+type Credential struct {
+	Host   string
+	Token  string
+	Source string // Where the token was found, for diagnostics
+
+	app *appTokenSource // Set for GitHub App installations instead of Token
+}
+
+// CurrentToken returns the token to send, which for a GitHub App may have
+// just been minted or refreshed.
+func (c *Credential) CurrentToken(ctx context.Context) (string, error) {
+	if c.app != nil {
+		return c.app.Token(ctx)
+	}
+	return c.Token, nil
+}
+
+// AppliesTo reports whether the credential may be sent to requestHost.
+// github.com tokens also cover its API and raw content hosts.
+func (c *Credential) AppliesTo(requestHost string) bool {
+	if c == nil || (c.Token == "" && c.app == nil) {
+		return false
+	}
+	requestHost = strings.ToLower(requestHost)
+	if strings.EqualFold(c.Host, DefaultHost) {
+		return requestHost == "github.com" || requestHost == "api.github.com" || requestHost == "raw.githubusercontent.com"
+	}
+	return requestHost == strings.ToLower(hostname(c.Host))
+}
+
+// CredentialOptions holds the explicitly provided token sources, which take
+// precedence over discovery.
+type CredentialOptions struct {
+	Token      string    // Token given on the command line
+	TokenFile  string    // File holding the token
+	TokenStdin io.Reader // Read the token from here when non-nil
+}
+
+// ResolveCredential finds a token for host. Explicit options are tried
+// first, then in order: the GITHUB_TOKEN/GH_TOKEN environment variables
+// (GH_ENTERPRISE_TOKEN/GITHUB_ENTERPRISE_TOKEN for other hosts), the gh
+// CLI's hosts.yml, ~/.netrc and `git credential fill`. It returns nil
+// without error when no token is found, for anonymous access.
+func ResolveCredential(host string, opts CredentialOptions) (*Credential, error) {
+	if opts.Token != "" {
+		return &Credential{Host: host, Token: opts.Token, Source: "-pat-token"}, nil
+	}
+	if opts.TokenFile != "" {
+		data, err := os.ReadFile(opts.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token file: %w", err)
+		}
+		return explicitCredential(host, string(data), opts.TokenFile)
+	}
+	if opts.TokenStdin != nil {
+		data, err := io.ReadAll(opts.TokenStdin)
+		if err != nil {
+			return nil, fmt.Errorf("error reading token from stdin: %w", err)
+		}
+		return explicitCredential(host, string(data), "stdin")
+	}
+
+	if token, source := envToken(host); token != "" {
+		return &Credential{Host: host, Token: token, Source: source}, nil
+	}
+
+	discoverers := []func(string) (string, string, error){
+		ghHostsToken,
+		netrcToken,
+		gitCredentialToken,
+	}
+	for _, discover := range discoverers {
+		token, source, err := discover(host)
+		if err != nil {
+			return nil, err
+		}
+		if token != "" {
+			return &Credential{Host: host, Token: token, Source: source}, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func explicitCredential(host, token, source string) (*Credential, error) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return nil, fmt.Errorf("no token found in %s", source)
+	}
+	return &Credential{Host: host, Token: token, Source: source}, nil
+}
+
+// envToken follows the gh CLI: GH_TOKEN and GITHUB_TOKEN are for
+// github.com only, the enterprise variables for any other host.
+func envToken(host string) (string, string) {
+	names := []string{"GITHUB_TOKEN", "GH_TOKEN"}
+	if !strings.EqualFold(host, DefaultHost) {
+		names = []string{"GH_ENTERPRISE_TOKEN", "GITHUB_ENTERPRISE_TOKEN"}
+	}
+	for _, name := range names {
+		if token := strings.TrimSpace(os.Getenv(name)); token != "" {
+			return token, "$" + name
+		}
+	}
+	return "", ""
+}
+
+// ghHostsToken reads the token stored by `gh auth login`. Recent gh
+// versions keep it in the system keyring instead, in which case there is
+// nothing to find here.
+func ghHostsToken(host string) (string, string, error) {
+	path := ghHostsPath()
+	if path == "" {
+		return "", "", nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	var hosts map[string]struct {
+		OAuthToken string `yaml:"oauth_token"`
+		User       string `yaml:"user"`
+		Users      map[string]struct {
+			OAuthToken string `yaml:"oauth_token"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(data, &hosts); err != nil {
+		return "", "", fmt.Errorf("error parsing %s: %w", path, err)
+	}
+
+	for name, entry := range hosts {
+		if !strings.EqualFold(name, host) {
+			continue
+		}
+		if entry.OAuthToken != "" {
+			return entry.OAuthToken, path, nil
+		}
+		if user, ok := entry.Users[entry.User]; ok && user.OAuthToken != "" {
+			return user.OAuthToken, path, nil
+		}
+	}
+	return "", "", nil
+}
+
+func ghHostsPath() string {
+	if dir := os.Getenv("GH_CONFIG_DIR"); dir != "" {
+		return filepath.Join(dir, "hosts.yml")
+	}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		return filepath.Join(dir, "gh", "hosts.yml")
+	}
+	if runtime.GOOS == "windows" {
+		if dir := os.Getenv("AppData"); dir != "" {
+			return filepath.Join(dir, "GitHub CLI", "hosts.yml")
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gh", "hosts.yml")
+}
+
+// netrcToken uses the password of the netrc machine entry for host. For
+// github.com the api.github.com entry is accepted too.
+func netrcToken(host string) (string, string, error) {
+	path := os.Getenv("NETRC")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", "", nil
+		}
+		path = filepath.Join(home, ".netrc")
+		if runtime.GOOS == "windows" {
+			path = filepath.Join(home, "_netrc")
+		}
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", fmt.Errorf("error reading %s: %w", path, err)
+	}
+
+	machines := []string{strings.ToLower(hostname(host))}
+	if strings.EqualFold(host, DefaultHost) {
+		machines = append(machines, "api.github.com")
+	}
+	passwords := parseNetrc(string(data))
+	for _, machine := range machines {
+		if password := passwords[machine]; password != "" {
+			return password, path, nil
+		}
+	}
+	return "", "", nil
+}
+
+// parseNetrc returns the password of each machine. The "default" entry is
+// deliberately ignored since it would send one token to every host.
+func parseNetrc(data string) map[string]string {
+	fields := []string{}
+	inMacro := false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// A macro body runs until an empty line.
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		lineFields := strings.Fields(line)
+		if i := slices.Index(lineFields, "macdef"); i >= 0 {
+			lineFields, inMacro = lineFields[:i], true
+		}
+		fields = append(fields, lineFields...)
+	}
+
+	passwords := map[string]string{}
+	machine := ""
+	for i := 0; i < len(fields); i++ {
+		switch fields[i] {
+		case "machine":
+			if i+1 < len(fields) {
+				i++
+				machine = strings.ToLower(fields[i])
+			}
+		case "default":
+			machine = ""
+		case "password":
+			if i+1 < len(fields) {
+				i++
+				if machine != "" {
+					passwords[machine] = fields[i]
+				}
+			}
+		}
+	}
+	return passwords
+}
+
+// gitCredentialToken asks the configured git credential helpers, without
+// allowing them to prompt.
+func gitCredentialToken(host string) (string, string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", "", nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), gitCredentialTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", "credential", "fill")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never", "GIT_ASKPASS=", "SSH_ASKPASS=")
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Run(); err != nil {
+		// No helper has a credential for this host.
+		return "", "", nil
+	}
+
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		if password, ok := strings.CutPrefix(scanner.Text(), "password="); ok && password != "" {
+			return password, "git credential fill", nil
+		}
+	}
+	return "", "", nil
+}
+
+// hostname strips a port from host.
+func hostname(host string) string {
+	if i := strings.LastIndex(host, ":"); i >= 0 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// authorize adds the credential to req when it is scoped to req's host.
+func (gf *GithubFetcher) authorize(req *http.Request) error {
+	if !gf.Credential.AppliesTo(req.URL.Hostname()) {
+		return nil
+	}
+	token, err := gf.Credential.CurrentToken(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	return nil
+}
@@ -0,0 +1,284 @@
+package subgit
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestCredentialAppliesTo(t *testing.T) {
+	tests := []struct {
+		host  string
+		hosts map[string]bool
+	}{
+		{
+			host: "github.com",
+			hosts: map[string]bool{
+				"github.com":                true,
+				"GitHub.com":                true,
+				"api.github.com":            true,
+				"raw.githubusercontent.com": true,
+				"gist.github.com":           false,
+				"github.com.example.com":    false,
+				"ghe.example.com":           false,
+			},
+		},
+		{
+			host: "ghe.example.com",
+			hosts: map[string]bool{
+				"ghe.example.com":           true,
+				"GHE.example.com":           true,
+				"github.com":                false,
+				"api.github.com":            false,
+				"raw.githubusercontent.com": false,
+				"api.ghe.example.com":       false,
+			},
+		},
+		{
+			// Requests are matched by URL.Hostname, which has no port.
+			host: "ghe.example.com:8443",
+			hosts: map[string]bool{
+				"ghe.example.com": true,
+				"github.com":      false,
+				"api.github.com":  false,
+			},
+		},
+	}
+	for _, tt := range tests {
+		credential := &Credential{Host: tt.host, Token: "secret"}
+		for host, want := range tt.hosts {
+			if got := credential.AppliesTo(host); got != want {
+				t.Errorf("credential for %s AppliesTo(%s) = %v, want %v", tt.host, host, got, want)
+			}
+		}
+	}
+
+	var none *Credential
+	if none.AppliesTo("github.com") || (&Credential{Host: "github.com"}).AppliesTo("github.com") {
+		t.Error("a missing or empty credential applies")
+	}
+}
+
+// TestAuthorizeScope sends requests to the fake server with credentials
+// for it and for other hosts, and checks which ones carry the token.
+func TestAuthorizeScope(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	var mu sync.Mutex
+	var authorization []string
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		return false
+	}
+	host := strings.TrimPrefix(f.URL, "https://")
+	for _, tt := range []struct {
+		credential *Credential
+		want       string
+	}{
+		{&Credential{Host: host, Token: "ghe"}, "token ghe"},
+		{&Credential{Host: "127.0.0.1", Token: "no-port"}, "token no-port"},
+		{&Credential{Host: "github.com", Token: "dotcom"}, ""},
+		{&Credential{Host: "ghe.example.com", Token: "other"}, ""},
+		{nil, ""},
+	} {
+		authorization = nil
+		opts := f.options(t.TempDir())
+		opts.Credential = tt.credential
+		if _, err := f.fetch(t, opts); err != nil {
+			t.Fatal(err)
+		}
+		for _, got := range authorization {
+			if got != tt.want {
+				t.Errorf("credential %+v sent Authorization %q, want %q", tt.credential, got, tt.want)
+			}
+		}
+	}
+}
+
+// setCredentialSources points every token source at a temporary file and
+// clears the environment variables, so that the host's own tokens are not
+// found.
+func setCredentialSources(t *testing.T) (hostsPath, netrcPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, name := range []string{"GITHUB_TOKEN", "GH_TOKEN", "GH_ENTERPRISE_TOKEN", "GITHUB_ENTERPRISE_TOKEN", "XDG_CONFIG_HOME"} {
+		t.Setenv(name, "")
+	}
+	t.Setenv("HOME", dir)
+	t.Setenv("GH_CONFIG_DIR", dir)
+	t.Setenv("NETRC", filepath.Join(dir, "netrc"))
+	t.Setenv("GIT_CONFIG_GLOBAL", os.DevNull)
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	return filepath.Join(dir, "hosts.yml"), filepath.Join(dir, "netrc")
+}
+
+func TestEnvToken(t *testing.T) {
+	setCredentialSources(t)
+	t.Setenv("GITHUB_TOKEN", "dotcom")
+	t.Setenv("GH_TOKEN", "gh")
+	t.Setenv("GH_ENTERPRISE_TOKEN", " enterprise\n")
+	t.Setenv("GITHUB_ENTERPRISE_TOKEN", "github-enterprise")
+
+	check := func(host, wantToken, wantSource string) {
+		t.Helper()
+		if token, source := envToken(host); token != wantToken || source != wantSource {
+			t.Errorf("envToken(%s) = %q from %q, want %q from %q", host, token, source, wantToken, wantSource)
+		}
+	}
+	check("github.com", "dotcom", "$GITHUB_TOKEN")
+	check("ghe.example.com", "enterprise", "$GH_ENTERPRISE_TOKEN")
+
+	t.Setenv("GITHUB_TOKEN", "")
+	t.Setenv("GH_ENTERPRISE_TOKEN", "")
+	check("github.com", "gh", "$GH_TOKEN")
+	check("ghe.example.com", "github-enterprise", "$GITHUB_ENTERPRISE_TOKEN")
+
+	// A github.com token is never used for another host.
+	t.Setenv("GITHUB_ENTERPRISE_TOKEN", "")
+	check("ghe.example.com", "", "")
+}
+
+func TestParseNetrc(t *testing.T) {
+	netrc := `machine github.com login me password dotcom
+default login anonymous password everywhere
+
+machine ghe.example.com
+  login me
+  password enterprise
+macdef init
+  machine ignored.example.com password inside-macro
+  cd /pub
+
+machine API.example.com login me password api
+machine nopassword.example.com login me
+`
+	want := map[string]string{
+		"github.com":      "dotcom",
+		"ghe.example.com": "enterprise",
+		"api.example.com": "api",
+	}
+	if got := parseNetrc(netrc); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseNetrc = %v, want %v", got, want)
+	}
+}
+
+func TestNetrcToken(t *testing.T) {
+	_, netrcPath := setCredentialSources(t)
+	if err := os.WriteFile(netrcPath, []byte("machine api.github.com password api\nmachine ghe.example.com password ghe\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"github.com":           "api", // From the API host's entry
+		"ghe.example.com":      "ghe",
+		"ghe.example.com:8443": "ghe",
+		"api.ghe.example.com":  "",
+		"other.example.com":    "",
+	} {
+		if token, _, err := netrcToken(host); err != nil || token != want {
+			t.Errorf("netrcToken(%s) = %q, %v, want %q", host, token, err, want)
+		}
+	}
+}
+
+func TestGhHostsToken(t *testing.T) {
+	hostsPath, _ := setCredentialSources(t)
+	hosts := `github.com:
+    user: me
+    oauth_token: direct
+    git_protocol: https
+ghe.example.com:
+    user: me
+    users:
+        me:
+            oauth_token: per-user
+        other:
+            oauth_token: not-active
+keyring.example.com:
+    user: me
+    users:
+        me: {}
+`
+	if err := os.WriteFile(hostsPath, []byte(hosts), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]string{
+		"github.com":          "direct",
+		"GHE.example.com":     "per-user",
+		"keyring.example.com": "", // Stored in the keyring
+		"missing.example.com": "",
+	} {
+		if token, _, err := ghHostsToken(host); err != nil || token != want {
+			t.Errorf("ghHostsToken(%s) = %q, %v, want %q", host, token, err, want)
+		}
+	}
+}
+
+// TestResolveCredentialOrder removes the sources one by one, from the
+// first in the chain, and checks that the next one is used.
+func TestResolveCredentialOrder(t *testing.T) {
+	hostsPath, netrcPath := setCredentialSources(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("from-file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("GH_ENTERPRISE_TOKEN", "from-env")
+	t.Setenv("GITHUB_TOKEN", "dotcom-env")
+	if err := os.WriteFile(hostsPath, []byte("ghe.example.com:\n    oauth_token: from-gh\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(netrcPath, []byte("machine ghe.example.com password from-netrc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	resolve := func(opts CredentialOptions) *Credential {
+		t.Helper()
+		credential, err := ResolveCredential("ghe.example.com", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return credential
+	}
+	steps := []struct {
+		opts       CredentialOptions
+		remove     func()
+		want       string
+		wantSource string
+	}{
+		{opts: CredentialOptions{Token: "from-flag", TokenFile: tokenFile, TokenStdin: strings.NewReader("stdin")}, want: "from-flag", wantSource: "-pat-token"},
+		{opts: CredentialOptions{TokenFile: tokenFile, TokenStdin: strings.NewReader("stdin")}, want: "from-file", wantSource: tokenFile},
+		{opts: CredentialOptions{TokenStdin: strings.NewReader(" from-stdin\n")}, want: "from-stdin", wantSource: "stdin"},
+		{want: "from-env", wantSource: "$GH_ENTERPRISE_TOKEN", remove: func() { t.Setenv("GH_ENTERPRISE_TOKEN", "") }},
+		{want: "from-gh", wantSource: hostsPath, remove: func() { os.Remove(hostsPath) }},
+		{want: "from-netrc", wantSource: netrcPath, remove: func() { os.Remove(netrcPath) }},
+	}
+	for _, step := range steps {
+		credential := resolve(step.opts)
+		if credential == nil || credential.Token != step.want || credential.Source != step.wantSource || credential.Host != "ghe.example.com" {
+			t.Fatalf("ResolveCredential = %+v, want %s from %s", credential, step.want, step.wantSource)
+		}
+		if step.remove != nil {
+			step.remove()
+		}
+	}
+	// GITHUB_TOKEN is still set, but it is for github.com.
+	if credential := resolve(CredentialOptions{}); credential != nil {
+		t.Errorf("ResolveCredential = %+v, want none", credential)
+	}
+
+	if _, err := ResolveCredential("ghe.example.com", CredentialOptions{TokenStdin: strings.NewReader("\n")}); err == nil {
+		t.Error("ResolveCredential accepted an empty token from stdin")
+	}
+}
+
+func TestCurrentToken(t *testing.T) {
+	token, err := (&Credential{Host: "github.com", Token: "static"}).CurrentToken(context.Background())
+	if err != nil || token != "static" {
+		t.Errorf("CurrentToken = %q, %v, want the static token", token, err)
+	}
+}
@@ -0,0 +1,203 @@
+package subgit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Statuses of a FileDiff, as in git diff --name-status.
+const (
+	DiffAdded    = "A"
+	DiffModified = "M"
+	DiffDeleted  = "D"
+)
+
+// FileDiff describes how the upstream version of a file differs from the
+// local one.
+type FileDiff struct {
+	Path        string // Repository path
+	Status      string // DiffAdded, DiffModified or DiffDeleted upstream
+	LocalSha    string // Blob SHA of the local file, empty if there is none
+	UpstreamSha string // Blob SHA upstream, empty if there is none
+	Binary      bool
+	Insertions  int
+	Deletions   int
+	Patch       string // Unified diff from the local to the upstream version
+}
+
+// DiffResult is the outcome of Diff.
+type DiffResult struct {
+	Commit string     // The upstream commit compared against
+	Files  []FileDiff // Files that differ, sorted by path
+}
+
+// Diff compares the files in RootDir with the subfolder at the commit
+// Branch points to, or the one at At, without changing anything. Files
+// are compared by blob SHA, so only those that differ are downloaded.
+func (gf *GithubFetcher) Diff(ctx context.Context) (*DiffResult, error) {
+	commit, err := gf.resolveBranch(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, entries, err := gf.ListTree(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+	upstream := map[string]TreeEntry{}
+	for _, entry := range entries {
+		upstream[entry.Path] = entry
+	}
+	local, err := gf.localFiles(upstream)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for p := range local {
+		paths = append(paths, p)
+	}
+	for p := range upstream {
+		if _, ok := local[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	diffs := []FileDiff{}
+	for _, p := range paths {
+		entry, inUpstream := upstream[p]
+		localSha, inLocal := local[p]
+		diff := FileDiff{Path: p, LocalSha: localSha, UpstreamSha: entry.Sha}
+		switch {
+		case !inUpstream:
+			diff.Status = DiffDeleted
+		case !inLocal:
+			diff.Status = DiffAdded
+		case localSha != entry.Sha || !gf.sameMode(entry):
+			diff.Status = DiffModified
+		default:
+			continue
+		}
+		diffs = append(diffs, diff)
+	}
+
+	// Download the upstream side of the files that differ, with as many
+	// requests at once as a fetch would make.
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, gf.Jobs)
+	for i := range diffs {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(diff *FileDiff) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if err := gf.diffFile(ctx, commit, diff, upstream[diff.Path]); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(&diffs[i])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return &DiffResult{Commit: commit, Files: diffs}, nil
+}
+
+// diffFile fills in the patch of diff.
+func (gf *GithubFetcher) diffFile(ctx context.Context, commit string, diff *FileDiff, entry TreeEntry) error {
+	var localFile, upstreamFile *patchFile
+	if diff.Status != DiffAdded {
+		var err error
+		localFile, err = readDiffFile(filepath.Join(gf.RootDir, diff.Path))
+		if err != nil {
+			return err
+		}
+	}
+	if diff.Status != DiffDeleted {
+		content, err := gf.getContent(ctx, commit, entry)
+		if err != nil {
+			return err
+		}
+		upstreamFile = &patchFile{content: []byte(content), mode: entry.FileMode()}
+		if entry.IsSymlink() {
+			upstreamFile.mode = os.ModeSymlink
+		}
+	}
+
+	var patch strings.Builder
+	diff.Insertions, diff.Deletions = writeFileDiff(&patch, diff.Path, localFile, upstreamFile)
+	diff.Patch = patch.String()
+	diff.Binary = (localFile != nil && isBinary(localFile.content)) || (upstreamFile != nil && isBinary(upstreamFile.content))
+	return nil
+}
+
+// localFiles returns the blob SHA of the local copy of each file that is
+// upstream or that the state file records, keyed by repository path. Other
+// local files, such as backups and build output, were not written by subgit
+// and are left out rather than shown as deleted upstream.
+func (gf *GithubFetcher) localFiles(upstream map[string]TreeEntry) (map[string]string, error) {
+	state, err := LoadState(gf.RootDir)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for p := range upstream {
+		paths = append(paths, p)
+	}
+	if state.sameSource(gf) {
+		for p := range state.Files {
+			if _, ok := upstream[p]; !ok && gf.inSubfolder(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+
+	files := map[string]string{}
+	for _, p := range paths {
+		if sha, ok := localBlobSHA(filepath.Join(gf.RootDir, filepath.FromSlash(p))); ok && sha != "" {
+			files[p] = sha
+		}
+	}
+	return files, nil
+}
+
+// sameMode reports whether the local copy of entry has the executable bit
+// git expects; symlinks are compared by SHA alone.
+func (gf *GithubFetcher) sameMode(entry TreeEntry) bool {
+	if entry.IsSymlink() {
+		return true
+	}
+	info, err := os.Lstat(filepath.Join(gf.RootDir, entry.Path))
+	return err == nil && gitFileMode(info.Mode()) == entry.Mode
+}
+
+// readDiffFile reads a local file for a diff, symlinks as their target.
+func readDiffFile(fullPath string) (*patchFile, error) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return nil, err
+		}
+		return &patchFile{content: []byte(filepath.ToSlash(target)), mode: os.ModeSymlink}, nil
+	}
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, err
+	}
+	return &patchFile{content: content, mode: info.Mode().Perm()}, nil
+}
@@ -0,0 +1,97 @@
+package subgit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("needs symlinks and the executable bit")
+	}
+	f := newFakeGitHub(t, map[string]string{
+		"lib/a.txt":    "a\n",
+		"lib/b.txt":    "b\n",
+		"lib/gone.txt": "gone\n",
+		"lib/run.sh":   "#!/bin/sh\n",
+		"lib/link":     "a.txt",
+		"other/c.txt":  "c\n",
+	})
+	f.setMode("lib/link", ModeSymlink)
+	rootDir := t.TempDir()
+	opts := f.options(rootDir)
+	opts.Subfolder = "lib"
+	if _, err := f.fetch(t, opts); err != nil {
+		t.Fatal(err)
+	}
+	// Files subgit did not write are not part of the diff.
+	writeTestFile(t, rootDir, "lib/b.txt.orig", "b\n")
+	writeTestFile(t, rootDir, "lib/notes.txt", "notes\n")
+
+	f.setFiles(map[string]string{
+		"lib/a.txt":   "a2\n",
+		"lib/b.txt":   "b\n",
+		"lib/new.txt": "new\n",
+		"lib/run.sh":  "#!/bin/sh\n",
+		"lib/link":    "b.txt",
+		"other/c.txt": "c2\n",
+	})
+	f.setMode("lib/run.sh", ModeExecutable)
+
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gf.Diff(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Commit != f.commit {
+		t.Errorf("commit = %s, want %s", result.Commit, f.commit)
+	}
+
+	want := []struct {
+		path, status string
+		patch        []string // Lines the patch must have
+	}{
+		{"lib/a.txt", DiffModified, []string{"-a", "+a2"}},
+		{"lib/gone.txt", DiffDeleted, []string{"deleted file mode 100644", "-gone"}},
+		{"lib/link", DiffModified, []string{"-a.txt", "+b.txt"}},
+		{"lib/new.txt", DiffAdded, []string{"new file mode 100644", "+new"}},
+		{"lib/run.sh", DiffModified, []string{"old mode 100644", "new mode 100755"}},
+	}
+	if len(result.Files) != len(want) {
+		paths := []string{}
+		for _, diff := range result.Files {
+			paths = append(paths, diff.Status+" "+diff.Path)
+		}
+		t.Fatalf("diff = %q, want %d files", paths, len(want))
+	}
+	for i, w := range want {
+		diff := result.Files[i]
+		if diff.Path != w.path || diff.Status != w.status {
+			t.Errorf("file %d = %s %s, want %s %s", i, diff.Status, diff.Path, w.status, w.path)
+			continue
+		}
+		lines := strings.Split(diff.Patch, "\n")
+		for _, line := range w.patch {
+			if !slices.Contains(lines, line) {
+				t.Errorf("patch of %s has no line %q:\n%s", w.path, line, diff.Patch)
+			}
+		}
+	}
+	if diff := result.Files[4]; diff.Insertions != 0 || diff.Deletions != 0 {
+		t.Errorf("mode change of run.sh has %d insertions and %d deletions, want none", diff.Insertions, diff.Deletions)
+	}
+
+	// Nothing was written.
+	checkFiles(t, rootDir, map[string]string{"lib/a.txt": "a\n", "lib/gone.txt": "gone\n", "lib/new.txt": ""})
+	if target, err := os.Readlink(filepath.Join(rootDir, "lib", "link")); err != nil || target != "a.txt" {
+		t.Errorf("lib/link points to %q, %v, want a.txt", target, err)
+	}
+}
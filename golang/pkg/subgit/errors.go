@@ -0,0 +1,253 @@
+package subgit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Exit codes of the CLI. 2 is left to the flag package for usage errors.
+const (
+	ExitOK             = 0
+	ExitError          = 1
+	ExitPartialFailure = 3
+	ExitAuthFailure    = 4
+	ExitNotFound       = 5
+	ExitRateLimited    = 6
+	ExitLocalChanges   = 8
+	ExitConflicts      = 9
+	ExitPatchFailed    = 10
+	ExitHookFailed     = 11
+	ExitTimeout        = 124 // As timeout(1)
+	ExitInterrupted    = 130 // Shell convention for SIGINT
+)
+
+// HTTPError is returned for any response other than 200 OK.
+type HTTPError struct {
+	StatusCode  int
+	URL         string
+	Message     string
+	RateLimited bool
+	RetryAfter  time.Duration // How long the server asked us to wait, if it did
+}
+
+func (e *HTTPError) Error() string {
+	if e.RateLimited {
+		return fmt.Sprintf("error %d for %s: rate limit exceeded", e.StatusCode, e.URL)
+	}
+	if e.Message != "" {
+		return fmt.Sprintf("error %d for %s: %s", e.StatusCode, e.URL, e.Message)
+	}
+	return fmt.Sprintf("error %d for %s", e.StatusCode, e.URL)
+}
+
+// newHTTPError builds an HTTPError from a failed response. GitHub reports
+// both primary and secondary rate limits as 403 or 429, so those are told
+// apart from authorization failures by their headers and message.
+func newHTTPError(resp *http.Response, url string) *HTTPError {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	var apiError struct {
+		Message string `json:"message"`
+	}
+	message := strings.TrimSpace(string(body))
+	if jsonErr := json.Unmarshal(body, &apiError); jsonErr == nil && apiError.Message != "" {
+		message = apiError.Message
+	}
+
+	rateLimited := resp.StatusCode == http.StatusTooManyRequests
+	if resp.StatusCode == http.StatusForbidden {
+		rateLimited = resp.Header.Get("X-RateLimit-Remaining") == "0" ||
+			resp.Header.Get("Retry-After") != "" ||
+			strings.Contains(strings.ToLower(message), "rate limit")
+	}
+
+	return &HTTPError{
+		StatusCode:  resp.StatusCode,
+		URL:         url,
+		Message:     message,
+		RateLimited: rateLimited,
+		RetryAfter:  retryAfter(resp.Header),
+	}
+}
+
+// retryAfter reads the wait requested by Retry-After or, for the primary
+// rate limit, implied by X-RateLimit-Reset.
+func retryAfter(header http.Header) time.Duration {
+	if seconds, err := strconv.Atoi(header.Get("Retry-After")); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return max(0, time.Until(time.Unix(reset, 0)))
+		}
+	}
+	return 0
+}
+
+// FileError records why a single file could not be fetched.
+type FileError struct {
+	Path string
+	Err  error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Path, e.Err)
+}
+
+func (e FileError) Unwrap() error {
+	return e.Err
+}
+
+// FetchError is returned by Fetch when some of the files failed or the
+// run was interrupted.
+type FetchError struct {
+	Total       int
+	Skipped     int // Files not downloaded after fail-fast or an interrupt
+	Failed      []FileError
+	Interrupted bool
+	TimedOut    bool          // The overall deadline expired
+	Deadline    time.Duration // The deadline, for reporting
+}
+
+// Completed returns the number of files that were downloaded.
+func (e *FetchError) Completed() int {
+	return e.Total - e.Skipped - len(e.Failed)
+}
+
+func (e *FetchError) Error() string {
+	if e.Interrupted {
+		return fmt.Sprintf("interrupted with %d of %d files remaining", e.Skipped, e.Total)
+	}
+	if e.TimedOut {
+		return fmt.Sprintf("deadline of %s exceeded with %d of %d files remaining", e.Deadline, e.Skipped, e.Total)
+	}
+	if e.Skipped > 0 {
+		return fmt.Sprintf("%d of %d files failed, %d skipped", len(e.Failed), e.Total, e.Skipped)
+	}
+	return fmt.Sprintf("%d of %d files failed", len(e.Failed), e.Total)
+}
+
+// LocalChangesError is returned by Fetch when files were changed locally
+// and the policy is PolicyAbort. Nothing has been written.
+type LocalChangesError struct {
+	Paths []string
+}
+
+func (e *LocalChangesError) Error() string {
+	if len(e.Paths) == 1 {
+		return fmt.Sprintf("%s was changed locally", e.Paths[0])
+	}
+	return fmt.Sprintf("%d files were changed locally", len(e.Paths))
+}
+
+// ConflictError is returned by Fetch when every file was written but some
+// merges had conflicts, see Options.WriteConflicts.
+type ConflictError struct {
+	Paths []string
+}
+
+func (e *ConflictError) Error() string {
+	if len(e.Paths) == 1 {
+		return fmt.Sprintf("%s has merge conflicts", e.Paths[0])
+	}
+	return fmt.Sprintf("%d files have merge conflicts", len(e.Paths))
+}
+
+// NoCommitError is returned when At is before the first commit on Branch.
+type NoCommitError struct {
+	Branch string
+	At     time.Time
+}
+
+func (e *NoCommitError) Error() string {
+	return fmt.Sprintf("no commit on %s at or before %s, the branch starts later", e.Branch, e.At.UTC().Format(time.RFC3339))
+}
+
+// ExitCode maps an error returned by Fetch to the process exit code.
+// Rate limiting and authorization failures take precedence over a plain
+// partial failure, since they apply to the whole run.
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+
+	var fetchErr *FetchError
+	if errors.As(err, &fetchErr) {
+		if fetchErr.Interrupted {
+			return ExitInterrupted
+		}
+		if fetchErr.TimedOut {
+			return ExitTimeout
+		}
+		code := ExitPartialFailure
+		for _, failure := range fetchErr.Failed {
+			switch classify(failure.Err) {
+			case ExitRateLimited:
+				return ExitRateLimited
+			case ExitAuthFailure:
+				code = ExitAuthFailure
+			}
+		}
+		return code
+	}
+
+	return classify(err)
+}
+
+func classify(err error) int {
+	var localErr *LocalChangesError
+	if errors.As(err, &localErr) {
+		return ExitLocalChanges
+	}
+	var patchErr *PatchError
+	if errors.As(err, &patchErr) {
+		return ExitPatchFailed
+	}
+	var conflictErr *ConflictError
+	if errors.As(err, &conflictErr) {
+		return ExitConflicts
+	}
+	var hookErr *HookError
+	if errors.As(err, &hookErr) {
+		return ExitHookFailed
+	}
+
+	var noCommitErr *NoCommitError
+	if errors.As(err, &noCommitErr) {
+		return ExitNotFound
+	}
+
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return ExitTimeout
+	}
+	// A request cut short by the caller or by -deadline.
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	case errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	}
+
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) {
+		return ExitError
+	}
+
+	switch {
+	case httpErr.RateLimited:
+		return ExitRateLimited
+	case httpErr.StatusCode == http.StatusUnauthorized || httpErr.StatusCode == http.StatusForbidden:
+		return ExitAuthFailure
+	case httpErr.StatusCode == http.StatusNotFound:
+		return ExitNotFound
+	}
+	return ExitError
+}
@@ -0,0 +1,48 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	notFound := &HTTPError{StatusCode: http.StatusNotFound}
+	rateLimited := &HTTPError{StatusCode: http.StatusForbidden, RateLimited: true}
+	denied := &HTTPError{StatusCode: http.StatusForbidden}
+	timeout := &TimeoutError{Phase: PhaseBodyStall, Err: context.DeadlineExceeded}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, ExitOK},
+		{"other", errors.New("boom"), ExitError},
+		{"401", fmt.Errorf("error listing: %w", &HTTPError{StatusCode: http.StatusUnauthorized}), ExitAuthFailure},
+		{"403", denied, ExitAuthFailure},
+		{"404", notFound, ExitNotFound},
+		{"429", &HTTPError{StatusCode: http.StatusTooManyRequests, RateLimited: true}, ExitRateLimited},
+		{"403 rate limited", rateLimited, ExitRateLimited},
+		{"500", &HTTPError{StatusCode: http.StatusInternalServerError}, ExitError},
+		{"timeout", fmt.Errorf("error fetching: %w", timeout), ExitTimeout},
+		{"deadline", fmt.Errorf("error fetching: %w", context.DeadlineExceeded), ExitTimeout},
+		{"canceled", fmt.Errorf("error fetching: %w", context.Canceled), ExitInterrupted},
+		{"hook", &HookError{Command: "false", Err: errors.New("exit status 1")}, ExitHookFailed},
+		{"local changes", &LocalChangesError{Paths: []string{"a"}}, ExitLocalChanges},
+		{"conflicts", &ConflictError{Paths: []string{"a"}}, ExitConflicts},
+		{"patch", &PatchError{}, ExitPatchFailed},
+		{"partial", &FetchError{Total: 2, Failed: []FileError{{Path: "a", Err: notFound}}}, ExitPartialFailure},
+		{"partial auth", &FetchError{Total: 3, Failed: []FileError{{Path: "a", Err: notFound}, {Path: "b", Err: denied}}}, ExitAuthFailure},
+		{"partial rate limited", &FetchError{Total: 3, Failed: []FileError{{Path: "a", Err: denied}, {Path: "b", Err: rateLimited}}}, ExitRateLimited},
+		{"partial timeout", &FetchError{Total: 2, Failed: []FileError{{Path: "a", Err: timeout}}}, ExitPartialFailure},
+		{"interrupted", &FetchError{Total: 2, Skipped: 1, Interrupted: true}, ExitInterrupted},
+		{"deadline expired", &FetchError{Total: 2, Skipped: 1, TimedOut: true}, ExitTimeout},
+	}
+	for _, tt := range tests {
+		if got := ExitCode(tt.err); got != tt.want {
+			t.Errorf("ExitCode(%s: %v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
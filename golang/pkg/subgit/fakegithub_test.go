@@ -0,0 +1,259 @@
+package subgit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+// fakeGitHub serves the parts of the REST API and the raw content host
+// that Fetch uses, for the repository o/r with a single branch main whose
+// files are held in memory.
+type fakeGitHub struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	files  map[string]string            // Repository path -> content at the head of main
+	trees  map[string]map[string]string // The files of every commit main pointed to
+	modes  map[string]string            // Repository path -> mode, ModeFile if missing
+	blobs  map[string]string            // Every blob served so far, by SHA
+	commit string
+	hits   map[string]int // Requests by URL path
+
+	graphqlCost    func(n int) int // Rate limit cost of a query for n blobs, 1 if nil
+	graphqlBatches [][]string      // Paths asked for by each GraphQL query
+
+	// intercept, if set, may answer a request itself and return true.
+	intercept func(w http.ResponseWriter, r *http.Request) bool
+}
+
+func newFakeGitHub(t *testing.T, files map[string]string) *fakeGitHub {
+	t.Helper()
+	f := &fakeGitHub{blobs: map[string]string{}, modes: map[string]string{}, trees: map[string]map[string]string{}, hits: map[string]int{}}
+	f.setFiles(files)
+	f.Server = httptest.NewTLSServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+// setFiles moves main to a new commit with the given files.
+func (f *fakeGitHub) setFiles(files map[string]string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	h := sha1.New()
+	for _, name := range sortedNames(files) {
+		io.WriteString(h, name+"\x00"+files[name]+"\x00")
+		f.blobs[GitBlobSHA([]byte(files[name]))] = files[name]
+	}
+	f.files = files
+	f.commit = hex.EncodeToString(h.Sum(nil))
+	f.trees[f.commit] = files
+}
+
+// setMode gives the file at name a mode other than ModeFile.
+func (f *fakeGitHub) setMode(name, mode string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.modes[name] = mode
+}
+
+// options returns Options that fetch all of o/r from the server into
+// rootDir.
+func (f *fakeGitHub) options(rootDir string) Options {
+	return Options{
+		Host:       strings.TrimPrefix(f.URL, "https://"),
+		APIBase:    f.URL,
+		HTTPClient: f.Client(),
+		RepoName:   "o/r",
+		Branch:     "main",
+		RootDir:    rootDir,
+	}
+}
+
+// fetch runs Fetch with a new fetcher for opts.
+func (f *fakeGitHub) fetch(t *testing.T, opts Options) (*Result, error) {
+	t.Helper()
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gf.Fetch(context.Background())
+}
+
+func (f *fakeGitHub) requests(path string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hits[path]
+}
+
+func (f *fakeGitHub) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.hits[r.URL.Path]++
+	intercept, files, modes, commit := f.intercept, f.files, f.modes, f.commit
+	// Older commits are still served by SHA.
+	for sha, tree := range f.trees {
+		if strings.HasPrefix(r.URL.Path, "/repos/o/r/git/trees/"+sha) || strings.HasPrefix(r.URL.Path, "/raw/o/r/"+sha+"/") || r.URL.Query().Get("ref") == sha {
+			files, commit = tree, sha
+		}
+	}
+	f.mu.Unlock()
+	if intercept != nil && intercept(w, r) {
+		return
+	}
+
+	p := r.URL.Path
+	switch {
+	case strings.HasPrefix(p, "/repos/o/r/commits/"):
+		etag := `"` + commit + `"`
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"sha":    commit,
+			"commit": map[string]any{"committer": map[string]any{"date": "2026-01-02T03:04:05Z"}},
+		})
+	case p == "/repos/o/r/git/trees/"+commit:
+		tree := []TreeEntry{}
+		dirs := map[string]hash.Hash{"": sha1.New()}
+		for _, name := range sortedNames(files) {
+			content, mode := files[name], modes[name]
+			if mode == "" {
+				mode = ModeFile
+			}
+			tree = append(tree, TreeEntry{Path: name, Mode: mode, Type: "blob", Sha: GitBlobSHA([]byte(content)), Size: int64(len(content))})
+			// Trees are hashed from the files below them, so that they
+			// only change with those.
+			for dir := path.Dir(name); ; dir = path.Dir(dir) {
+				if dir == "." {
+					dir = ""
+				}
+				if dirs[dir] == nil {
+					dirs[dir] = sha1.New()
+				}
+				io.WriteString(dirs[dir], name+"\x00"+mode+"\x00"+content+"\x00")
+				if dir == "" {
+					break
+				}
+			}
+		}
+		for dir, h := range dirs {
+			if dir != "" {
+				tree = append(tree, TreeEntry{Path: dir, Mode: "040000", Type: "tree", Sha: hex.EncodeToString(h.Sum(nil))})
+			}
+		}
+		sort.Slice(tree, func(i, j int) bool { return tree[i].Path < tree[j].Path })
+		json.NewEncoder(w).Encode(map[string]any{"sha": hex.EncodeToString(dirs[""].Sum(nil)), "tree": tree})
+	case strings.HasPrefix(p, "/raw/o/r/"+commit+"/"):
+		content, ok := files[strings.TrimPrefix(p, "/raw/o/r/"+commit+"/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	case strings.HasPrefix(p, "/repos/o/r/git/blobs/"):
+		f.mu.Lock()
+		content, ok := f.blobs[strings.TrimPrefix(p, "/repos/o/r/git/blobs/")]
+		f.mu.Unlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{"content": wrapBase64(content), "encoding": "base64"})
+	case strings.HasPrefix(p, "/repos/o/r/contents/") && r.URL.Query().Get("ref") == commit:
+		content, ok := files[strings.TrimPrefix(p, "/repos/o/r/contents/")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		io.WriteString(w, content)
+	case p == "/graphql" && r.Method == "POST":
+		f.serveGraphQL(w, r, files, commit)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveGraphQL answers the blob queries of queryBlobs. Blobs with a NUL
+// byte are binary and those that are not valid UTF-8 have no text, as on
+// GitHub.
+func (f *fakeGitHub) serveGraphQL(w http.ResponseWriter, r *http.Request, files map[string]string, commit string) {
+	var request struct {
+		Variables map[string]any `json:"variables"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	paths := []string{}
+	repository := map[string]any{}
+	for key, value := range request.Variables {
+		expression, ok := value.(string)
+		if !ok || !strings.HasPrefix(key, "e") {
+			continue
+		}
+		alias := "f" + strings.TrimPrefix(key, "e")
+		ref, path, _ := strings.Cut(expression, ":")
+		content, ok := files[path]
+		if ref != commit || !ok {
+			repository[alias] = nil
+			continue
+		}
+		paths = append(paths, path)
+		blob := map[string]any{"text": content, "isBinary": false, "isTruncated": false, "byteSize": len(content)}
+		if strings.Contains(content, "\x00") {
+			blob["text"], blob["isBinary"] = nil, true
+		} else if !utf8.ValidString(content) {
+			blob["text"] = nil
+		}
+		repository[alias] = blob
+	}
+	sort.Strings(paths)
+
+	f.mu.Lock()
+	f.graphqlBatches = append(f.graphqlBatches, paths)
+	cost := 1
+	if f.graphqlCost != nil {
+		cost = f.graphqlCost(len(paths))
+	}
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+		"rateLimit":  map[string]any{"cost": cost, "remaining": 5000},
+		"repository": repository,
+	}})
+}
+
+// wrapBase64 encodes content as the blobs API does, in lines of 60
+// characters.
+func wrapBase64(content string) string {
+	encoded := base64.StdEncoding.EncodeToString([]byte(content))
+	var wrapped strings.Builder
+	for len(encoded) > 60 {
+		wrapped.WriteString(encoded[:60] + "\n")
+		encoded = encoded[60:]
+	}
+	wrapped.WriteString(encoded)
+	return wrapped.String()
+}
+
+func sortedNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
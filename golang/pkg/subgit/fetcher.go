@@ -0,0 +1,753 @@
+package subgit
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Git file modes as reported by the tree API.
+const (
+	ModeFile       = "100644"
+	ModeExecutable = "100755"
+	ModeSymlink    = "120000"
+)
+
+// TreeEntry is a single item of a recursive git tree listing.
+type TreeEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	Sha  string `json:"sha"`
+	Size int64  `json:"size"`
+}
+
+// GitBlobSHA returns the object ID git assigns to a blob with content.
+func GitBlobSHA(content []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(content))
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (e TreeEntry) IsSymlink() bool {
+	return e.Mode == ModeSymlink
+}
+
+// FileMode maps the git mode of a blob to local file permissions.
+func (e TreeEntry) FileMode() os.FileMode {
+	if e.Mode == ModeExecutable {
+		return 0755
+	}
+	return 0644
+}
+
+type GithubFetcher struct {
+	Options
+	Client *http.Client // Use http.Client directly
+
+	mu       sync.Mutex
+	symlinks map[string]string // repo path -> link target
+	failures []FileError
+	files    []FileResult
+	bytes    int64
+
+	baseFiles map[string]StateFile // What the last run wrote, from the state file
+	modified  map[string]bool      // Paths changed locally since then
+	patchDir  string               // PatchDir, or the one recorded in the state file
+	patched   map[string]string    // Blob SHAs of the files the patch queue changed
+	commit    string               // The commit Fetch pinned Branch to
+	polled    string               // The commit Watch saw, for Fetch to use instead of Branch
+	hooks     []string             // Hooks, or the ones recorded in the state file
+	previous  string               // The commit recorded in the state file
+
+	prefetched map[string]string // Contents from GraphQL batches, by path, until written
+	strategy   int               // The first strategy to download contents with
+	local      *gitRepo          // LocalRepo, opened
+
+	progressMu sync.Mutex
+}
+
+func NewGithubFetcher(opts Options) (*GithubFetcher, error) {
+	client := opts.HTTPClient
+	if client == nil {
+		var err error
+		client, err = NewHTTPClient(opts.ClientOptions)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if opts.Host == "" && opts.LocalRepo == "" {
+		opts.Host = DefaultHost
+	}
+	if opts.Jobs < 1 {
+		opts.Jobs = DefaultJobs
+	}
+	if opts.MaxJobs < 1 {
+		opts.MaxJobs = DefaultMaxJobs
+	}
+	switch opts.LocalChanges {
+	case "":
+		opts.LocalChanges = PolicyAbort
+	case PolicyAbort, PolicySkip, PolicyOverwrite, PolicyBackup, PolicyMerge:
+	default:
+		return nil, fmt.Errorf("unknown local changes policy %q", opts.LocalChanges)
+	}
+	switch opts.Backend {
+	case "":
+		opts.Backend = BackendRaw
+	case BackendRaw, BackendGraphQL:
+	default:
+		return nil, fmt.Errorf("unknown backend %q", opts.Backend)
+	}
+	if opts.PatchDir != "" && opts.Archive != nil {
+		return nil, fmt.Errorf("patches cannot be applied to an archive")
+	}
+	if len(opts.Hooks) > 0 && opts.Archive != nil {
+		return nil, fmt.Errorf("hooks cannot be run on an archive")
+	}
+
+	var local *gitRepo
+	if opts.LocalRepo != "" {
+		if opts.Backend == BackendGraphQL {
+			return nil, fmt.Errorf("the graphql backend cannot read a local repository")
+		}
+		var err error
+		if opts.LocalRepo, err = filepath.Abs(opts.LocalRepo); err != nil {
+			return nil, fmt.Errorf("error resolving %s: %w", opts.LocalRepo, err)
+		}
+		if local, err = openGitRepo(opts.LocalRepo); err != nil {
+			return nil, err
+		}
+		if opts.Branch == "" {
+			opts.Branch = "HEAD"
+		}
+	}
+
+	return &GithubFetcher{
+		Options:  opts,
+		Client:   client,
+		symlinks: map[string]string{},
+		local:    local,
+	}, nil
+}
+
+// Close releases the files held open to read a local repository. The
+// fetcher cannot be used afterwards.
+func (gf *GithubFetcher) Close() error {
+	if gf.local == nil {
+		return nil
+	}
+	return gf.local.Close()
+}
+
+// APIURL returns the REST API base URL for Host.
+func (gf *GithubFetcher) APIURL() string {
+	if gf.APIBase != "" {
+		return strings.TrimSuffix(gf.APIBase, "/")
+	}
+	if gf.Host == "" || gf.Host == DefaultHost {
+		return "https://api.github.com"
+	}
+	return "https://" + gf.Host + "/api/v3"
+}
+
+// RawURL returns the base URL serving raw file contents for Host.
+func (gf *GithubFetcher) RawURL() string {
+	if gf.Host == "" || gf.Host == DefaultHost {
+		return "https://raw.githubusercontent.com"
+	}
+	return "https://" + gf.Host + "/raw"
+}
+
+// GetFileContent downloads a file as of the commit Fetch resolved Branch
+// to, or the head of Branch outside of Fetch.
+func (gf *GithubFetcher) GetFileContent(ctx context.Context, filepath string) (string, error) {
+	return gf.getFileContent(ctx, TreeEntry{Path: filepath})
+}
+
+// getRaw downloads the file at filepath as of ref, which may be a
+// qualified ref or a commit SHA.
+func (gf *GithubFetcher) getRaw(ctx context.Context, ref string, filepath string) (string, error) {
+	url := fmt.Sprintf("%s/%s/%s/%s", gf.RawURL(), gf.RepoName, ref, filepath)
+
+	// Cancelled by the stall detector when the body stops flowing.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	if err := gf.authorize(req); err != nil {
+		return "", err
+	}
+
+	resp, err := gf.do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", newHTTPError(resp, url)
+	}
+	if gf.Progress != nil {
+		resp.Body = &progressReader{ReadCloser: resp.Body, gf: gf, path: filepath}
+	}
+
+	bodyBytes, err := gf.readBody(resp, url, cancel)
+	if err != nil {
+		return "", fmt.Errorf("error reading body from %s: %w", url, gf.classifyTimeout(err, url))
+	}
+
+	return string(bodyBytes), nil
+}
+
+// getJSON fetches an API URL and decodes the response into v.
+func (gf *GithubFetcher) getJSON(ctx context.Context, url string, v any) error {
+	_, _, err := gf.getJSONIfNoneMatch(ctx, url, "", v)
+	return err
+}
+
+// getJSONIfNoneMatch is getJSON with a conditional request: if etag is not
+// empty and still matches, v is left alone and modified is false. GitHub
+// does not count such requests against the rate limit.
+func (gf *GithubFetcher) getJSONIfNoneMatch(ctx context.Context, url string, etag string, v any) (newETag string, modified bool, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", false, fmt.Errorf("error creating request: %w", err)
+	}
+	if err := gf.authorize(req); err != nil {
+		return "", false, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	resp, err := gf.do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if etag != "" && resp.StatusCode == http.StatusNotModified {
+		return etag, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", false, newHTTPError(resp, url)
+	}
+
+	bodyBytes, err := gf.readBody(resp, url, cancel)
+	if err != nil {
+		return "", false, fmt.Errorf("error reading body: %w", gf.classifyTimeout(err, url))
+	}
+
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return "", false, fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	return resp.Header.Get("ETag"), true, nil
+}
+
+// ResolveCommit returns the SHA and committer date of the commit that ref,
+// a branch, tag or SHA, points to.
+func (gf *GithubFetcher) ResolveCommit(ctx context.Context, ref string) (string, time.Time, error) {
+	if gf.local != nil {
+		sha, err := gf.local.resolve(ref)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		commit, err := gf.local.readCommit(sha)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		return sha, commit.CommitDate, nil
+	}
+	url := fmt.Sprintf("%s/repos/%s/commits/%s", gf.APIURL(), gf.RepoName, ref)
+
+	var commitResponse struct {
+		Sha    string `json:"sha"`
+		Commit struct {
+			Committer struct {
+				Date time.Time `json:"date"`
+			} `json:"committer"`
+		} `json:"commit"`
+	}
+	if err := gf.getJSON(ctx, url, &commitResponse); err != nil {
+		return "", time.Time{}, err
+	}
+	return commitResponse.Sha, commitResponse.Commit.Committer.Date, nil
+}
+
+// resolveBranch returns the commit Branch points to, or with At the last
+// one at or before that time, as the commits API's until parameter finds it.
+// Within Watch it is the commit the last poll returned.
+func (gf *GithubFetcher) resolveBranch(ctx context.Context) (string, error) {
+	if gf.polled != "" {
+		return gf.polled, nil
+	}
+	if gf.At.IsZero() {
+		commit, _, err := gf.ResolveCommit(ctx, gf.Branch)
+		return commit, err
+	}
+	if gf.local != nil {
+		return gf.resolveLocalAt()
+	}
+
+	query := url.Values{}
+	query.Set("sha", gf.Branch)
+	query.Set("until", gf.At.UTC().Format(time.RFC3339))
+	query.Set("per_page", "1")
+	commitsURL := fmt.Sprintf("%s/repos/%s/commits?%s", gf.APIURL(), gf.RepoName, query.Encode())
+
+	var commitsResponse []struct {
+		Sha string `json:"sha"`
+	}
+	if err := gf.getJSON(ctx, commitsURL, &commitsResponse); err != nil {
+		return "", err
+	}
+	if len(commitsResponse) == 0 {
+		return "", &NoCommitError{Branch: gf.Branch, At: gf.At}
+	}
+	return commitsResponse[0].Sha, nil
+}
+
+// GetBlob downloads a blob through the API. Unlike GetFileContent it also
+// serves blobs the branch no longer points to.
+func (gf *GithubFetcher) GetBlob(ctx context.Context, sha string) (string, error) {
+	if gf.local != nil {
+		return gf.local.readBlob(sha)
+	}
+	url := fmt.Sprintf("%s/repos/%s/git/blobs/%s", gf.APIURL(), gf.RepoName, sha)
+
+	var blobResponse struct {
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := gf.getJSON(ctx, url, &blobResponse); err != nil {
+		return "", err
+	}
+	if blobResponse.Encoding != "base64" {
+		return "", fmt.Errorf("error decoding blob %s: unsupported encoding %q", sha, blobResponse.Encoding)
+	}
+	content, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(blobResponse.Content, "\n", ""))
+	if err != nil {
+		return "", fmt.Errorf("error decoding blob %s: %w", sha, err)
+	}
+	return string(content), nil
+}
+
+// ListTree returns the SHA of the tree at ref and the blobs in the
+// subfolder.
+func (gf *GithubFetcher) ListTree(ctx context.Context, ref string) (string, []TreeEntry, error) {
+	tree, _, entries, err := gf.listTree(ctx, ref)
+	return tree, entries, err
+}
+
+// listTree is ListTree that also returns the SHA of the subfolder's own
+// tree (or blob, for a single file), empty if there is no such path.
+func (gf *GithubFetcher) listTree(ctx context.Context, ref string) (string, string, []TreeEntry, error) {
+	if gf.local != nil {
+		commit, err := gf.local.resolve(ref)
+		if err != nil {
+			return "", "", nil, err
+		}
+		return gf.local.listTree(commit, gf.Subfolder)
+	}
+	url := fmt.Sprintf("%s/repos/%s/git/trees/%s?recursive=1", gf.APIURL(), gf.RepoName, ref)
+
+	var treeResponse struct {
+		Sha  string      `json:"sha"`
+		Tree []TreeEntry `json:"tree"`
+	}
+	if err := gf.getJSON(ctx, url, &treeResponse); err != nil {
+		return "", "", nil, err
+	}
+
+	subtree := ""
+	if gf.Subfolder == "" {
+		subtree = treeResponse.Sha
+	}
+	entries := []TreeEntry{}
+	for _, item := range treeResponse.Tree {
+		if gf.inSubfolder(item.Path) && item.Type == "blob" {
+			entries = append(entries, item)
+		}
+		if item.Path == gf.Subfolder {
+			subtree = item.Sha
+		}
+	}
+	return treeResponse.Sha, subtree, entries, nil
+}
+
+func (gf *GithubFetcher) SaveFileContent(filepath_ string, content string, mode os.FileMode) error {
+	return writeFileAtomic(filepath.Join(gf.RootDir, filepath_), []byte(content), mode)
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames
+// it into place, so that an interrupted run never leaves a partial file
+// behind. The rename also replaces, rather than writes through, a symlink
+// from a previous run. Missing parent directories are created.
+func writeFileAtomic(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+
+	file, err := os.CreateTemp(dir, "."+filepath.Base(path)+".subgit-*")
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	defer func() {
+		file.Close()
+		os.Remove(file.Name()) // No-op once renamed
+	}()
+
+	// CreateTemp uses 0600 regardless of the umask.
+	if err := file.Chmod(mode); err != nil {
+		return fmt.Errorf("error setting mode on %s: %w", path, err)
+	}
+	if _, err := file.Write(data); err != nil {
+		return fmt.Errorf("error writing to file %s: %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing to file %s: %w", path, err)
+	}
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error creating file %s: %w", path, err)
+	}
+	return nil
+}
+
+// IsUpToDate reports whether the local copy of entry already matches its
+// blob, so that a rerun resumes where an interrupted one stopped. For
+// symlinks it also returns the current link target.
+func (gf *GithubFetcher) IsUpToDate(entry TreeEntry) (bool, string) {
+	if gf.Archive != nil {
+		return false, "" // Nothing on disk to resume from
+	}
+
+	fullPath := filepath.Join(gf.RootDir, entry.Path)
+	info, err := os.Lstat(fullPath)
+	if err != nil || entry.Sha == "" {
+		return false, ""
+	}
+
+	if entry.IsSymlink() {
+		if gf.CopySymlinks || info.Mode()&os.ModeSymlink == 0 {
+			return false, ""
+		}
+		target, err := os.Readlink(fullPath)
+		target = filepath.ToSlash(target)
+		return err == nil && GitBlobSHA([]byte(target)) == entry.Sha, target
+	}
+
+	if !info.Mode().IsRegular() || info.Mode().Perm() != entry.FileMode() || info.Size() != entry.Size {
+		return false, ""
+	}
+	content, err := os.ReadFile(fullPath)
+	return err == nil && GitBlobSHA(content) == entry.Sha, ""
+}
+
+// ArchivePath returns the name of a repository path inside the archive,
+// which is relative to the subfolder.
+func (gf *GithubFetcher) ArchivePath(repoPath string) string {
+	if gf.Subfolder == "" {
+		return repoPath
+	}
+	if repoPath == gf.Subfolder {
+		return path.Base(repoPath)
+	}
+	return strings.TrimPrefix(repoPath, gf.Subfolder+"/")
+}
+
+// inSubfolder reports whether repoPath is the subfolder or below it.
+func (gf *GithubFetcher) inSubfolder(repoPath string) bool {
+	return gf.Subfolder == "" || repoPath == gf.Subfolder || strings.HasPrefix(repoPath, gf.Subfolder+"/")
+}
+
+func (gf *GithubFetcher) ProcessFile(ctx context.Context, entry TreeEntry) (FileResult, error) {
+	file := FileResult{Path: entry.Path, Sha: entry.Sha, Mode: entry.Mode, Size: entry.Size}
+
+	if upToDate, target := gf.IsUpToDate(entry); upToDate {
+		if entry.IsSymlink() {
+			gf.mu.Lock()
+			gf.symlinks[entry.Path] = target
+			gf.mu.Unlock()
+		}
+		file.UpToDate = true
+		return file, nil
+	}
+
+	modified := gf.modified[entry.Path]
+	if modified && gf.LocalChanges == PolicySkip {
+		file.Local = PolicySkip
+		return file, nil
+	}
+	if modified && gf.LocalChanges == PolicyMerge {
+		return gf.mergeFile(ctx, entry, file)
+	}
+
+	content, err := gf.fileContent(ctx, entry)
+	if err != nil {
+		return file, err
+	}
+
+	if modified && gf.LocalChanges == PolicyBackup {
+		if err := gf.backupFile(entry.Path); err != nil {
+			return file, err
+		}
+		file.Local = PolicyBackup
+	}
+
+	if entry.IsSymlink() {
+		// Links are created once every file is on disk, see CreateSymlinks.
+		gf.mu.Lock()
+		gf.symlinks[entry.Path] = content
+		gf.mu.Unlock()
+	} else if gf.Archive != nil {
+		gf.Archive.AddFile(gf.ArchivePath(entry.Path), content, entry.FileMode())
+	} else if err := gf.SaveFileContent(entry.Path, content, entry.FileMode()); err != nil {
+		return file, err
+	}
+
+	file.Size = int64(len(content))
+	return file, nil
+}
+
+// recordFile adds a fetched file to the result.
+func (gf *GithubFetcher) recordFile(file FileResult, attempt int, elapsed time.Duration) {
+	gf.mu.Lock()
+	gf.files = append(gf.files, file)
+	if !file.UpToDate && file.Local != PolicySkip {
+		gf.bytes += file.Size
+	}
+	gf.mu.Unlock()
+
+	gf.emit(Event{Type: EventFileDone, Path: file.Path, Sha: file.Sha, Size: file.Size, Attempt: attempt, Duration: elapsed, UpToDate: file.UpToDate, Local: file.Local, Conflicts: file.Conflicts})
+}
+
+// recordFailure collects a per-file error so that the run can carry on
+// and report every failure at the end.
+func (gf *GithubFetcher) recordFailure(path string, err error) {
+	gf.recordFailureEvent(Event{Path: path, Err: err})
+}
+
+// recordFailureEvent is recordFailure with the details of the last attempt.
+func (gf *GithubFetcher) recordFailureEvent(event Event) {
+	gf.mu.Lock()
+	gf.failures = append(gf.failures, FileError{Path: event.Path, Err: event.Err})
+	gf.mu.Unlock()
+
+	event.Type = EventFileFailed
+	gf.emit(event)
+}
+
+// emit passes event to the Progress callback, one call at a time.
+func (gf *GithubFetcher) emit(event Event) {
+	if gf.Progress == nil {
+		return
+	}
+	gf.progressMu.Lock()
+	defer gf.progressMu.Unlock()
+	gf.Progress(event)
+}
+
+// Fetch downloads the subfolder. The returned Result lists what was
+// fetched even when the error is a *FetchError for a partial failure.
+func (gf *GithubFetcher) Fetch(parent context.Context) (*Result, error) {
+	gf.symlinks = map[string]string{}
+	gf.failures = nil
+	gf.files = nil
+	gf.bytes = 0
+	gf.baseFiles = nil
+	gf.modified = map[string]bool{}
+	gf.patchDir = gf.PatchDir
+	gf.patched = map[string]string{}
+	gf.hooks = nonEmpty(gf.Hooks)
+	gf.previous = ""
+	gf.prefetched = map[string]string{}
+
+	runCtx := parent
+	if gf.Deadline > 0 {
+		var cancelRun context.CancelFunc
+		runCtx, cancelRun = context.WithTimeout(parent, gf.Deadline)
+		defer cancelRun()
+	}
+
+	// Pin the branch to a commit, so that every file comes from the same
+	// one even if the branch moves during the run.
+	gf.commit = ""
+	gf.emit(Event{Type: EventListStart})
+	commit, err := gf.resolveBranch(runCtx)
+	if err != nil {
+		return nil, err
+	}
+	tree, filesToFetch, err := gf.ListTree(runCtx, commit)
+	if err != nil {
+		return nil, err
+	}
+	gf.commit = commit
+
+	if gf.Archive == nil {
+		state, err := LoadState(gf.RootDir)
+		if err != nil {
+			return nil, err
+		}
+		if state.sameSource(gf) {
+			gf.baseFiles = state.Files
+			gf.previous = state.Commit
+			if gf.patchDir == "" {
+				gf.patchDir = state.patchDir(gf.RootDir)
+			}
+			if gf.Hooks == nil {
+				gf.hooks = state.Hooks
+			}
+		}
+		changed := gf.findLocalChanges(filesToFetch)
+		if len(changed) > 0 && gf.LocalChanges == PolicyAbort {
+			return nil, &LocalChangesError{Paths: changed}
+		}
+		for _, path := range changed {
+			gf.modified[path] = true
+		}
+	}
+
+	var totalSize int64
+	for _, entry := range filesToFetch {
+		totalSize += entry.Size
+	}
+	totalFiles := len(filesToFetch)
+	gf.emit(Event{Type: EventListDone, Sha: tree, Total: totalFiles, Size: totalSize})
+
+	result := &Result{Commit: commit, Tree: tree}
+	if totalFiles == 0 {
+		return result, nil
+	}
+
+	// The child context is also cancelled by fail-fast; the parent only by
+	// the caller, e.g. on SIGINT.
+	ctx, cancel := context.WithCancel(runCtx)
+	defer cancel()
+
+	var skipped int
+	if gf.Backend == BackendGraphQL {
+		skipped = gf.downloadGraphQL(ctx, cancel, filesToFetch)
+	} else {
+		skipped = gf.downloadAll(ctx, cancel, filesToFetch)
+	}
+
+	if ctx.Err() == nil {
+		gf.CreateSymlinks()
+	}
+
+	sort.Slice(gf.failures, func(i, j int) bool {
+		return gf.failures[i].Path < gf.failures[j].Path
+	})
+	failed := map[string]bool{}
+	for _, failure := range gf.failures {
+		failed[failure.Path] = true
+	}
+	for _, file := range gf.files {
+		if !failed[file.Path] { // A link can fail after its target was read
+			result.Files = append(result.Files, file)
+		}
+	}
+	sort.Slice(result.Files, func(i, j int) bool {
+		return result.Files[i].Path < result.Files[j].Path
+	})
+	result.Bytes = gf.bytes
+	result.Failed = gf.failures
+	result.Skipped = skipped
+
+	// Patches only make sense on top of a complete set of files.
+	var patchErr error
+	if gf.patchDir != "" && len(gf.failures) == 0 && skipped == 0 {
+		result.Patches, patchErr = gf.applyPatches()
+	}
+
+	result.Changed = gf.changedFiles(result.Files)
+
+	if gf.Archive == nil {
+		if err := gf.saveState(commit, tree, filesToFetch, result.Files); err != nil {
+			return result, err
+		}
+	}
+	if patchErr != nil {
+		return result, patchErr
+	}
+
+	if len(gf.failures) > 0 || skipped > 0 {
+		return result, &FetchError{
+			Total:       totalFiles,
+			Skipped:     skipped,
+			Failed:      gf.failures,
+			Interrupted: parent.Err() != nil,
+			TimedOut:    parent.Err() == nil && runCtx.Err() != nil,
+			Deadline:    gf.Deadline,
+		}
+	}
+
+	failedPatches := []PatchResult{}
+	for _, patch := range result.Patches {
+		if len(patch.Failed) > 0 {
+			failedPatches = append(failedPatches, patch)
+		}
+	}
+	if len(failedPatches) > 0 {
+		return result, &PatchError{Patches: failedPatches}
+	}
+
+	conflicts := []string{}
+	for _, file := range result.Files {
+		if file.Conflicts > 0 {
+			conflicts = append(conflicts, file.Path)
+		}
+	}
+	if len(conflicts) > 0 {
+		return result, &ConflictError{Paths: conflicts}
+	}
+
+	return result, nil
+}
+
+// ParseGithubURL splits a github.com/<owner>/<repo>/tree/<branch>/<path>
+// URL into its host, repository, branch and subfolder.
+func ParseGithubURL(githubURL string) (string, string, string, string, error) {
+	parsedURL, err := url.Parse(githubURL)
+	if err != nil {
+		return "", "", "", "", fmt.Errorf("error parsing URL: %w", err)
+	}
+
+	pathParts := strings.Split(strings.Trim(parsedURL.Path, "/"), "/")
+	if len(pathParts) < 4 {
+		return "", "", "", "", fmt.Errorf("invalid GitHub URL format")
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(parsedURL.Host), "www.")
+	if host == "" {
+		host = DefaultHost
+	}
+
+	repoName := path.Join(pathParts[0], pathParts[1])
+	branch := pathParts[3]
+	subfolder := strings.Join(pathParts[4:], "/")
+
+	return host, repoName, branch, subfolder, nil
+}
@@ -0,0 +1,79 @@
+package subgit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestResolveBranchAt(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	// main has three commits, a day apart.
+	history := []struct {
+		sha  string
+		date time.Time
+	}{
+		{"c3", time.Date(2026, 3, 3, 0, 0, 0, 0, time.UTC)},
+		{"c2", time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"c1", time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/repos/o/r/commits" {
+			return false
+		}
+		query := r.URL.Query()
+		until, err := time.Parse(time.RFC3339, query.Get("until"))
+		if err != nil || query.Get("sha") != "main" || query.Get("per_page") != "1" {
+			http.Error(w, "bad query "+r.URL.RawQuery, http.StatusBadRequest)
+			return true
+		}
+		commits := []map[string]string{}
+		for _, c := range history {
+			if !c.date.After(until) {
+				commits = append(commits, map[string]string{"sha": c.sha})
+				break
+			}
+		}
+		json.NewEncoder(w).Encode(commits)
+		return true
+	}
+
+	for at, want := range map[time.Time]string{
+		time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC):                     "c2",
+		time.Date(2026, 3, 2, 12, 0, 0, 0, time.UTC):                    "c2",
+		time.Date(2026, 3, 3, 1, 0, 0, 0, time.FixedZone("CET", 3600)):  "c3",
+		time.Date(2026, 3, 3, 0, 59, 0, 0, time.FixedZone("CET", 3600)): "c2",
+		time.Date(2027, 1, 1, 0, 0, 0, 0, time.UTC):                     "c3",
+	} {
+		opts := f.options(t.TempDir())
+		opts.At = at
+		gf, err := NewGithubFetcher(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := gf.resolveBranch(context.Background()); err != nil || got != want {
+			t.Errorf("resolveBranch at %v = %s, %v, want %s", at, got, err, want)
+		}
+	}
+
+	opts := f.options(t.TempDir())
+	opts.At = time.Date(2026, 2, 28, 0, 0, 0, 0, time.UTC)
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gf.resolveBranch(context.Background())
+	var noCommitErr *NoCommitError
+	if !errors.As(err, &noCommitErr) || noCommitErr.Branch != "main" {
+		t.Fatalf("resolveBranch before the first commit = %v, want a NoCommitError", err)
+	}
+	if got, want := err.Error(), "no commit on main at or before 2026-02-28T00:00:00Z, the branch starts later"; got != want {
+		t.Errorf("error = %q, want %q", got, want)
+	}
+	if code := ExitCode(err); code != ExitNotFound {
+		t.Errorf("ExitCode = %d, want %d", code, ExitNotFound)
+	}
+}
@@ -0,0 +1,404 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"sync"
+	"time"
+)
+
+// errOutsideFS is fs.ErrNotExist, as nothing outside the subfolder is in
+// the file system.
+var errOutsideFS = fmt.Errorf("symlink points outside the file system: %w", fs.ErrNotExist)
+
+// FS is a read-only view of the subfolder at a single commit. It
+// implements fs.ReadDirFS, fs.StatFS and fs.ReadFileFS, with names relative
+// to the subfolder. The tree is listed once up front, file contents are
+// downloaded when first read. Like os.DirFS, symlinks are followed, as long
+// as they stay within the subfolder; those that leave it do not exist.
+type FS struct {
+	gf      *GithubFetcher
+	ctx     context.Context
+	commit  string
+	modTime time.Time // Commit date, reported for every file
+	cache   BlobCache
+
+	files map[string]TreeEntry     // name -> blob, symlinks included
+	dirs  map[string][]fs.DirEntry // name -> sorted entries, "." for the root
+
+	hasLinks  bool
+	linksOnce sync.Once
+	links     map[string]string // name -> link target, loaded on first use
+	linksErr  error
+}
+
+var (
+	_ fs.ReadDirFS  = (*FS)(nil)
+	_ fs.StatFS     = (*FS)(nil)
+	_ fs.ReadFileFS = (*FS)(nil)
+)
+
+// FS pins the subfolder to the commit Branch points to now, or the one at
+// At, and returns it as a file system. Reads use ctx, so they fail once it
+// is cancelled. Downloaded blobs are kept in cache, which may be nil.
+func (gf *GithubFetcher) FS(ctx context.Context, cache BlobCache) (*FS, error) {
+	ref := gf.Branch
+	if !gf.At.IsZero() {
+		var err error
+		if ref, err = gf.resolveBranch(ctx); err != nil {
+			return nil, err
+		}
+	}
+	commit, modTime, err := gf.ResolveCommit(ctx, ref)
+	if err != nil {
+		return nil, err
+	}
+	_, entries, err := gf.ListTree(ctx, commit)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, &fs.PathError{Op: "open", Path: gf.Subfolder, Err: fs.ErrNotExist}
+	}
+
+	fsys := &FS{
+		gf:      gf,
+		ctx:     ctx,
+		commit:  commit,
+		modTime: modTime,
+		cache:   cache,
+		files:   map[string]TreeEntry{},
+		dirs:    map[string][]fs.DirEntry{},
+	}
+
+	children := map[string]map[string]fs.DirEntry{".": {}}
+	for _, entry := range entries {
+		name := gf.ArchivePath(entry.Path)
+		fsys.files[name] = entry
+		fsys.hasLinks = fsys.hasLinks || entry.IsSymlink()
+
+		info := fsys.entryInfo(path.Base(name), entry)
+		if entry.IsSymlink() {
+			info.mode = fs.ModeSymlink | 0777
+		}
+		for dir := path.Dir(name); ; name, dir = dir, path.Dir(dir) {
+			if children[dir] == nil {
+				children[dir] = map[string]fs.DirEntry{}
+			}
+			children[dir][path.Base(name)] = info
+			if dir == "." {
+				break
+			}
+			info = fsys.dirInfo(path.Base(dir))
+		}
+	}
+	for dir, entries := range children {
+		sorted := make([]fs.DirEntry, 0, len(entries))
+		for _, entry := range entries {
+			sorted = append(sorted, entry)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			return sorted[i].Name() < sorted[j].Name()
+		})
+		fsys.dirs[dir] = sorted
+	}
+
+	return fsys, nil
+}
+
+// Commit returns the SHA of the commit the file system is pinned to.
+func (fsys *FS) Commit() string {
+	return fsys.commit
+}
+
+func (fsys *FS) Open(name string) (fs.File, error) {
+	resolved, err := fsys.resolve("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if entries, ok := fsys.dirs[resolved]; ok {
+		return &openDir{info: fsys.dirInfo(path.Base(name)), entries: entries}, nil
+	}
+	if entry, ok := fsys.files[resolved]; ok {
+		return &openFile{fsys: fsys, name: name, entry: entry, info: fsys.entryInfo(path.Base(name), entry)}, nil
+	}
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys *FS) Stat(name string) (fs.FileInfo, error) {
+	resolved, err := fsys.resolve("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := fsys.dirs[resolved]; ok {
+		return fsys.dirInfo(path.Base(name)), nil
+	}
+	if entry, ok := fsys.files[resolved]; ok {
+		return fsys.entryInfo(path.Base(name), entry), nil
+	}
+	return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+}
+
+func (fsys *FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	resolved, err := fsys.resolve("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries, ok := fsys.dirs[resolved]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	return append([]fs.DirEntry(nil), entries...), nil
+}
+
+func (fsys *FS) ReadFile(name string) ([]byte, error) {
+	resolved, err := fsys.resolve("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := fsys.files[resolved]
+	if !ok {
+		if _, isDir := fsys.dirs[resolved]; isDir {
+			return nil, &fs.PathError{Op: "readfile", Path: name, Err: errIsDir}
+		}
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrNotExist}
+	}
+	content, err := fsys.readBlob(entry)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return bytes.Clone(content), nil // The cache keeps the original
+}
+
+// Lstat is like Stat but does not follow a symlink at name itself.
+func (fsys *FS) Lstat(name string) (fs.FileInfo, error) {
+	resolved, err := fsys.resolveParent("lstat", name)
+	if err != nil {
+		return nil, err
+	}
+	if entry, ok := fsys.files[resolved]; ok && entry.IsSymlink() {
+		info := fsys.entryInfo(path.Base(name), entry)
+		info.mode = fs.ModeSymlink | 0777
+		return info, nil
+	}
+	return fsys.Stat(resolved)
+}
+
+// ReadLink returns the target of the symlink at name.
+func (fsys *FS) ReadLink(name string) (string, error) {
+	resolved, err := fsys.resolveParent("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	entry, ok := fsys.files[resolved]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	if !entry.IsSymlink() {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrInvalid}
+	}
+	target, err := fsys.readBlob(entry)
+	if err != nil {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: err}
+	}
+	return string(target), nil
+}
+
+// resolveParent follows the symlinks in the directory of name, leaving the
+// last component as is.
+func (fsys *FS) resolveParent(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return name, nil
+	}
+	dir, err := fsys.resolve(op, path.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	return path.Join(dir, path.Base(name)), nil
+}
+
+// resolve validates name and follows any symlinks in it.
+func (fsys *FS) resolve(op string, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if !fsys.hasLinks {
+		return name, nil
+	}
+
+	fsys.linksOnce.Do(fsys.loadLinks)
+	if fsys.linksErr != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: fsys.linksErr}
+	}
+	resolved, err := resolvePath(name, fsys.links)
+	if errors.Is(err, errOutsideRoot) {
+		err = errOutsideFS
+	}
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if resolved == "" {
+		return ".", nil
+	}
+	return resolved, nil
+}
+
+// loadLinks reads the targets of all symlinks, which any lookup may have
+// to follow.
+func (fsys *FS) loadLinks() {
+	fsys.links = map[string]string{}
+	for name, entry := range fsys.files {
+		if !entry.IsSymlink() {
+			continue
+		}
+		target, err := fsys.readBlob(entry)
+		if err != nil {
+			fsys.linksErr = fmt.Errorf("error reading symlink %s: %w", name, err)
+			return
+		}
+		fsys.links[name] = string(target)
+	}
+}
+
+// readBlob returns the content of entry from the cache or, failing that,
+// downloads it as of the pinned commit.
+func (fsys *FS) readBlob(entry TreeEntry) ([]byte, error) {
+	if fsys.cache != nil {
+		if content, ok := fsys.cache.Get(entry.Sha); ok {
+			return content, nil
+		}
+	}
+
+	content, err := fsys.gf.getContent(fsys.ctx, fsys.commit, entry)
+	if err != nil {
+		return nil, err
+	}
+	blob := []byte(content)
+	if GitBlobSHA(blob) != entry.Sha {
+		return nil, fmt.Errorf("content of %s does not match blob %s", entry.Path, entry.Sha)
+	}
+
+	if fsys.cache != nil {
+		fsys.cache.Put(entry.Sha, blob)
+	}
+	return blob, nil
+}
+
+func (fsys *FS) entryInfo(name string, entry TreeEntry) *fileInfo {
+	return &fileInfo{name: name, size: entry.Size, mode: entry.FileMode(), modTime: fsys.modTime}
+}
+
+func (fsys *FS) dirInfo(name string) *fileInfo {
+	return &fileInfo{name: name, mode: fs.ModeDir | 0755, modTime: fsys.modTime}
+}
+
+var errIsDir = errors.New("is a directory")
+
+// fileInfo serves as both fs.FileInfo and fs.DirEntry.
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string               { return fi.name }
+func (fi *fileInfo) Size() int64                { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode          { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *fileInfo) IsDir() bool                { return fi.mode.IsDir() }
+func (fi *fileInfo) Sys() any                   { return nil }
+func (fi *fileInfo) Type() fs.FileMode          { return fi.mode.Type() }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// openFile downloads its content on the first read. It implements
+// io.Seeker and io.ReaderAt, which http.FS needs to serve ranges.
+type openFile struct {
+	fsys   *FS
+	name   string
+	entry  TreeEntry
+	info   *fileInfo
+	reader *bytes.Reader
+}
+
+func (f *openFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *openFile) load() error {
+	if f.reader != nil {
+		return nil
+	}
+	content, err := f.fsys.readBlob(f.entry)
+	if err != nil {
+		return &fs.PathError{Op: "read", Path: f.name, Err: err}
+	}
+	f.reader = bytes.NewReader(content)
+	return nil
+}
+
+func (f *openFile) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *openFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.ReadAt(p, off)
+}
+
+func (f *openFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *openFile) Close() error {
+	return nil
+}
+
+type openDir struct {
+	info    *fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *openDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *openDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errIsDir}
+}
+
+func (d *openDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return append([]fs.DirEntry(nil), remaining...), nil
+	}
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(remaining))
+	d.offset += n
+	return append([]fs.DirEntry(nil), remaining[:n]...), nil
+}
+
+func (d *openDir) Close() error {
+	return nil
+}
@@ -0,0 +1,147 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+)
+
+// newTestFS returns the file system of lib in f.
+func newTestFS(t *testing.T, f *fakeGitHub, cache BlobCache) *FS {
+	t.Helper()
+	opts := f.options(t.TempDir())
+	opts.Subfolder = "lib"
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fsys, err := gf.FS(context.Background(), cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fsys
+}
+
+func TestFS(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		"lib/a.txt":     "a\n",
+		"lib/run.sh":    "#!/bin/sh\n",
+		"lib/dir/b.txt": "b\n",
+		"lib/dir/sub/c": "c\n",
+		"lib/link":      "a.txt",
+		"lib/dir/up":    "../a.txt",
+		"other/d.txt":   "d\n",
+	})
+	f.setMode("lib/run.sh", ModeExecutable)
+	f.setMode("lib/link", ModeSymlink)
+	f.setMode("lib/dir/up", ModeSymlink)
+
+	fsys := newTestFS(t, f, nil)
+	if err := fstest.TestFS(fsys, "a.txt", "run.sh", "dir/b.txt", "dir/sub/c", "link", "dir/up"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fsys.Stat("other"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Stat(other) = %v, want a file outside the subfolder to be missing", err)
+	}
+	if info, err := fsys.Stat("run.sh"); err != nil || info.Mode() != 0755 {
+		t.Errorf("Stat(run.sh) = %v, %v, want mode 0755", info, err)
+	}
+}
+
+func TestFSSymlinks(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		"lib/a.txt":     "a\n",
+		"lib/dir/b.txt": "b\n",
+		"lib/link":      "a.txt",
+		"lib/dirlink":   "dir",
+		"lib/chain":     "dirlink/up",
+		"lib/dir/up":    "../a.txt",
+		"lib/escape":    "../other/c.txt",
+		"lib/absolute":  "/etc/passwd",
+		"lib/loop":      "loop",
+		"other/c.txt":   "c\n",
+	})
+	for _, link := range []string{"lib/link", "lib/dirlink", "lib/chain", "lib/dir/up", "lib/escape", "lib/absolute", "lib/loop"} {
+		f.setMode(link, ModeSymlink)
+	}
+	fsys := newTestFS(t, f, nil)
+
+	for name, want := range map[string]string{
+		"link":          "a\n",
+		"chain":         "a\n",
+		"dirlink/b.txt": "b\n",
+		"dirlink/up":    "a\n",
+	} {
+		if content, err := fsys.ReadFile(name); err != nil || string(content) != want {
+			t.Errorf("ReadFile(%s) = %q, %v, want %q", name, content, err, want)
+		}
+	}
+	if entries, err := fsys.ReadDir("dirlink"); err != nil || len(entries) != 2 {
+		t.Errorf("ReadDir(dirlink) = %v, %v, want b.txt and up", entries, err)
+	}
+
+	for name, want := range map[string]string{
+		"link":       "a.txt",
+		"dirlink/up": "../a.txt",
+		"escape":     "../other/c.txt",
+		"absolute":   "/etc/passwd",
+	} {
+		if target, err := fsys.ReadLink(name); err != nil || target != want {
+			t.Errorf("ReadLink(%s) = %q, %v, want %q", name, target, err, want)
+		}
+	}
+	if _, err := fsys.ReadLink("a.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("ReadLink(a.txt) = %v, want fs.ErrInvalid", err)
+	}
+	if info, err := fsys.Lstat("link"); err != nil || info.Mode() != fs.ModeSymlink|0777 {
+		t.Errorf("Lstat(link) = %v, %v, want a symlink", info, err)
+	}
+	if info, err := fsys.Stat("link"); err != nil || !info.Mode().IsRegular() || info.Size() != 2 {
+		t.Errorf("Stat(link) = %v, %v, want the file it points to", info, err)
+	}
+
+	for _, name := range []string{"escape", "absolute"} {
+		if _, err := fsys.ReadFile(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadFile(%s) = %v, want fs.ErrNotExist", name, err)
+		}
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%s) = %v, want fs.ErrNotExist", name, err)
+		}
+	}
+	if _, err := fsys.Open("loop"); err == nil || errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Open(loop) = %v, want too many levels of symlinks", err)
+	}
+	if _, err := fsys.Open("../other/c.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("Open(../other/c.txt) = %v, want fs.ErrInvalid", err)
+	}
+}
+
+// TestFSCache checks that blobs are downloaded once and then read from the
+// cache, also by another FS.
+func TestFSCache(t *testing.T) {
+	files := map[string]string{"lib/a.txt": "a\n", "lib/copy.txt": "a\n", "lib/link": "a.txt"}
+	f := newFakeGitHub(t, files)
+	f.setMode("lib/link", ModeSymlink)
+	cache := NewMemoryCache()
+
+	downloads := func() int {
+		return f.requests("/raw/o/r/"+f.commit+"/lib/a.txt") + f.requests("/raw/o/r/"+f.commit+"/lib/copy.txt")
+	}
+	for i := 0; i < 2; i++ {
+		fsys := newTestFS(t, f, cache)
+		for _, name := range []string{"a.txt", "copy.txt", "link", "a.txt"} {
+			if content, err := fsys.ReadFile(name); err != nil || string(content) != "a\n" {
+				t.Fatalf("ReadFile(%s) = %q, %v", name, content, err)
+			}
+		}
+		// Both files have the same blob.
+		if n := downloads(); n != 1 {
+			t.Errorf("%d downloads after reading with FS %d, want 1", n, i+1)
+		}
+	}
+	if content, ok := cache.Get(GitBlobSHA([]byte("a\n"))); !ok || string(content) != "a\n" {
+		t.Errorf("cache has %q, %v, want the blob", content, ok)
+	}
+}
@@ -0,0 +1,165 @@
+package subgit
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// GitHub rejects app JWTs valid for more than ten minutes, and backdating
+	// iat allows for clock drift.
+	appJWTLifetime = 9 * time.Minute
+	appJWTBackdate = time.Minute
+
+	// Installation tokens last an hour; renew them well before that so a
+	// request never goes out with a token about to expire.
+	appTokenRefreshMargin = 5 * time.Minute
+)
+
+// appTokenSource mints and caches installation access tokens for a
+// GitHub App.
+type appTokenSource struct {
+	client         *http.Client
+	apiURL         string
+	appID          string
+	installationID string
+	key            *rsa.PrivateKey
+
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// NewAppCredential returns a credential for host that authenticates as an
+// installation of a GitHub App. Tokens are obtained from apiURL on first
+// use and refreshed before they expire.
+func NewAppCredential(host, apiURL, appID, installationID string, privateKeyPEM []byte, client *http.Client) (*Credential, error) {
+	key, err := parseRSAPrivateKey(privateKeyPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Credential{
+		Host:   host,
+		Source: fmt.Sprintf("GitHub App %s installation %s", appID, installationID),
+		app: &appTokenSource{
+			client:         client,
+			apiURL:         apiURL,
+			appID:          appID,
+			installationID: installationID,
+			key:            key,
+		},
+	}, nil
+}
+
+func parseRSAPrivateKey(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("error parsing GitHub App private key: no PEM block found")
+	}
+
+	// GitHub issues PKCS#1 keys, converted ones are often PKCS#8.
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing GitHub App private key: %w", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("error parsing GitHub App private key: not an RSA key")
+	}
+	return key, nil
+}
+
+// Token returns a valid installation token, minting a new one when there
+// is none yet or the current one is close to expiry.
+func (s *appTokenSource) Token(ctx context.Context) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.token != "" && time.Until(s.expiresAt) > appTokenRefreshMargin {
+		return s.token, nil
+	}
+
+	jwt, err := s.signJWT(time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	url := fmt.Sprintf("%s/app/installations/%s/access_tokens", s.apiURL, s.installationID)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, nil)
+	if err != nil {
+		return "", fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("error fetching installation token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return "", fmt.Errorf("error fetching installation token: %w", newHTTPError(resp, url))
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("error reading installation token: %w", err)
+	}
+	var tokenResponse struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := json.Unmarshal(body, &tokenResponse); err != nil {
+		return "", fmt.Errorf("error unmarshaling installation token: %w", err)
+	}
+	if tokenResponse.Token == "" {
+		return "", fmt.Errorf("error fetching installation token: empty token in response")
+	}
+
+	s.token = tokenResponse.Token
+	s.expiresAt = tokenResponse.ExpiresAt
+	return s.token, nil
+}
+
+// signJWT returns the RS256 JSON Web Token identifying the app.
+func (s *appTokenSource) signJWT(now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"iat": now.Add(-appJWTBackdate).Unix(),
+		"exp": now.Add(appJWTLifetime).Unix(),
+		"iss": s.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	signingInput := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("error signing GitHub App JWT: %w", err)
+	}
+
+	return signingInput + "." + encoding.EncodeToString(signature), nil
+}
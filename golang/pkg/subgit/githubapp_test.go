@@ -0,0 +1,225 @@
+package subgit
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeAppServer mints installation tokens for installation 42, checking
+// the app JWT on every request.
+type fakeAppServer struct {
+	*httptest.Server
+	t   *testing.T
+	key *rsa.PublicKey
+
+	mu       sync.Mutex
+	minted   int
+	lifetime time.Duration // Until the next token expires
+}
+
+func newFakeAppServer(t *testing.T, key *rsa.PublicKey) *fakeAppServer {
+	s := &fakeAppServer{t: t, key: key, lifetime: time.Hour}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeAppServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+		http.NotFound(w, r)
+		return
+	}
+	jwt, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		http.Error(w, "no JWT", http.StatusUnauthorized)
+		return
+	}
+	if err := s.checkJWT(jwt); err != "" {
+		s.t.Errorf("invalid JWT: %s", err)
+		http.Error(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	s.mu.Lock()
+	s.minted++
+	token := "ghs_" + strings.Repeat("x", s.minted)
+	expiresAt := time.Now().Add(s.lifetime).UTC().Truncate(time.Second)
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]any{"token": token, "expires_at": expiresAt})
+}
+
+// checkJWT verifies the signature and claims the way GitHub does.
+func (s *fakeAppServer) checkJWT(jwt string) string {
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		return "not three parts"
+	}
+	decode := base64.RawURLEncoding.DecodeString
+
+	var header map[string]string
+	if data, err := decode(parts[0]); err != nil || json.Unmarshal(data, &header) != nil {
+		return "bad header"
+	}
+	if header["alg"] != "RS256" || header["typ"] != "JWT" {
+		return "header is not RS256 JWT"
+	}
+
+	signature, err := decode(parts[2])
+	if err != nil {
+		return "bad signature encoding"
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(s.key, crypto.SHA256, digest[:], signature); err != nil {
+		return "bad signature"
+	}
+
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+		Exp int64  `json:"exp"`
+	}
+	if data, err := decode(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return "bad claims"
+	}
+	now := time.Now()
+	switch {
+	case claims.Iss != "123":
+		return "iss is " + claims.Iss
+	case claims.Iat > now.Add(-30*time.Second).Unix():
+		return "iat is not backdated"
+	case claims.Exp <= now.Unix():
+		return "already expired"
+	case claims.Exp > now.Add(10*time.Minute).Unix(), claims.Exp-claims.Iat > int64(10*time.Minute/time.Second):
+		return "valid for more than ten minutes"
+	}
+	return ""
+}
+
+func (s *fakeAppServer) mintedTokens() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.minted
+}
+
+func (s *fakeAppServer) setLifetime(lifetime time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lifetime = lifetime
+}
+
+func newAppTestCredential(t *testing.T) (*Credential, *fakeAppServer) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newFakeAppServer(t, &key.PublicKey)
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	cred, err := NewAppCredential("github.com", server.URL, "123", "42", keyPEM, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cred, server
+}
+
+func TestAppCredentialCachesToken(t *testing.T) {
+	cred, server := newAppTestCredential(t)
+	if !cred.AppliesTo("api.github.com") {
+		t.Fatal("app credential does not apply to api.github.com")
+	}
+
+	for i := 0; i < 3; i++ {
+		token, err := cred.CurrentToken(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "ghs_x" {
+			t.Fatalf("token = %q, want ghs_x", token)
+		}
+	}
+	if n := server.mintedTokens(); n != 1 {
+		t.Fatalf("minted %d tokens, want 1", n)
+	}
+	if until := time.Until(cred.app.expiresAt); until < 59*time.Minute || until > time.Hour {
+		t.Fatalf("token expires in %v, want the expires_at from the response", until)
+	}
+}
+
+func TestAppCredentialRefreshesBeforeExpiry(t *testing.T) {
+	cred, server := newAppTestCredential(t)
+
+	// A token inside the refresh margin is replaced on next use, and the
+	// replacement is cached.
+	server.setLifetime(appTokenRefreshMargin - time.Minute)
+	if token, err := cred.CurrentToken(context.Background()); err != nil || token != "ghs_x" {
+		t.Fatalf("CurrentToken = %q, %v, want ghs_x", token, err)
+	}
+	server.setLifetime(time.Hour)
+	for i := 0; i < 3; i++ {
+		if token, err := cred.CurrentToken(context.Background()); err != nil || token != "ghs_xx" {
+			t.Fatalf("CurrentToken = %q, %v, want ghs_xx", token, err)
+		}
+	}
+	if n := server.mintedTokens(); n != 2 {
+		t.Fatalf("minted %d tokens, want 2", n)
+	}
+
+	// Just outside the margin the token is still used.
+	cred.app.expiresAt = time.Now().Add(appTokenRefreshMargin + time.Minute)
+	if token, err := cred.CurrentToken(context.Background()); err != nil || token != "ghs_xx" {
+		t.Fatalf("CurrentToken = %q, %v, want the cached ghs_xx", token, err)
+	}
+	if n := server.mintedTokens(); n != 2 {
+		t.Fatalf("minted %d tokens, want 2", n)
+	}
+}
+
+func TestAppCredentialReportsHTTPErrors(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"Bad credentials"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	cred, err := NewAppCredential("github.com", server.URL, "123", "42", keyPEM, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cred.CurrentToken(context.Background())
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("CurrentToken = %v, want a 401 HTTPError", err)
+	}
+}
+
+func TestParseRSAPrivateKeyRejectsOtherKeys(t *testing.T) {
+	if _, err := parseRSAPrivateKey([]byte("not a key")); err == nil {
+		t.Fatal("parsed a key without a PEM block")
+	}
+	if _, err := parseRSAPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("garbage")})); err == nil {
+		t.Fatal("parsed a garbage key")
+	}
+}
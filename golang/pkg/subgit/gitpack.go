@@ -0,0 +1,301 @@
+package subgit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Object types as numbered in packfiles.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+var packTypeNames = map[int]string{packCommit: "commit", packTree: "tree", packBlob: "blob", packTag: "tag"}
+
+// maxDeltaChain bounds the deltas resolved for one object, to fail on
+// corrupt packs rather than recurse forever. git itself stops at 50.
+const maxDeltaChain = 1000
+
+// packFile is a packfile with its version 2 index loaded into memory.
+type packFile struct {
+	path    string
+	file    *os.File // Read with ReadAt, so it is shared between goroutines
+	fanout  [256]uint32
+	shas    []byte // 20 bytes per object, sorted
+	offsets []byte // 4 bytes per object
+	large   []byte // 8 bytes per offset that does not fit in 31 bits
+}
+
+// openPack reads the index of the pack at packPath.
+func openPack(packPath string) (*packFile, error) {
+	idxPath := strings.TrimSuffix(packPath, ".pack") + ".idx"
+	idx, err := os.ReadFile(idxPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading pack index: %w", err)
+	}
+	if len(idx) < 8+256*4 || !bytes.Equal(idx[:4], []byte{0xff, 't', 'O', 'c'}) {
+		return nil, fmt.Errorf("error reading pack index %s: not a version 2 index", idxPath)
+	}
+	if version := binary.BigEndian.Uint32(idx[4:8]); version != 2 {
+		return nil, fmt.Errorf("error reading pack index %s: unsupported version %d", idxPath, version)
+	}
+
+	p := &packFile{path: packPath}
+	for i := range p.fanout {
+		p.fanout[i] = binary.BigEndian.Uint32(idx[8+i*4:])
+	}
+	n := int(p.fanout[255])
+	pos := 8 + 256*4
+	// SHAs, CRCs, offsets and the pack and index checksums.
+	if len(idx) < pos+n*(20+4+4)+40 {
+		return nil, fmt.Errorf("error reading pack index %s: truncated", idxPath)
+	}
+	p.shas = idx[pos : pos+n*20]
+	pos += n*20 + n*4
+	p.offsets = idx[pos : pos+n*4]
+	pos += n * 4
+	p.large = idx[pos : len(idx)-40]
+
+	if p.file, err = os.Open(packPath); err != nil {
+		return nil, fmt.Errorf("error opening pack: %w", err)
+	}
+	return p, nil
+}
+
+// find returns the offset of the object with the given raw SHA in the pack.
+func (p *packFile) find(sha []byte) (int64, bool) {
+	lo := 0
+	if sha[0] > 0 {
+		lo = int(p.fanout[sha[0]-1])
+	}
+	hi := int(p.fanout[sha[0]])
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(p.shas[(lo+i)*20:(lo+i+1)*20], sha) >= 0
+	})
+	if i >= hi || !bytes.Equal(p.shas[i*20:(i+1)*20], sha) {
+		return 0, false
+	}
+
+	offset := binary.BigEndian.Uint32(p.offsets[i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset), true
+	}
+	j := int(offset &^ 0x80000000)
+	if (j+1)*8 > len(p.large) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(p.large[j*8:])), true
+}
+
+// packEntry is the header of an object in a pack. For deltas, baseOffset
+// or baseSha names the object the delta applies to.
+type packEntry struct {
+	typ        int
+	size       int64 // Of the inflated data, which for deltas is the delta
+	baseOffset int64
+	baseSha    string
+	data       *bufio.Reader // Positioned at the compressed data
+}
+
+// entryAt reads the header of the object at offset.
+func (p *packFile) entryAt(offset int64) (*packEntry, error) {
+	r := bufio.NewReader(io.NewSectionReader(p.file, offset, 1<<62))
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, p.corrupt(offset, err)
+	}
+	entry := &packEntry{typ: int(b>>4) & 7, size: int64(b & 0x0f), data: r}
+	for shift := 4; b&0x80 != 0; shift += 7 {
+		if b, err = r.ReadByte(); err != nil {
+			return nil, p.corrupt(offset, err)
+		}
+		entry.size |= int64(b&0x7f) << shift
+	}
+
+	switch entry.typ {
+	case packOfsDelta:
+		if b, err = r.ReadByte(); err != nil {
+			return nil, p.corrupt(offset, err)
+		}
+		distance := int64(b & 0x7f)
+		for b&0x80 != 0 {
+			if b, err = r.ReadByte(); err != nil {
+				return nil, p.corrupt(offset, err)
+			}
+			distance = (distance+1)<<7 | int64(b&0x7f)
+		}
+		entry.baseOffset = offset - distance
+	case packRefDelta:
+		sha := make([]byte, 20)
+		if _, err := io.ReadFull(r, sha); err != nil {
+			return nil, p.corrupt(offset, err)
+		}
+		entry.baseSha = hex.EncodeToString(sha)
+	case packCommit, packTree, packBlob, packTag:
+	default:
+		return nil, p.corrupt(offset, fmt.Errorf("unknown object type %d", entry.typ))
+	}
+	return entry, nil
+}
+
+// inflate returns the data of entry, limited to limit bytes if limit is
+// not negative. Unless limited, the data is checked against the size in
+// the header and the zlib checksum.
+func (p *packFile) inflate(entry *packEntry, limit int64) ([]byte, error) {
+	zr, err := zlib.NewReader(entry.data)
+	if err != nil {
+		return nil, fmt.Errorf("error inflating object in %s: %w", p.path, err)
+	}
+	defer zr.Close()
+	if limit >= 0 && limit < entry.size {
+		data := make([]byte, limit)
+		if _, err := io.ReadFull(zr, data); err != nil {
+			return nil, fmt.Errorf("error inflating object in %s: %w", p.path, err)
+		}
+		return data, nil
+	}
+	data, err := readSized(zr, entry.size)
+	if err != nil {
+		return nil, fmt.Errorf("error inflating object in %s: %w", p.path, err)
+	}
+	return data, nil
+}
+
+// readAt returns the type and content of the object at offset, applying
+// deltas. Bases named by SHA are looked up in repo.
+func (p *packFile) readAt(repo *gitRepo, offset int64, depth int) (string, []byte, error) {
+	if depth > maxDeltaChain {
+		return "", nil, p.corrupt(offset, errors.New("delta chain too long"))
+	}
+	entry, err := p.entryAt(offset)
+	if err != nil {
+		return "", nil, err
+	}
+	data, err := p.inflate(entry, -1)
+	if err != nil {
+		return "", nil, err
+	}
+
+	var typ string
+	var base []byte
+	switch entry.typ {
+	case packOfsDelta:
+		typ, base, err = p.readAt(repo, entry.baseOffset, depth+1)
+	case packRefDelta:
+		typ, base, err = repo.readObjectDepth(entry.baseSha, depth+1)
+	default:
+		return packTypeNames[entry.typ], data, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	content, err := applyDelta(base, data)
+	if err != nil {
+		return "", nil, p.corrupt(offset, err)
+	}
+	return typ, content, nil
+}
+
+// sizeAt returns the size of the object at offset without inflating more
+// of it than the header of a delta.
+func (p *packFile) sizeAt(repo *gitRepo, offset int64) (int64, error) {
+	entry, err := p.entryAt(offset)
+	if err != nil {
+		return 0, err
+	}
+	if entry.typ != packOfsDelta && entry.typ != packRefDelta {
+		return entry.size, nil
+	}
+	// Two varints of at most 10 bytes each.
+	header, err := p.inflate(entry, 20)
+	if err != nil {
+		return 0, err
+	}
+	r := bytes.NewReader(header)
+	if _, err := binary.ReadUvarint(r); err != nil {
+		return 0, p.corrupt(offset, err)
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, p.corrupt(offset, err)
+	}
+	return int64(size), nil
+}
+
+func (p *packFile) corrupt(offset int64, err error) error {
+	return fmt.Errorf("error reading object at %d in %s: %w", offset, p.path, err)
+}
+
+// applyDelta rebuilds an object from its base and a git delta: the sizes
+// of the base and the result, then instructions that either copy a range
+// of the base or insert the bytes that follow them.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	r := bytes.NewReader(delta)
+	baseSize, err := binary.ReadUvarint(r)
+	if err != nil || baseSize != uint64(len(base)) {
+		return nil, errors.New("delta does not match its base")
+	}
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, errors.New("truncated delta")
+	}
+
+	// The size comes from the pack, so it only bounds what is allocated
+	// up front when a delta of this length could produce it.
+	out := make([]byte, 0, min(size, uint64(len(base)+len(delta))))
+	for r.Len() > 0 {
+		op, _ := r.ReadByte()
+		switch {
+		case op&0x80 != 0:
+			var offset, n uint64
+			for i := 0; i < 7; i++ {
+				if op&(1<<i) == 0 {
+					continue
+				}
+				b, err := r.ReadByte()
+				if err != nil {
+					return nil, errors.New("truncated delta")
+				}
+				if i < 4 {
+					offset |= uint64(b) << (8 * i)
+				} else {
+					n |= uint64(b) << (8 * (i - 4))
+				}
+			}
+			if n == 0 {
+				n = 0x10000
+			}
+			if offset+n > uint64(len(base)) {
+				return nil, errors.New("delta copies beyond its base")
+			}
+			out = append(out, base[offset:offset+n]...)
+		case op != 0:
+			if int(op) > r.Len() {
+				return nil, errors.New("truncated delta")
+			}
+			start := len(delta) - r.Len()
+			out = append(out, delta[start:start+int(op)]...)
+			r.Seek(int64(op), io.SeekCurrent)
+		default:
+			return nil, errors.New("invalid delta instruction")
+		}
+	}
+	if uint64(len(out)) != size {
+		return nil, errors.New("delta result has the wrong size")
+	}
+	return out, nil
+}
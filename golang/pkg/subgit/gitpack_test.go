@@ -0,0 +1,200 @@
+package subgit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// packedTypes counts the objects in repo's packs by their type in the
+// pack, deltas included.
+func packedTypes(t *testing.T, repo *gitRepo) map[int]int {
+	t.Helper()
+	types := map[int]int{}
+	for _, pack := range repo.packs {
+		for i := 0; i < len(pack.shas)/20; i++ {
+			offset, ok := pack.find(pack.shas[i*20 : (i+1)*20])
+			if !ok {
+				t.Fatalf("object %d of %s not found by its SHA", i, pack.path)
+			}
+			entry, err := pack.entryAt(offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			types[entry.typ]++
+		}
+	}
+	return types
+}
+
+// TestPackLargeOffsets has git write an index whose offsets all go
+// through the table of 64-bit offsets, as they do in packs over 2 GB.
+func TestPackLargeOffsets(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q")
+	packs, _ := filepath.Glob(filepath.Join(r.dir, ".git", "objects", "pack", "*.pack"))
+	if len(packs) != 1 {
+		t.Fatalf("found packs %v, want 1", packs)
+	}
+	idx := strings.TrimSuffix(packs[0], ".pack") + ".idx"
+	if err := os.Remove(idx); err != nil {
+		t.Fatal(err)
+	}
+	r.git("index-pack", "--index-version=2,12", packs[0])
+
+	repo := openTestRepo(t, r.dir)
+	if n := len(repo.packs[0].shas) / 20; len(repo.packs[0].large) != 8*(n-1) {
+		// Only the object right after the pack header is below the limit.
+		t.Fatalf("%d bytes of large offsets for %d objects", len(repo.packs[0].large), n)
+	}
+	checkAgainstGit(t, r, repo)
+}
+
+func TestPackFindMissing(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q")
+	repo := openTestRepo(t, r.dir)
+	pack := repo.packs[0]
+
+	// The first and last fanout buckets, and a SHA next to each present one.
+	missing := [][]byte{make([]byte, 20), []byte(strings.Repeat("\xff", 20))}
+	for i := 0; i < len(pack.shas)/20; i++ {
+		sha := append([]byte(nil), pack.shas[i*20:(i+1)*20]...)
+		sha[19] ^= 1
+		missing = append(missing, sha)
+	}
+	for _, sha := range missing {
+		if i := sort.Search(len(pack.shas)/20, func(i int) bool { return string(pack.shas[i*20:(i+1)*20]) >= string(sha) }); i < len(pack.shas)/20 && string(pack.shas[i*20:(i+1)*20]) == string(sha) {
+			continue // Present after all
+		}
+		if offset, ok := pack.find(sha); ok {
+			t.Errorf("find(%x) = %d, want not found", sha, offset)
+		}
+	}
+	if _, err := repo.readBlob(strings.Repeat("00", 20)); err == nil {
+		t.Error("readBlob of a missing object succeeded")
+	}
+}
+
+func TestPackCorrupt(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q")
+	packs, _ := filepath.Glob(filepath.Join(r.dir, ".git", "objects", "pack", "*.pack"))
+	original, err := os.ReadFile(packs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shas []string
+	for _, line := range strings.Split(r.git("cat-file", "--batch-all-objects", "--batch-check=%(objectname) %(objecttype)"), "\n") {
+		sha, _, _ := strings.Cut(line, " ")
+		shas = append(shas, sha)
+	}
+	want := map[string]string{}
+	for _, sha := range shas {
+		want[sha] = r.run(r.dir, "cat-file", "-p", sha)
+	}
+
+	// Every read either fails or returns the right object, whatever part
+	// of the pack is damaged.
+	check := func(name string, pack []byte) {
+		t.Helper()
+		if err := os.WriteFile(packs[0], pack, 0644); err != nil {
+			t.Fatal(err)
+		}
+		repo := openTestRepo(t, r.dir)
+		failed := 0
+		for _, sha := range shas {
+			typ, data, err := repo.readObject(sha)
+			if err != nil {
+				failed++
+				continue
+			}
+			if typ == "blob" && string(data) != want[sha] {
+				t.Errorf("%s: object %s read as %q, want %q", name, sha, data, want[sha])
+			}
+		}
+		if failed == 0 {
+			t.Errorf("%s: every object was read", name)
+		}
+	}
+	check("truncated", original[:len(original)/2])
+	check("header only", original[:12])
+	for _, at := range []int{20, len(original) / 3, len(original) / 2, len(original) - 100} {
+		damaged := append([]byte(nil), original...)
+		for i := at; i < at+8 && i < len(damaged); i++ {
+			damaged[i] ^= 0x55
+		}
+		check(fmt.Sprintf("damaged at %d", at), damaged)
+	}
+
+	// A truncated index is rejected when the repository is opened.
+	idx := strings.TrimSuffix(packs[0], ".pack") + ".idx"
+	data, err := os.ReadFile(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(idx, 0644)
+	if err := os.WriteFile(idx, data[:len(data)-50], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openGitRepo(r.dir); err == nil {
+		t.Error("opened a repository with a truncated pack index")
+	}
+}
+
+// delta encodes a git delta from the sizes and raw instructions.
+func delta(baseSize, size int, instructions ...string) []byte {
+	d := binary.AppendUvarint(nil, uint64(baseSize))
+	d = binary.AppendUvarint(d, uint64(size))
+	return append(d, strings.Join(instructions, "")...)
+}
+
+func TestApplyDelta(t *testing.T) {
+	base := []byte("0123456789")
+	big := bytes.Repeat([]byte("x"), 0x10000+5)
+	tests := []struct {
+		name  string
+		base  []byte
+		delta []byte
+		want  string // Empty for an error
+	}{
+		{name: "copy", base: base, delta: delta(10, 4, "\x91\x02\x04"), want: "2345"},
+		{name: "copy from offset 0", base: base, delta: delta(10, 3, "\x90\x03"), want: "012"},
+		{name: "insert", base: base, delta: delta(10, 3, "\x03abc"), want: "abc"},
+		{name: "copy and insert", base: base, delta: delta(10, 6, "\x90\x02", "\x02ab", "\x91\x08\x02"), want: "01ab89"},
+		{name: "copy with every byte", base: base, delta: delta(10, 1, "\xff\x09\x00\x00\x00\x01\x00\x00"), want: "9"},
+		{name: "size 0 copies 0x10000", base: big, delta: delta(len(big), 0x10000, "\x81\x05"), want: string(big[5:])},
+		{name: "base size mismatch", base: base, delta: delta(9, 3, "\x03abc")},
+		{name: "copy beyond base", base: base, delta: delta(10, 4, "\x91\x08\x04")},
+		{name: "offset beyond base", base: base, delta: delta(10, 1, "\x91\x0b\x01")},
+		{name: "truncated copy", base: base, delta: delta(10, 4, "\x91\x02")},
+		{name: "truncated insert", base: base, delta: delta(10, 3, "\x03ab")},
+		{name: "reserved instruction", base: base, delta: delta(10, 0, "\x00")},
+		{name: "result too short", base: base, delta: delta(10, 4, "\x03abc")},
+		{name: "result too long", base: base, delta: delta(10, 2, "\x03abc")},
+		{name: "no result size", base: base, delta: binary.AppendUvarint(nil, 10)},
+		{name: "empty", base: base, delta: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := applyDelta(tt.base, tt.delta)
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("applyDelta = %q, want an error", got)
+				}
+			} else if err != nil || string(got) != tt.want {
+				t.Errorf("applyDelta = %q, %v, want %q", got, err, tt.want)
+			}
+		})
+	}
+
+	// A huge result size in a short delta fails without allocating it.
+	if _, err := applyDelta(base, delta(10, 1<<62, "\x01a")); err == nil {
+		t.Error("applyDelta accepted a delta shorter than its result size")
+	}
+}
@@ -0,0 +1,507 @@
+package subgit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitRepo reads refs and objects from a local repository, bare or not,
+// without running git. Objects may be loose or in version 2 packs.
+type gitRepo struct {
+	gitDir     string   // Where HEAD is
+	commonDir  string   // Where refs and objects are; gitDir except in linked worktrees
+	objectDirs []string // objects and its alternates
+	packs      []*packFile
+}
+
+// gitCommit is the part of a commit object subgit uses.
+type gitCommit struct {
+	Tree       string
+	Parents    []string
+	Author     string
+	AuthorDate time.Time
+	CommitDate time.Time
+	Message    string
+}
+
+// openGitRepo opens the repository at dir, which is either a git directory
+// such as a bare repository or a checkout containing .git.
+func openGitRepo(dir string) (*gitRepo, error) {
+	gitDir := dir
+	dotGit := filepath.Join(dir, ".git")
+	if info, err := os.Stat(dotGit); err == nil && info.IsDir() {
+		gitDir = dotGit
+	} else if err == nil {
+		// A worktree or submodule points to its git directory.
+		data, err := os.ReadFile(dotGit)
+		if err != nil {
+			return nil, fmt.Errorf("error reading %s: %w", dotGit, err)
+		}
+		target, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir:")
+		if !ok {
+			return nil, fmt.Errorf("error reading %s: no gitdir line", dotGit)
+		}
+		gitDir = resolveGitPath(dir, strings.TrimSpace(target))
+	}
+	if _, err := os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		return nil, fmt.Errorf("%s is not a git repository", dir)
+	}
+
+	repo := &gitRepo{gitDir: gitDir, commonDir: gitDir}
+	if data, err := os.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		repo.commonDir = resolveGitPath(gitDir, strings.TrimSpace(string(data)))
+	}
+
+	objects := filepath.Join(repo.commonDir, "objects")
+	repo.objectDirs = []string{objects}
+	if data, err := os.ReadFile(filepath.Join(objects, "info", "alternates")); err == nil {
+		for _, line := range strings.Split(string(data), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				repo.objectDirs = append(repo.objectDirs, resolveGitPath(objects, line))
+			}
+		}
+	}
+	for _, objectDir := range repo.objectDirs {
+		packPaths, _ := filepath.Glob(filepath.Join(objectDir, "pack", "*.pack"))
+		for _, packPath := range packPaths {
+			pack, err := openPack(packPath)
+			if err != nil {
+				repo.Close()
+				return nil, err
+			}
+			repo.packs = append(repo.packs, pack)
+		}
+	}
+	return repo, nil
+}
+
+// Close closes the packs.
+func (repo *gitRepo) Close() error {
+	var firstErr error
+	for _, pack := range repo.packs {
+		if err := pack.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// resolveGitPath resolves p, which git files give relative to dir.
+func resolveGitPath(dir, p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// resolve returns the commit that ref names: a full SHA, HEAD, or a
+// branch, tag or remote branch in the order git looks them up. Annotated
+// tags are followed to their commit.
+func (repo *gitRepo) resolve(ref string) (string, error) {
+	sha := ""
+	if isFullSha(ref) {
+		sha = strings.ToLower(ref)
+	} else {
+		names := []string{"refs/" + ref, "refs/tags/" + ref, "refs/heads/" + ref, "refs/remotes/" + ref, "refs/remotes/" + ref + "/HEAD"}
+		// Only refs/... and names like HEAD are looked up as files in the
+		// git directory itself.
+		if strings.HasPrefix(ref, "refs/") || ref == strings.ToUpper(ref) {
+			names = append([]string{ref}, names...)
+		}
+		for _, name := range names {
+			var err error
+			if sha, err = repo.readRef(name, 0); err != nil {
+				return "", err
+			}
+			if sha != "" {
+				break
+			}
+		}
+		if sha == "" {
+			return "", fmt.Errorf("no ref %s in %s", ref, repo.gitDir)
+		}
+	}
+
+	for {
+		typ, data, err := repo.readObject(sha)
+		if err != nil {
+			return "", err
+		}
+		switch typ {
+		case "commit":
+			return sha, nil
+		case "tag":
+			target, _, _ := strings.Cut(string(data), "\n")
+			var ok bool
+			if sha, ok = strings.CutPrefix(target, "object "); !ok {
+				return "", fmt.Errorf("error reading tag %s: no object", sha)
+			}
+		default:
+			return "", fmt.Errorf("%s is a %s, not a commit", ref, typ)
+		}
+	}
+}
+
+// readRef returns the SHA of the ref with the full name, following
+// symbolic refs, or "" if there is no such ref.
+func (repo *gitRepo) readRef(name string, depth int) (string, error) {
+	if depth > 5 {
+		return "", fmt.Errorf("too many levels of symbolic refs at %s", name)
+	}
+	dir := repo.commonDir
+	if name == "HEAD" {
+		dir = repo.gitDir
+	}
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err == nil {
+		value := strings.TrimSpace(string(data))
+		if target, ok := strings.CutPrefix(value, "ref:"); ok {
+			return repo.readRef(strings.TrimSpace(target), depth+1)
+		}
+		if !isFullSha(value) {
+			return "", fmt.Errorf("error reading ref %s: %q is not a SHA", name, value)
+		}
+		return strings.ToLower(value), nil
+	} else if !errors.Is(err, fs.ErrNotExist) && !isDirError(err) {
+		return "", fmt.Errorf("error reading ref %s: %w", name, err)
+	}
+
+	packed, err := os.ReadFile(filepath.Join(repo.commonDir, "packed-refs"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("error reading packed-refs: %w", err)
+	}
+	for _, line := range strings.Split(string(packed), "\n") {
+		sha, refName, ok := strings.Cut(strings.TrimSpace(line), " ")
+		if ok && refName == name && isFullSha(sha) {
+			return strings.ToLower(sha), nil
+		}
+	}
+	return "", nil
+}
+
+// isDirError reports whether err came from reading a directory as a file,
+// as when refs/heads is looked up as a ref.
+func isDirError(err error) bool {
+	var pathErr *fs.PathError
+	if !errors.As(err, &pathErr) {
+		return false
+	}
+	info, statErr := os.Stat(pathErr.Path)
+	return statErr == nil && info.IsDir()
+}
+
+func isFullSha(s string) bool {
+	if len(s) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// readObject returns the type and content of the object with sha.
+func (repo *gitRepo) readObject(sha string) (string, []byte, error) {
+	return repo.readObjectDepth(sha, 0)
+}
+
+// readObjectDepth is readObject for the base of a delta depth deltas deep.
+func (repo *gitRepo) readObjectDepth(sha string, depth int) (string, []byte, error) {
+	if !isFullSha(sha) {
+		return "", nil, fmt.Errorf("invalid object name %q", sha)
+	}
+	for _, objectDir := range repo.objectDirs {
+		file, err := os.Open(filepath.Join(objectDir, sha[:2], sha[2:]))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", nil, fmt.Errorf("error reading object %s: %w", sha, err)
+		}
+		defer file.Close()
+		typ, size, r, err := looseHeader(file)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading object %s: %w", sha, err)
+		}
+		data, err := readSized(r, size)
+		if err != nil {
+			return "", nil, fmt.Errorf("error reading object %s: %w", sha, err)
+		}
+		return checkObject(sha, typ, data)
+	}
+
+	pack, offset, err := repo.findPacked(sha)
+	if err != nil {
+		return "", nil, err
+	}
+	typ, data, err := pack.readAt(repo, offset, depth)
+	if err != nil {
+		return "", nil, err
+	}
+	return checkObject(sha, typ, data)
+}
+
+// checkObject returns typ and data if they hash to sha, so that a corrupt
+// object is an error rather than wrong content.
+func checkObject(sha, typ string, data []byte) (string, []byte, error) {
+	h := sha1.New()
+	fmt.Fprintf(h, "%s %d\x00", typ, len(data))
+	h.Write(data)
+	if hex.EncodeToString(h.Sum(nil)) != sha {
+		return "", nil, fmt.Errorf("error reading object %s: content does not match", sha)
+	}
+	return typ, data, nil
+}
+
+// readSized reads the rest of r, which its header says is size bytes,
+// without trusting the size enough to allocate it up front.
+func readSized(r io.Reader, size int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, size+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("size is %d, not %d", len(data), size)
+	}
+	return data, nil
+}
+
+// objectSize returns the size of the object with sha, reading as little
+// of it as possible.
+func (repo *gitRepo) objectSize(sha string) (int64, error) {
+	if !isFullSha(sha) {
+		return 0, fmt.Errorf("invalid object name %q", sha)
+	}
+	for _, objectDir := range repo.objectDirs {
+		file, err := os.Open(filepath.Join(objectDir, sha[:2], sha[2:]))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("error reading object %s: %w", sha, err)
+		}
+		defer file.Close()
+		_, size, _, err := looseHeader(file)
+		if err != nil {
+			return 0, fmt.Errorf("error reading object %s: %w", sha, err)
+		}
+		return size, nil
+	}
+
+	pack, offset, err := repo.findPacked(sha)
+	if err != nil {
+		return 0, err
+	}
+	return pack.sizeAt(repo, offset)
+}
+
+// findPacked returns the pack holding sha and its offset there.
+func (repo *gitRepo) findPacked(sha string) (*packFile, int64, error) {
+	raw, _ := hex.DecodeString(sha)
+	for _, pack := range repo.packs {
+		if offset, ok := pack.find(raw); ok {
+			return pack, offset, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("object %s not found in %s: %w", sha, repo.gitDir, fs.ErrNotExist)
+}
+
+// looseHeader inflates the "<type> <size>\x00" header of a loose object
+// and returns a reader positioned at its content.
+func looseHeader(r io.Reader) (string, int64, io.Reader, error) {
+	zr, err := zlib.NewReader(r)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	br := bufio.NewReader(zr)
+	header, err := br.ReadString(0)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("invalid object header: %w", err)
+	}
+	typ, sizeText, _ := strings.Cut(strings.TrimSuffix(header, "\x00"), " ")
+	size, err := strconv.ParseInt(sizeText, 10, 64)
+	if err != nil || size < 0 {
+		return "", 0, nil, fmt.Errorf("invalid object header %q", header)
+	}
+	return typ, size, br, nil
+}
+
+// readCommit parses the commit with sha.
+func (repo *gitRepo) readCommit(sha string) (*gitCommit, error) {
+	typ, data, err := repo.readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "commit" {
+		return nil, fmt.Errorf("%s is a %s, not a commit", sha, typ)
+	}
+
+	commit := &gitCommit{}
+	headers, message, _ := strings.Cut(string(data), "\n\n")
+	commit.Message = message
+	for _, line := range strings.Split(headers, "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			commit.Tree = value
+		case "parent":
+			commit.Parents = append(commit.Parents, value)
+		case "author":
+			commit.Author, commit.AuthorDate = parseSignature(value)
+		case "committer":
+			_, commit.CommitDate = parseSignature(value)
+		}
+	}
+	if !isFullSha(commit.Tree) {
+		return nil, fmt.Errorf("error reading commit %s: no tree", sha)
+	}
+	return commit, nil
+}
+
+// parseSignature splits "Name <email> 1700000000 +0100" into the name and
+// the time.
+func parseSignature(value string) (string, time.Time) {
+	name, rest, _ := strings.Cut(value, " <")
+	_, rest, _ = strings.Cut(rest, "> ")
+	seconds, zone, _ := strings.Cut(rest, " ")
+	unix, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return name, time.Time{}
+	}
+	t := time.Unix(unix, 0).UTC()
+	if offset, err := strconv.Atoi(zone); err == nil {
+		minutes := offset/100*60 + offset%100
+		t = t.In(time.FixedZone(zone, minutes*60))
+	}
+	return name, t
+}
+
+// gitTreeEntry is an entry of a tree object.
+type gitTreeEntry struct {
+	Mode string
+	Name string
+	Sha  string
+}
+
+// readTree parses the tree with sha.
+func (repo *gitRepo) readTree(sha string) ([]gitTreeEntry, error) {
+	typ, data, err := repo.readObject(sha)
+	if err != nil {
+		return nil, err
+	}
+	if typ != "tree" {
+		return nil, fmt.Errorf("%s is a %s, not a tree", sha, typ)
+	}
+
+	entries := []gitTreeEntry{}
+	for len(data) > 0 {
+		space := bytes.IndexByte(data, ' ')
+		nul := bytes.IndexByte(data, 0)
+		if space < 0 || nul < space || len(data) < nul+21 {
+			return nil, fmt.Errorf("error reading tree %s: truncated", sha)
+		}
+		entries = append(entries, gitTreeEntry{
+			Mode: string(data[:space]),
+			Name: string(data[space+1 : nul]),
+			Sha:  hex.EncodeToString(data[nul+1 : nul+21]),
+		})
+		data = data[nul+21:]
+	}
+	return entries, nil
+}
+
+// lookup returns the entry at the slash-separated name below the tree
+// root, the root itself for an empty name. Its Sha is empty if there is no
+// such entry.
+func (repo *gitRepo) lookup(root, name string) (gitTreeEntry, error) {
+	entry := gitTreeEntry{Mode: "40000", Sha: root}
+	if name == "" {
+		return entry, nil
+	}
+	for _, part := range strings.Split(name, "/") {
+		if entry.Mode != "40000" {
+			return gitTreeEntry{}, nil
+		}
+		entries, err := repo.readTree(entry.Sha)
+		if err != nil {
+			return gitTreeEntry{}, err
+		}
+		found := false
+		for _, child := range entries {
+			if child.Name == part {
+				entry, found = child, true
+				break
+			}
+		}
+		if !found {
+			return gitTreeEntry{}, nil
+		}
+	}
+	return entry, nil
+}
+
+// listTree is GithubFetcher.listTree for a local repository: the root
+// tree of commit, the SHA of subfolder and the blobs below it. Submodules
+// are left out, as the tree API reports them as commits.
+func (repo *gitRepo) listTree(commit, subfolder string) (string, string, []TreeEntry, error) {
+	c, err := repo.readCommit(commit)
+	if err != nil {
+		return "", "", nil, err
+	}
+	top, err := repo.lookup(c.Tree, subfolder)
+	if err != nil || top.Sha == "" {
+		return c.Tree, "", []TreeEntry{}, err
+	}
+
+	entries := []TreeEntry{}
+	var walk func(name string, entry gitTreeEntry) error
+	walk = func(name string, entry gitTreeEntry) error {
+		switch entry.Mode {
+		case "40000":
+			children, err := repo.readTree(entry.Sha)
+			if err != nil {
+				return err
+			}
+			for _, child := range children {
+				if err := walk(path.Join(name, child.Name), child); err != nil {
+					return err
+				}
+			}
+		case "160000":
+		default:
+			size, err := repo.objectSize(entry.Sha)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, TreeEntry{Path: name, Mode: entry.Mode, Type: "blob", Sha: entry.Sha, Size: size})
+		}
+		return nil
+	}
+	if err := walk(subfolder, top); err != nil {
+		return "", "", nil, err
+	}
+	return c.Tree, top.Sha, entries, nil
+}
+
+// readBlob returns the content of the blob with sha.
+func (repo *gitRepo) readBlob(sha string) (string, error) {
+	typ, data, err := repo.readObject(sha)
+	if err != nil {
+		return "", err
+	}
+	if typ != "blob" {
+		return "", fmt.Errorf("%s is a %s, not a blob", sha, typ)
+	}
+	return string(data), nil
+}
@@ -0,0 +1,438 @@
+package subgit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// gitTestRepo is a repository in a temporary directory, written with the
+// git command the local repository reader is checked against.
+type gitTestRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newGitTestRepo(t *testing.T) *gitTestRepo {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	r := &gitTestRepo{t: t, dir: filepath.Join(t.TempDir(), "repo")}
+	r.run(filepath.Dir(r.dir), "init", "-q", "-b", "main", r.dir)
+	return r
+}
+
+// git runs git in the repository and returns its output.
+func (r *gitTestRepo) git(args ...string) string {
+	r.t.Helper()
+	return strings.TrimSpace(r.run(r.dir, args...))
+}
+
+func (r *gitTestRepo) run(dir string, args ...string) string {
+	r.t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=Test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=Test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+	out, err := cmd.Output()
+	if err != nil {
+		stderr := ""
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			stderr = string(exitErr.Stderr)
+		}
+		r.t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, stderr)
+	}
+	return string(out)
+}
+
+func (r *gitTestRepo) write(name, content string, mode os.FileMode) {
+	r.t.Helper()
+	path := filepath.Join(r.dir, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		r.t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		r.t.Fatal(err)
+	}
+}
+
+// buildHistory commits a few versions of a tree with every kind of entry,
+// and files large enough that git stores later versions as deltas.
+func buildHistory(t *testing.T) *gitTestRepo {
+	t.Helper()
+	r := newGitTestRepo(t)
+	var big strings.Builder
+	for i := 0; i < 400; i++ {
+		fmt.Fprintf(&big, "line %d of a file that is stored as a delta once packed\n", i)
+	}
+	for version := 1; version <= 4; version++ {
+		content := strings.Replace(big.String(), fmt.Sprintf("line %d ", version*50), fmt.Sprintf("changed in version %d ", version), 1)
+		r.write("lib/big.txt", content, 0644)
+		r.write("lib/nested/deep/file.txt", strings.Repeat(content, version%2+1), 0644)
+		r.write("lib/run.sh", fmt.Sprintf("#!/bin/sh\necho %d\n", version), 0755)
+		r.write("lib/binary.bin", "\x00\x01\x02"+strconv.Itoa(version), 0644)
+		r.write("lib/empty.txt", "", 0644)
+		r.write("lib/with space.txt", "spaces\n", 0644)
+		r.write("other/readme.md", fmt.Sprintf("version %d\n", version), 0644)
+		if version == 1 {
+			if err := os.Symlink("big.txt", filepath.Join(r.dir, "lib", "link")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		r.git("add", "-A")
+		if version == 2 {
+			// A submodule, which the tree API reports as a commit.
+			r.git("update-index", "--add", "--cacheinfo", "160000,"+strings.Repeat("ab", 20)+",lib/submodule")
+		}
+		r.git("commit", "-q", "-m", fmt.Sprintf("Version %d\n\nWith a body.", version))
+		if version == 1 {
+			r.git("tag", "-a", "v1", "-m", "Annotated")
+			r.git("tag", "-a", "v1-outer", "v1", "-m", "A tag of a tag")
+		}
+		if version == 3 {
+			r.git("tag", "light")
+			r.git("branch", "feature")
+		}
+	}
+	return r
+}
+
+// checkAgainstGit compares what repo reads with git's own view of every
+// commit, tree and blob.
+func checkAgainstGit(t *testing.T, r *gitTestRepo, repo *gitRepo) {
+	t.Helper()
+	for _, ref := range []string{"HEAD", "main", "refs/heads/main", "feature", "v1", "v1-outer", "light", "refs/tags/light"} {
+		got, err := repo.resolve(ref)
+		if err != nil {
+			t.Errorf("resolve(%s): %v", ref, err)
+		} else if want := r.git("rev-parse", ref+"^{commit}"); got != want {
+			t.Errorf("resolve(%s) = %s, want %s", ref, got, want)
+		}
+	}
+
+	blobs := map[string]bool{}
+	for _, commit := range strings.Fields(r.git("rev-list", "--all")) {
+		c, err := repo.readCommit(commit)
+		if err != nil {
+			t.Fatalf("readCommit(%s): %v", commit, err)
+		}
+		if want := r.git("rev-parse", commit+"^{tree}"); c.Tree != want {
+			t.Errorf("commit %s tree = %s, want %s", commit, c.Tree, want)
+		}
+		if want := strings.Fields(r.git("rev-list", "--parents", "-n1", commit))[1:]; strings.Join(c.Parents, " ") != strings.Join(want, " ") {
+			t.Errorf("commit %s parents = %v, want %v", commit, c.Parents, want)
+		}
+		if want := r.git("log", "-1", "--format=%B", commit); strings.TrimSpace(c.Message) != want {
+			t.Errorf("commit %s message = %q, want %q", commit, c.Message, want)
+		}
+		if want := r.git("log", "-1", "--format=%ct", commit); strconv.FormatInt(c.CommitDate.Unix(), 10) != want || c.Author != "Test" {
+			t.Errorf("commit %s date = %v by %q, want %s by Test", commit, c.CommitDate, c.Author, want)
+		}
+
+		for _, subfolder := range []string{"", "lib", "lib/nested"} {
+			tree, subtree, entries, err := repo.listTree(commit, subfolder)
+			if err != nil {
+				t.Fatalf("listTree(%s, %q): %v", commit, subfolder, err)
+			}
+			if tree != c.Tree {
+				t.Errorf("listTree(%s, %q) tree = %s, want %s", commit, subfolder, tree, c.Tree)
+			}
+			treeish := commit + "^{tree}"
+			if subfolder != "" {
+				treeish = commit + ":" + subfolder
+			}
+			if want := r.git("rev-parse", treeish); subtree != want {
+				t.Errorf("listTree(%s, %q) subtree = %s, want %s", commit, subfolder, subtree, want)
+			}
+			if got, want := formatEntries(entries), lsTree(r, commit, subfolder); got != want {
+				t.Errorf("listTree(%s, %q) =\n%s\nwant\n%s", commit, subfolder, got, want)
+			}
+			for _, entry := range entries {
+				blobs[entry.Sha] = true
+			}
+		}
+	}
+
+	for sha := range blobs {
+		content, err := repo.readBlob(sha)
+		if err != nil {
+			t.Errorf("readBlob(%s): %v", sha, err)
+		} else if want := r.run(r.dir, "cat-file", "blob", sha); content != want {
+			t.Errorf("readBlob(%s) = %q, want %q", sha, content, want)
+		}
+	}
+}
+
+// lsTree lists the blobs below subfolder at commit in the format of
+// formatEntries, as git ls-tree sees them.
+func lsTree(r *gitTestRepo, commit, subfolder string) string {
+	args := []string{"ls-tree", "-r", "-l", "-z", commit}
+	if subfolder != "" {
+		args = append(args, subfolder+"/")
+	}
+	var lines []string
+	for _, record := range strings.Split(r.run(r.dir, args...), "\x00") {
+		info, name, ok := strings.Cut(record, "\t")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(info)
+		if fields[1] != "blob" {
+			continue // Submodules are left out
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s %s", fields[0], fields[2], fields[3], name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatEntries(entries []TreeEntry) string {
+	var lines []string
+	for _, entry := range entries {
+		if entry.Type != "blob" {
+			lines = append(lines, "unexpected "+entry.Type)
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %d %s", entry.Mode, entry.Sha, entry.Size, entry.Path))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func openTestRepo(t *testing.T, dir string) *gitRepo {
+	t.Helper()
+	repo, err := openGitRepo(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { repo.Close() })
+	return repo
+}
+
+func TestGitRepoLoose(t *testing.T) {
+	r := buildHistory(t)
+	repo := openTestRepo(t, r.dir)
+	if len(repo.packs) != 0 {
+		t.Fatalf("%d packs in a new repository, want only loose objects", len(repo.packs))
+	}
+	checkAgainstGit(t, r, repo)
+}
+
+// TestGitRepoCorruptLoose replaces a loose object with valid zlib data
+// that is not the object, which reads must not return.
+func TestGitRepoCorruptLoose(t *testing.T) {
+	r := buildHistory(t)
+	sha := r.git("rev-parse", "HEAD:other/readme.md")
+	path := filepath.Join(r.dir, ".git", "objects", sha[:2], sha[2:])
+	repo := openTestRepo(t, r.dir)
+	for _, data := range []string{
+		"blob 10\x00version 0\n",
+		"blob 10\x00version 4",
+		"blob 9\x00version 4\n",
+		"tree 10\x00version 4\n",
+	} {
+		if err := os.Chmod(path, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(zlibCompress(t, data)), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if content, err := repo.readBlob(sha); err == nil {
+			t.Errorf("readBlob of %q = %q, want an error", data, content)
+		}
+	}
+}
+
+func TestGitRepoPacked(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q", "--aggressive")
+	repo := openTestRepo(t, r.dir)
+	if len(repo.packs) != 1 {
+		t.Fatalf("%d packs after gc, want 1", len(repo.packs))
+	}
+	if types := packedTypes(t, repo); types[packOfsDelta] == 0 {
+		t.Fatalf("no offset deltas in the pack: %v", types)
+	}
+	if _, err := os.Stat(filepath.Join(r.dir, ".git", "refs", "tags", "v1")); err == nil {
+		t.Fatal("refs were not packed")
+	}
+	checkAgainstGit(t, r, repo)
+}
+
+// TestGitRepoClose checks that closing a fetcher for a local repository
+// closes its packs.
+func TestGitRepoClose(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q")
+	gf, err := NewGithubFetcher(Options{LocalRepo: r.dir, RootDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gf.local.packs) != 1 {
+		t.Fatalf("%d packs after gc, want 1", len(gf.local.packs))
+	}
+	if err := gf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gf.local.packs[0].file.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("pack is still open: %v", err)
+	}
+
+	gf, err = NewGithubFetcher(Options{RepoName: "o/r", Branch: "main", RootDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := gf.Close(); err != nil {
+		t.Errorf("Close without a local repository = %v", err)
+	}
+}
+
+func TestGitRepoRefDeltas(t *testing.T) {
+	r := buildHistory(t)
+	r.git("-c", "repack.useDeltaBaseOffset=false", "repack", "-q", "-a", "-d", "-f")
+	repo := openTestRepo(t, r.dir)
+	if types := packedTypes(t, repo); types[packRefDelta] == 0 || types[packOfsDelta] != 0 {
+		t.Fatalf("pack has %d ref deltas and %d offset deltas, want only ref deltas", types[packRefDelta], types[packOfsDelta])
+	}
+	checkAgainstGit(t, r, repo)
+}
+
+func TestGitRepoRefs(t *testing.T) {
+	r := buildHistory(t)
+	head := r.git("rev-parse", "HEAD")
+	feature := r.git("rev-parse", "feature")
+
+	// Symbolic refs are followed, in the git directory and in refs.
+	r.git("symbolic-ref", "refs/heads/alias", "refs/heads/feature")
+	r.git("pack-refs", "--all")
+	if err := os.WriteFile(filepath.Join(r.dir, ".git", "refs", "heads", "loose"), []byte(head+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	packedRefs, err := os.ReadFile(filepath.Join(r.dir, ".git", "packed-refs"))
+	if err != nil || !strings.Contains(string(packedRefs), "^") {
+		t.Fatalf("packed-refs = %q, %v, want peeled tags", packedRefs, err)
+	}
+
+	repo := openTestRepo(t, r.dir)
+	for ref, want := range map[string]string{
+		"HEAD":                head,
+		"main":                head,
+		"alias":               feature,
+		"feature":             feature,
+		"loose":               head,
+		"v1":                  r.git("rev-parse", "v1^{commit}"),
+		"v1-outer":            r.git("rev-parse", "v1^{commit}"),
+		head:                  head,
+		strings.ToUpper(head): head,
+	} {
+		if got, err := repo.resolve(ref); err != nil || got != want {
+			t.Errorf("resolve(%s) = %s, %v, want %s", ref, got, err, want)
+		}
+	}
+
+	for _, ref := range []string{"missing", "refs/heads", r.git("rev-parse", "HEAD^{tree}"), "HEAD~1"} {
+		if got, err := repo.resolve(ref); err == nil {
+			t.Errorf("resolve(%s) = %s, want an error", ref, got)
+		}
+	}
+
+	// A symbolic ref loop fails rather than recursing forever.
+	r.git("symbolic-ref", "refs/heads/loop1", "refs/heads/loop2")
+	r.git("symbolic-ref", "refs/heads/loop2", "refs/heads/loop1")
+	if _, err := repo.resolve("loop1"); err == nil || !strings.Contains(err.Error(), "symbolic refs") {
+		t.Errorf("resolve(loop1) = %v, want a symbolic ref error", err)
+	}
+}
+
+func TestGitRepoWorktreeAndAlternates(t *testing.T) {
+	r := buildHistory(t)
+	r.git("gc", "-q")
+	feature := r.git("rev-parse", "feature")
+
+	// A linked worktree has its own HEAD, and its refs and objects in the
+	// common directory.
+	worktree := filepath.Join(t.TempDir(), "worktree")
+	r.git("worktree", "add", "-q", worktree, "feature")
+	repo := openTestRepo(t, worktree)
+	if repo.commonDir == repo.gitDir {
+		t.Fatalf("worktree git directory %s has no common directory", repo.gitDir)
+	}
+	if got, err := repo.resolve("HEAD"); err != nil || got != feature {
+		t.Errorf("worktree resolve(HEAD) = %s, %v, want %s", got, err, feature)
+	}
+	checkAgainstGit(t, &gitTestRepo{t: t, dir: worktree}, repo)
+
+	// A shared clone reads the objects through objects/info/alternates.
+	clone := &gitTestRepo{t: t, dir: filepath.Join(t.TempDir(), "clone")}
+	r.run(r.dir, "clone", "-q", "--shared", "--mirror", r.dir, clone.dir)
+	if _, err := os.Stat(filepath.Join(clone.dir, "objects", "info", "alternates")); err != nil {
+		t.Fatal(err)
+	}
+	if packs, _ := filepath.Glob(filepath.Join(clone.dir, "objects", "pack", "*.pack")); len(packs) != 0 {
+		t.Fatalf("shared clone has packs %v", packs)
+	}
+	repo = openTestRepo(t, clone.dir)
+	if len(repo.objectDirs) != 2 {
+		t.Fatalf("object directories = %v, want the clone's and the alternate", repo.objectDirs)
+	}
+	checkAgainstGit(t, clone, repo)
+}
+
+func TestLooseHeader(t *testing.T) {
+	for _, tt := range []struct {
+		data    string
+		typ     string
+		size    int64
+		content string
+	}{
+		{data: "blob 5\x00hello", typ: "blob", size: 5, content: "hello"},
+		{data: "tree 0\x00", typ: "tree", size: 0},
+		{data: "blob 5hello"},
+		{data: "blob -1\x00"},
+		{data: "blob x\x00"},
+	} {
+		typ, size, r, err := looseHeader(strings.NewReader(zlibCompress(t, tt.data)))
+		if tt.typ == "" {
+			if err == nil {
+				t.Errorf("looseHeader(%q) succeeded", tt.data)
+			}
+			continue
+		}
+		if err != nil || typ != tt.typ || size != tt.size {
+			t.Errorf("looseHeader(%q) = %s, %d, %v, want %s, %d", tt.data, typ, size, err, tt.typ, tt.size)
+			continue
+		}
+		rest := make([]byte, 100)
+		n, _ := r.Read(rest)
+		if string(rest[:n]) != tt.content {
+			t.Errorf("looseHeader(%q) content = %q, want %q", tt.data, rest[:n], tt.content)
+		}
+	}
+	if _, _, _, err := looseHeader(strings.NewReader("not zlib")); err == nil {
+		t.Error("looseHeader accepted data that is not zlib")
+	}
+}
+
+func zlibCompress(t *testing.T, data string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
@@ -0,0 +1,234 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Backends for downloading file contents, see Options.Backend.
+const (
+	BackendRaw     = "raw"     // One request per file to the raw content host
+	BackendGraphQL = "graphql" // Text files in batches through the GraphQL API, the rest raw
+)
+
+const (
+	graphqlInitialBatch = 50
+	graphqlMaxBatch     = 500
+
+	// graphqlMaxBlobSize is the size above which files are downloaded raw;
+	// GraphQL truncates large blobs anyway.
+	graphqlMaxBlobSize = 512 << 10
+
+	// graphqlMaxBatchBytes bounds the content returned by one query.
+	graphqlMaxBatchBytes = 8 << 20
+
+	// graphqlTargetDuration is how long a query may take before batches
+	// shrink. GitHub aborts queries after 10 seconds.
+	graphqlTargetDuration = 4 * time.Second
+)
+
+// GraphQLURL returns the GraphQL API endpoint for Host.
+func (gf *GithubFetcher) GraphQLURL() string {
+	apiURL := gf.APIURL()
+	if strings.HasSuffix(apiURL, "/api/v3") {
+		return strings.TrimSuffix(apiURL, "/v3") + "/graphql" // GitHub Enterprise
+	}
+	return apiURL + "/graphql"
+}
+
+// downloadGraphQL is downloadAll for BackendGraphQL. It queries the
+// entries that ProcessFile would download through the GraphQL API, many
+// per query, and writes each batch before querying the next, so that only
+// one batch is held in memory. The batch size grows while queries are
+// cheap and fast and shrinks when they are expensive, slow or fail.
+// Anything not in a batch, such as binary or large files, or all of them
+// if the API cannot be used, is left to raw downloads. It returns the
+// number of entries skipped.
+func (gf *GithubFetcher) downloadGraphQL(ctx context.Context, cancel context.CancelFunc, entries []TreeEntry) int {
+	queryable := func(entry TreeEntry) bool {
+		if entry.Size > graphqlMaxBlobSize {
+			return false
+		}
+		if gf.modified[entry.Path] && (gf.LocalChanges == PolicySkip || gf.LocalChanges == PolicyMerge) {
+			return false
+		}
+		upToDate, _ := gf.IsUpToDate(entry)
+		return !upToDate
+	}
+	pending, rest := []TreeEntry{}, []TreeEntry{}
+	for _, entry := range entries {
+		if queryable(entry) {
+			pending = append(pending, entry)
+		} else {
+			rest = append(rest, entry)
+		}
+	}
+
+	skipped := 0
+	size, limit := graphqlInitialBatch, graphqlMaxBatch
+batches:
+	for len(pending) > 0 && ctx.Err() == nil {
+		n := 0
+		var batchBytes int64
+		for n < len(pending) && n < size && (n == 0 || batchBytes+pending[n].Size <= graphqlMaxBatchBytes) {
+			batchBytes += pending[n].Size
+			n++
+		}
+
+		start := time.Now()
+		cost, remaining, err := gf.queryBlobs(ctx, pending[:n])
+		elapsed := time.Since(start)
+		if err != nil {
+			if n == 1 || !isTransient(err) {
+				break
+			}
+			// Stay below the size that failed from now on.
+			size = n / 2
+			limit = size
+			continue
+		}
+		batch := pending[:n]
+		pending = pending[n:]
+		skipped += gf.downloadAll(ctx, cancel, batch)
+		gf.releaseBlobs(batch)
+
+		switch {
+		case remaining < cost:
+			break batches // Leave the GraphQL rate limit to others
+		case cost > 1:
+			size = max(1, n/cost)
+		case elapsed > graphqlTargetDuration:
+			size = max(1, n/2)
+		case elapsed < graphqlTargetDuration/4 && n == size:
+			size = min(limit, size*2)
+		}
+	}
+	return skipped + gf.downloadAll(ctx, cancel, append(pending, rest...))
+}
+
+// releaseBlobs drops the queried contents of entries that were not
+// written, because they were up to date or skipped.
+func (gf *GithubFetcher) releaseBlobs(entries []TreeEntry) {
+	gf.mu.Lock()
+	defer gf.mu.Unlock()
+	for _, entry := range entries {
+		delete(gf.prefetched, entry.Path)
+	}
+}
+
+// graphqlBlob is the part of a Blob object queryBlobs asks for.
+type graphqlBlob struct {
+	Text        *string `json:"text"`
+	IsBinary    bool    `json:"isBinary"`
+	IsTruncated bool    `json:"isTruncated"`
+	ByteSize    int64   `json:"byteSize"`
+}
+
+// queryBlobs fetches the contents of entries at the pinned commit in one
+// GraphQL query and returns its rate limit cost and the points remaining.
+// Blobs that come back binary, truncated or not matching their SHA are
+// skipped.
+func (gf *GithubFetcher) queryBlobs(ctx context.Context, entries []TreeEntry) (int, int, error) {
+	owner, name, _ := strings.Cut(gf.RepoName, "/")
+	variables := map[string]any{"owner": owner, "name": name}
+	var params, fields strings.Builder
+	for i, entry := range entries {
+		fmt.Fprintf(&params, ", $e%d: String!", i)
+		fmt.Fprintf(&fields, "f%d: object(expression: $e%d) { ... on Blob { text isBinary isTruncated byteSize } }\n", i, i)
+		variables[fmt.Sprintf("e%d", i)] = gf.commit + ":" + entry.Path
+	}
+	query := fmt.Sprintf("query($owner: String!, $name: String!%s) {\nrateLimit { cost remaining }\nrepository(owner: $owner, name: $name) {\n%s}\n}", params.String(), fields.String())
+
+	var response struct {
+		Data struct {
+			RateLimit struct {
+				Cost      int `json:"cost"`
+				Remaining int `json:"remaining"`
+			} `json:"rateLimit"`
+			Repository map[string]*graphqlBlob `json:"repository"`
+		} `json:"data"`
+		Errors []struct {
+			Type    string `json:"type"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := gf.postJSON(ctx, gf.GraphQLURL(), map[string]any{"query": query, "variables": variables}, &response); err != nil {
+		return 0, 0, err
+	}
+	// Errors for single objects come with the data of the others.
+	if response.Data.Repository == nil && len(response.Errors) > 0 {
+		return 0, 0, fmt.Errorf("error querying %s: %s", gf.GraphQLURL(), response.Errors[0].Message)
+	}
+
+	for i, entry := range entries {
+		blob := response.Data.Repository[fmt.Sprintf("f%d", i)]
+		if blob == nil || blob.Text == nil || blob.IsBinary || blob.IsTruncated {
+			continue
+		}
+		if GitBlobSHA([]byte(*blob.Text)) != entry.Sha {
+			continue // Not valid UTF-8, for example
+		}
+		gf.mu.Lock()
+		gf.prefetched[entry.Path] = *blob.Text
+		gf.mu.Unlock()
+		gf.emit(Event{Type: EventFileBytes, Path: entry.Path, Size: int64(len(*blob.Text))})
+	}
+	return response.Data.RateLimit.Cost, response.Data.RateLimit.Remaining, nil
+}
+
+// postJSON sends body as JSON to an API URL and decodes the response into
+// v.
+func (gf *GithubFetcher) postJSON(ctx context.Context, url string, body any, v any) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	data, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("error encoding request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("error creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if err := gf.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := gf.do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return newHTTPError(resp, url)
+	}
+
+	bodyBytes, err := gf.readBody(resp, url, cancel)
+	if err != nil {
+		return fmt.Errorf("error reading body: %w", gf.classifyTimeout(err, url))
+	}
+	if err := json.Unmarshal(bodyBytes, v); err != nil {
+		return fmt.Errorf("error unmarshaling JSON: %w", err)
+	}
+	return nil
+}
+
+// fileContent returns the content of entry, taking it from a GraphQL batch
+// if it was in one. The content is released once taken.
+func (gf *GithubFetcher) fileContent(ctx context.Context, entry TreeEntry) (string, error) {
+	gf.mu.Lock()
+	content, ok := gf.prefetched[entry.Path]
+	delete(gf.prefetched, entry.Path)
+	gf.mu.Unlock()
+	if ok {
+		return content, nil
+	}
+	return gf.getFileContent(ctx, entry)
+}
@@ -0,0 +1,220 @@
+package subgit
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// textFiles returns n small text files.
+func textFiles(n int) map[string]string {
+	files := map[string]string{}
+	for i := 0; i < n; i++ {
+		files[fmt.Sprintf("dir/%03d.txt", i)] = fmt.Sprintf("file %d\n", i)
+	}
+	return files
+}
+
+// graphqlOptions returns options for fetching from f with BackendGraphQL.
+func graphqlOptions(f *fakeGitHub, rootDir string) Options {
+	opts := f.options(rootDir)
+	opts.Backend = BackendGraphQL
+	return opts
+}
+
+// batchSizes returns the number of blobs in each GraphQL query so far.
+func (f *fakeGitHub) batchSizes() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sizes := []int{}
+	for _, batch := range f.graphqlBatches {
+		sizes = append(sizes, len(batch))
+	}
+	return sizes
+}
+
+// rawRequests returns the number of raw downloads of files.
+func (f *fakeGitHub) rawRequests(files map[string]string) int {
+	n := 0
+	for name := range files {
+		n += f.requests("/raw/o/r/" + f.commit + "/" + name)
+	}
+	return n
+}
+
+func TestGraphQLBatches(t *testing.T) {
+	files := textFiles(120)
+	f := newFakeGitHub(t, files)
+	rootDir := t.TempDir()
+	if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, rootDir, files)
+	// Cheap, fast queries double the batch size.
+	if got, want := f.batchSizes(), []int{graphqlInitialBatch, 120 - graphqlInitialBatch}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+	if n := f.rawRequests(files); n != 0 {
+		t.Errorf("%d raw downloads, want none", n)
+	}
+
+	// Nothing is queried for files that are up to date.
+	if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.batchSizes(); len(got) != 2 {
+		t.Errorf("batch sizes = %v after fetching again, want no new query", got)
+	}
+}
+
+func TestGraphQLCost(t *testing.T) {
+	tests := []struct {
+		name string
+		cost func(n int) int
+		want []int
+		raw  int
+	}{
+		// A batch of 50 costing 5 shrinks to 10, which costs 1 and is
+		// fast enough to double again.
+		{name: "expensive", cost: func(n int) int { return (n + 9) / 10 }, want: []int{50, 10, 10}},
+		// Above the points remaining, the rest is downloaded raw.
+		{name: "rate limit", cost: func(n int) int { return 10000 }, want: []int{50}, raw: 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files := textFiles(70)
+			f := newFakeGitHub(t, files)
+			f.graphqlCost = tt.cost
+			rootDir := t.TempDir()
+			if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+				t.Fatal(err)
+			}
+			checkFiles(t, rootDir, files)
+			if got := f.batchSizes(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("batch sizes = %v, want %v", got, tt.want)
+			}
+			if n := f.rawRequests(files); n != tt.raw {
+				t.Errorf("%d raw downloads, want %d", n, tt.raw)
+			}
+		})
+	}
+}
+
+// TestGraphQLFallback checks that files GraphQL cannot return as text are
+// downloaded raw.
+func TestGraphQLFallback(t *testing.T) {
+	text := map[string]string{"a.txt": "a\n", "b.txt": "b\n"}
+	other := map[string]string{
+		"binary.bin": "bin\x00ary",
+		"latin1.txt": "caf\xe9\n", // No text, not being UTF-8
+		"large.txt":  strings.Repeat("x", graphqlMaxBlobSize+1),
+	}
+	files := map[string]string{}
+	for name, content := range text {
+		files[name] = content
+	}
+	for name, content := range other {
+		files[name] = content
+	}
+	f := newFakeGitHub(t, files)
+	rootDir := t.TempDir()
+	if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, rootDir, files)
+
+	f.mu.Lock()
+	batches := f.graphqlBatches
+	f.mu.Unlock()
+	want := [][]string{{"a.txt", "b.txt", "binary.bin", "latin1.txt"}}
+	if !reflect.DeepEqual(batches, want) {
+		t.Errorf("queried %v, want %v", batches, want)
+	}
+	if n := f.rawRequests(text); n != 0 {
+		t.Errorf("%d raw downloads of text files, want none", n)
+	}
+	for _, name := range []string{"binary.bin", "latin1.txt", "large.txt"} {
+		if n := f.rawRequests(map[string]string{name: ""}); n != 1 {
+			t.Errorf("%d raw downloads of %s, want 1", n, name)
+		}
+	}
+}
+
+// TestGraphQLUnavailable checks that every file is downloaded raw when the
+// API refuses queries.
+func TestGraphQLUnavailable(t *testing.T) {
+	files := textFiles(10)
+	f := newFakeGitHub(t, files)
+	refuse(f, "/graphql")
+	rootDir := t.TempDir()
+	if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, rootDir, files)
+	if got := f.requests("/graphql"); got != 1 {
+		t.Errorf("%d queries, want 1", got)
+	}
+	if n := f.rawRequests(files); n != 10 {
+		t.Errorf("%d raw downloads, want 10", n)
+	}
+}
+
+// TestGraphQLTransientError checks that a failing batch is retried at half
+// its size, which stays the limit.
+func TestGraphQLTransientError(t *testing.T) {
+	files := textFiles(40)
+	f := newFakeGitHub(t, files)
+	var queries atomic.Int32
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/graphql" {
+			return false
+		}
+		if queries.Add(1) <= 2 {
+			http.Error(w, "timed out", http.StatusBadGateway)
+			return true
+		}
+		return false
+	}
+	rootDir := t.TempDir()
+	if _, err := f.fetch(t, graphqlOptions(f, rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(t, rootDir, files)
+	// 40 and 20 failed, then the limit of 10 holds.
+	if got, want := f.batchSizes(), []int{10, 10, 10, 10}; !reflect.DeepEqual(got, want) {
+		t.Errorf("batch sizes = %v, want %v", got, want)
+	}
+}
+
+// TestGraphQLRelease checks that each batch is written and released before
+// the next one is queried.
+func TestGraphQLRelease(t *testing.T) {
+	files := textFiles(120)
+	f := newFakeGitHub(t, files)
+	gf, err := NewGithubFetcher(graphqlOptions(f, t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := []int{}
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path == "/graphql" {
+			gf.mu.Lock()
+			held = append(held, len(gf.prefetched))
+			gf.mu.Unlock()
+		}
+		return false
+	}
+	if _, err := gf.Fetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{0, 0}; !reflect.DeepEqual(held, want) {
+		t.Errorf("contents held when querying = %v, want %v", held, want)
+	}
+	if len(gf.prefetched) != 0 {
+		t.Errorf("%d contents held after Fetch, want none", len(gf.prefetched))
+	}
+}
@@ -0,0 +1,116 @@
+package subgit
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// HookError is returned by RunHooks when a hook fails. The files were
+// fetched.
+type HookError struct {
+	Command string
+	Err     error
+}
+
+func (e *HookError) Error() string {
+	return fmt.Sprintf("hook %q failed: %v", e.Command, e.Err)
+}
+
+func (e *HookError) Unwrap() error {
+	return e.Err
+}
+
+// RunHooks runs the hooks of the last Fetch, given as Options.Hooks or
+// recorded in the state file, one after another in RootDir. They only run
+// if result changed files. The environment describes the fetch:
+//
+//	SUBGIT_URL, SUBGIT_HOST, SUBGIT_REPO, SUBGIT_REF, SUBGIT_SUBFOLDER
+//	SUBGIT_COMMIT           the commit fetched
+//	SUBGIT_PREVIOUS_COMMIT  the commit of the run before, if known
+//	SUBGIT_CHANGED_FILES    changed repository paths, one per line
+//
+// The first hook that fails stops the others.
+func (gf *GithubFetcher) RunHooks(ctx context.Context, result *Result) error {
+	if result == nil || len(result.Changed) == 0 {
+		return nil
+	}
+
+	source := &State{Host: gf.Host, Repo: gf.RepoName, Local: gf.LocalRepo, Branch: gf.Branch, Subfolder: gf.Subfolder}
+	repo := gf.RepoName
+	if gf.LocalRepo != "" {
+		repo = gf.LocalRepo
+	}
+	env := append(os.Environ(),
+		"SUBGIT_URL="+source.URL(),
+		"SUBGIT_HOST="+gf.Host,
+		"SUBGIT_REPO="+repo,
+		"SUBGIT_REF="+gf.Branch,
+		"SUBGIT_SUBFOLDER="+gf.Subfolder,
+		"SUBGIT_COMMIT="+result.Commit,
+		"SUBGIT_PREVIOUS_COMMIT="+gf.previous,
+		"SUBGIT_CHANGED_FILES="+strings.Join(result.Changed, "\n"),
+	)
+	out := gf.HookOutput
+	if out == nil {
+		out = io.Discard
+	}
+
+	for _, hook := range gf.hooks {
+		cmd := ShellCommand(ctx, hook)
+		cmd.Dir = gf.RootDir
+		cmd.Env = env
+		cmd.Stdout = out
+		cmd.Stderr = out
+		if err := cmd.Run(); err != nil {
+			return &HookError{Command: hook, Err: err}
+		}
+	}
+	return nil
+}
+
+// ShellCommand returns the command that runs command through the shell:
+// sh -c, or cmd /C on Windows.
+func ShellCommand(ctx context.Context, command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.CommandContext(ctx, "cmd", "/C", command)
+	}
+	return exec.CommandContext(ctx, "sh", "-c", command)
+}
+
+// changedFiles returns the paths of the files this run changed. Patched
+// files are written again on every run, but only count if the upstream
+// blob or the patched result differs from the last run.
+func (gf *GithubFetcher) changedFiles(files []FileResult) []string {
+	changed := []string{}
+	for _, file := range files {
+		if file.UpToDate || file.Local == PolicySkip {
+			continue
+		}
+		base, ok := gf.baseFiles[file.Path]
+		if ok && base.Patched != "" && base.Sha == file.Sha && base.Mode == file.Mode && base.Patched == gf.patched[file.Path] {
+			continue
+		}
+		changed = append(changed, file.Path)
+	}
+	return changed
+}
+
+// nonEmpty drops empty commands, so that a single empty hook clears the
+// recorded ones.
+func nonEmpty(commands []string) []string {
+	if commands == nil {
+		return nil
+	}
+	kept := []string{}
+	for _, command := range commands {
+		if strings.TrimSpace(command) != "" {
+			kept = append(kept, command)
+		}
+	}
+	return kept
+}
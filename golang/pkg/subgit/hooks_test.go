@@ -0,0 +1,171 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fetchAndRunHooks runs Fetch and then RunHooks, as the CLI does.
+func fetchAndRunHooks(t *testing.T, opts Options) (*Result, error) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the hooks are sh commands")
+	}
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gf.Fetch(context.Background())
+	if err != nil {
+		return result, err
+	}
+	return result, gf.RunHooks(context.Background(), result)
+}
+
+// readLines returns the lines of the file name in rootDir, none if it
+// does not exist.
+func readLines(t *testing.T, rootDir, name string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(rootDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+}
+
+func TestRunHooks(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"lib/a.txt": "a\n", "lib/b.txt": "b\n"})
+	rootDir := t.TempDir()
+	opts := f.options(rootDir)
+	opts.Subfolder = "lib"
+	opts.Hooks = []string{
+		`echo "$SUBGIT_REPO $SUBGIT_REF $SUBGIT_SUBFOLDER $SUBGIT_COMMIT prev=$SUBGIT_PREVIOUS_COMMIT" >> hook.log`,
+		`printf '%s\n' "$SUBGIT_CHANGED_FILES" > changed.txt`,
+	}
+	run := func(opts Options) {
+		t.Helper()
+		if _, err := fetchAndRunHooks(t, opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run(opts)
+	first := f.commit
+	if got, want := readLines(t, rootDir, "hook.log"), []string{"o/r main lib " + first + " prev="}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hook.log = %q, want %q", got, want)
+	}
+	if got, want := readLines(t, rootDir, "changed.txt"), []string{"lib/a.txt", "lib/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed files = %q, want %q", got, want)
+	}
+
+	// Nothing changed, so the hooks do not run.
+	run(opts)
+	if got := readLines(t, rootDir, "hook.log"); len(got) != 1 {
+		t.Errorf("hook.log = %q after a fetch without changes, want one run", got)
+	}
+
+	// Without Options.Hooks the recorded ones run.
+	f.setFiles(map[string]string{"lib/a.txt": "a\n", "lib/b.txt": "b2\n"})
+	opts.Hooks = nil
+	run(opts)
+	if got, want := readLines(t, rootDir, "hook.log"), []string{"o/r main lib " + first + " prev=", "o/r main lib " + f.commit + " prev=" + first}; !reflect.DeepEqual(got, want) {
+		t.Errorf("hook.log = %q, want %q", got, want)
+	}
+	if got, want := readLines(t, rootDir, "changed.txt"), []string{"lib/b.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("changed files = %q, want %q", got, want)
+	}
+
+	// An empty hook clears them, for this and later runs.
+	for i, hooks := range [][]string{{""}, nil} {
+		f.setFiles(map[string]string{"lib/a.txt": "a\n", "lib/b.txt": strings.Repeat("b", i+3)})
+		opts.Hooks = hooks
+		run(opts)
+		if got := readLines(t, rootDir, "hook.log"); len(got) != 2 {
+			t.Errorf("hook.log = %q with hooks %q, want no new run", got, hooks)
+		}
+	}
+	state, err := LoadState(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Hooks) != 0 {
+		t.Errorf("recorded hooks = %q, want none", state.Hooks)
+	}
+}
+
+// TestRunHooksFailure checks that the first failing hook stops the others
+// and that the files stay fetched.
+func TestRunHooksFailure(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	rootDir := t.TempDir()
+	var output bytes.Buffer
+	opts := f.options(rootDir)
+	opts.Hooks = []string{"echo one; echo to-stderr >&2", "exit 3", "echo three"}
+	opts.HookOutput = &output
+
+	_, err := fetchAndRunHooks(t, opts)
+	var hookErr *HookError
+	if !errors.As(err, &hookErr) || hookErr.Command != "exit 3" {
+		t.Fatalf("RunHooks = %v, want the second hook to fail", err)
+	}
+	if code := ExitCode(err); code != ExitHookFailed {
+		t.Errorf("ExitCode = %d, want %d", code, ExitHookFailed)
+	}
+	if got := output.String(); got != "one\nto-stderr\n" {
+		t.Errorf("hook output = %q, want only the first hook's", got)
+	}
+	checkFiles(t, rootDir, map[string]string{"a.txt": "a\n"})
+}
+
+// TestChangedFilesPatched checks that a patched file, which is written
+// again on every run, only counts as changed when its upstream blob or its
+// patch did.
+func TestChangedFilesPatched(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": numbered(1, 20), "b.txt": "b\n"})
+	rootDir := t.TempDir()
+	patchDir := filepath.Join(rootDir, "patches")
+	if err := os.MkdirAll(patchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	writePatch := func(line string) {
+		t.Helper()
+		patch := "--- a/a.txt\n+++ b/a.txt\n@@ -1,3 +1,3 @@\n l1\n-l2\n+" + line + "\n l3\n"
+		writeTestFile(t, patchDir, "0001-local.patch", patch)
+	}
+	writePatch("patched")
+	opts := f.options(rootDir)
+	opts.PatchDir = patchDir
+
+	fetch := func(want ...string) {
+		t.Helper()
+		result, err := f.fetch(t, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(result.Changed, append([]string{}, want...)) {
+			t.Errorf("changed = %q, want %q", result.Changed, want)
+		}
+	}
+	fetch("a.txt", "b.txt")
+	fetch()
+
+	f.setFiles(map[string]string{"a.txt": numbered(1, 20), "b.txt": "b2\n"})
+	fetch("b.txt")
+
+	f.setFiles(map[string]string{"a.txt": numbered(1, 21), "b.txt": "b2\n"})
+	fetch("a.txt")
+
+	writePatch("patched again")
+	fetch("a.txt")
+	fetch()
+	checkFiles(t, rootDir, map[string]string{"a.txt": strings.Replace(numbered(1, 21), "l2\n", "patched again\n", 1)})
+}
@@ -0,0 +1,153 @@
+package subgit
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// IsLocalURL reports whether source names a local repository, as a
+// file:// URL or a path, rather than a GitHub URL.
+func IsLocalURL(source string) bool {
+	return strings.HasPrefix(source, "file://") || !strings.Contains(source, "://")
+}
+
+// ParseLocalURL splits file:///path/to/repo.git#ref:subdir, or the same
+// with a plain path, into the repository path, the ref and the subfolder.
+// The ref is HEAD and the subfolder empty if they are left out.
+func ParseLocalURL(source string) (string, string, string, error) {
+	repoPath, fragment, _ := strings.Cut(strings.TrimPrefix(source, "file://"), "#")
+	// file:///C:/repo on Windows
+	if len(repoPath) > 2 && repoPath[0] == '/' && repoPath[2] == ':' {
+		repoPath = repoPath[1:]
+	}
+	if repoPath == "" {
+		return "", "", "", fmt.Errorf("invalid local repository URL %q", source)
+	}
+	ref, subfolder, _ := strings.Cut(fragment, ":")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return filepath.FromSlash(repoPath), ref, strings.Trim(subfolder, "/"), nil
+}
+
+// LocalURL returns the URL ParseLocalURL splits into repoPath, ref and
+// subfolder.
+func LocalURL(repoPath, ref, subfolder string) string {
+	u := filepath.ToSlash(repoPath)
+	if !strings.HasPrefix(u, "/") {
+		u = "/" + u
+	}
+	u = "file://" + u + "#" + ref
+	if subfolder != "" {
+		u += ":" + subfolder
+	}
+	return u
+}
+
+// getLocalContent is getContent for a local repository.
+func (gf *GithubFetcher) getLocalContent(ref string, entry TreeEntry) (string, error) {
+	sha := entry.Sha
+	if sha == "" {
+		commit, err := gf.local.resolve(ref)
+		if err != nil {
+			return "", err
+		}
+		c, err := gf.local.readCommit(commit)
+		if err != nil {
+			return "", err
+		}
+		found, err := gf.local.lookup(c.Tree, entry.Path)
+		if err != nil {
+			return "", err
+		}
+		if found.Sha == "" {
+			return "", fmt.Errorf("no file %s at %s: %w", entry.Path, ref, fs.ErrNotExist)
+		}
+		sha = found.Sha
+	}
+
+	content, err := gf.local.readBlob(sha)
+	if err != nil {
+		return "", err
+	}
+	gf.emit(Event{Type: EventFileBytes, Path: entry.Path, Size: int64(len(content))})
+	return content, nil
+}
+
+// resolveLocalAt is resolveBranch with At for a local repository: the
+// first commit following first parents from Branch whose committer date
+// is not after At.
+func (gf *GithubFetcher) resolveLocalAt() (string, error) {
+	sha, err := gf.local.resolve(gf.Branch)
+	if err != nil {
+		return "", err
+	}
+	for sha != "" {
+		commit, err := gf.local.readCommit(sha)
+		if err != nil {
+			return "", err
+		}
+		if !commit.CommitDate.After(gf.At) {
+			return sha, nil
+		}
+		sha = ""
+		if len(commit.Parents) > 0 {
+			sha = commit.Parents[0]
+		}
+	}
+	return "", &NoCommitError{Branch: gf.Branch, At: gf.At}
+}
+
+// localLog is Log for a local repository. It follows first parents, like
+// git log --first-parent, and lists the commits that changed the
+// subfolder's tree.
+func (gf *GithubFetcher) localLog(since string) ([]Commit, error) {
+	sinceSha := ""
+	if since != "" {
+		var err error
+		if sinceSha, err = gf.local.resolve(since); err != nil {
+			return nil, err
+		}
+	}
+	sha, err := gf.local.resolve(gf.Branch)
+	if err != nil {
+		return nil, err
+	}
+
+	commits := []Commit{}
+	for sha != "" && sha != sinceSha {
+		commit, err := gf.local.readCommit(sha)
+		if err != nil {
+			return nil, err
+		}
+		subtree, err := gf.local.lookup(commit.Tree, gf.Subfolder)
+		if err != nil {
+			return nil, err
+		}
+		next, parentSubtree := "", gitTreeEntry{}
+		if len(commit.Parents) > 0 {
+			next = commit.Parents[0]
+			parent, err := gf.local.readCommit(next)
+			if err != nil {
+				return nil, err
+			}
+			if parentSubtree, err = gf.local.lookup(parent.Tree, gf.Subfolder); err != nil {
+				return nil, err
+			}
+		}
+
+		if subtree.Sha != parentSubtree.Sha {
+			subject, _, _ := strings.Cut(commit.Message, "\n")
+			commits = append(commits, Commit{
+				Sha:     sha,
+				Author:  commit.Author,
+				Date:    commit.AuthorDate,
+				Subject: strings.TrimSpace(subject),
+			})
+		}
+		sha = next
+	}
+	return commits, nil
+}
@@ -0,0 +1,88 @@
+package subgit
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// logPageSize is the number of commits requested per page, the most the
+// API allows.
+const logPageSize = 100
+
+// Commit is an entry of Log.
+type Commit struct {
+	Sha     string
+	Author  string
+	Date    time.Time // Author date
+	Subject string    // First line of the message
+	URL     string    // Web page of the commit, empty for local repositories
+}
+
+// Log lists the commits on Branch that touched the subfolder, newest
+// first. If since is not empty, it stops at that ref or SHA, which is not
+// included, as with git log since..Branch.
+func (gf *GithubFetcher) Log(ctx context.Context, since string) ([]Commit, error) {
+	if gf.local != nil {
+		return gf.localLog(since)
+	}
+
+	query := url.Values{}
+	query.Set("sha", gf.Branch)
+	query.Set("per_page", fmt.Sprint(logPageSize))
+	if gf.Subfolder != "" {
+		query.Set("path", gf.Subfolder)
+	}
+
+	// The path filter may hide the since commit itself, so also stop at
+	// its date rather than paging through the whole history.
+	sinceSha := ""
+	if since != "" {
+		sha, date, err := gf.ResolveCommit(ctx, since)
+		if err != nil {
+			return nil, err
+		}
+		sinceSha = sha
+		query.Set("since", date.UTC().Format(time.RFC3339))
+	}
+
+	commits := []Commit{}
+	for page := 1; ; page++ {
+		query.Set("page", fmt.Sprint(page))
+		pageURL := fmt.Sprintf("%s/repos/%s/commits?%s", gf.APIURL(), gf.RepoName, query.Encode())
+
+		var commitsResponse []struct {
+			Sha     string `json:"sha"`
+			HTMLURL string `json:"html_url"`
+			Commit  struct {
+				Message string `json:"message"`
+				Author  struct {
+					Name string    `json:"name"`
+					Date time.Time `json:"date"`
+				} `json:"author"`
+			} `json:"commit"`
+		}
+		if err := gf.getJSON(ctx, pageURL, &commitsResponse); err != nil {
+			return nil, err
+		}
+
+		for _, c := range commitsResponse {
+			if c.Sha == sinceSha {
+				return commits, nil
+			}
+			subject, _, _ := strings.Cut(c.Commit.Message, "\n")
+			commits = append(commits, Commit{
+				Sha:     c.Sha,
+				Author:  c.Commit.Author.Name,
+				Date:    c.Commit.Author.Date,
+				Subject: strings.TrimSpace(subject),
+				URL:     c.HTMLURL,
+			})
+		}
+		if len(commitsResponse) < logPageSize {
+			return commits, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package subgit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHistory makes f list a history of n commits, in which every other
+// one touches lib, honouring the path, since and paging parameters.
+func serveHistory(f *fakeGitHub, n int) {
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	sha := func(i int) string { return fmt.Sprintf("%040x", i) }
+	date := func(i int) time.Time { return base.Add(time.Duration(i) * time.Hour) }
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		if ref, ok := strings.CutPrefix(r.URL.Path, "/repos/o/r/commits/"); ok {
+			i, err := strconv.ParseInt(ref, 16, 64)
+			if err != nil {
+				return false
+			}
+			json.NewEncoder(w).Encode(map[string]any{
+				"sha":    ref,
+				"commit": map[string]any{"committer": map[string]any{"date": date(int(i))}},
+			})
+			return true
+		}
+		if r.URL.Path != "/repos/o/r/commits" {
+			return false
+		}
+		query := r.URL.Query()
+		since := time.Time{}
+		if s := query.Get("since"); s != "" {
+			since, _ = time.Parse(time.RFC3339, s)
+		}
+		matching := []map[string]any{}
+		for i := n - 1; i >= 0; i-- {
+			if (query.Get("path") == "lib" && i%2 != 0) || date(i).Before(since) {
+				continue
+			}
+			matching = append(matching, map[string]any{
+				"sha":      sha(i),
+				"html_url": "https://github.com/o/r/commit/" + sha(i),
+				"commit": map[string]any{
+					"message": fmt.Sprintf("Commit %d\n\nBody", i),
+					"author":  map[string]any{"name": "A U Thor", "date": date(i)},
+				},
+			})
+		}
+		page, _ := strconv.Atoi(query.Get("page"))
+		perPage, _ := strconv.Atoi(query.Get("per_page"))
+		start, end := min((page-1)*perPage, len(matching)), min(page*perPage, len(matching))
+		json.NewEncoder(w).Encode(matching[start:end])
+		return true
+	}
+}
+
+func TestLog(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		subfolder string
+		since     string
+		commits   int
+		newest    int // Index of the first commit listed
+		oldest    int // and of the last
+		pages     int
+	}{
+		{name: "everything", commits: 250, newest: 249, oldest: 0, pages: 3},
+		{name: "subfolder", subfolder: "lib", commits: 125, newest: 248, oldest: 0, pages: 2},
+		// Commit 100 touches lib and is found by SHA.
+		{name: "since listed commit", subfolder: "lib", since: fmt.Sprintf("%040x", 100), commits: 74, newest: 248, oldest: 102, pages: 1},
+		// Commit 101 does not, so the date ends the log.
+		{name: "since hidden commit", subfolder: "lib", since: fmt.Sprintf("%040x", 101), commits: 74, newest: 248, oldest: 102, pages: 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFakeGitHub(t, map[string]string{"lib/a.txt": "a\n"})
+			serveHistory(f, 250)
+			opts := f.options(t.TempDir())
+			opts.Subfolder = test.subfolder
+			gf, err := NewGithubFetcher(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			commits, err := gf.Log(context.Background(), test.since)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(commits) != test.commits {
+				t.Fatalf("%d commits, want %d", len(commits), test.commits)
+			}
+			newest, oldest := commits[0], commits[len(commits)-1]
+			if newest.Sha != fmt.Sprintf("%040x", test.newest) || oldest.Sha != fmt.Sprintf("%040x", test.oldest) {
+				t.Errorf("commits %s to %s, want %d to %d", newest.Sha, oldest.Sha, test.newest, test.oldest)
+			}
+			if want := fmt.Sprintf("Commit %d", test.newest); newest.Subject != want || newest.Author != "A U Thor" || newest.URL != "https://github.com/o/r/commit/"+newest.Sha {
+				t.Errorf("newest commit = %+v, want subject %q", newest, want)
+			}
+			if n := f.requests("/repos/o/r/commits"); n != test.pages {
+				t.Errorf("%d pages requested, want %d", n, test.pages)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+package subgit
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+)
+
+// ErrMergeConflict is returned when local changes and upstream changes to a
+// file overlap.
+var ErrMergeConflict = errors.New("merge conflict")
+
+// Conflict markers, as written by git.
+const (
+	markerLocal    = "<<<<<<< local"
+	markerSep      = "======="
+	markerUpstream = ">>>>>>> upstream"
+)
+
+// Merge3 merges the changes made from base to local with those made from
+// base to upstream, line by line. Where both sides changed the same lines
+// differently, both versions are written between conflict markers, and
+// conflicts counts how often that happened.
+func Merge3(base, local, upstream []byte) (merged []byte, conflicts int) {
+	baseLines := splitLines(base)
+	localLines := splitLines(local)
+	upstreamLines := splitLines(upstream)
+	toLocal := matchLines(baseLines, localLines)
+	toUpstream := matchLines(baseLines, upstreamLines)
+
+	var out bytes.Buffer
+	i, j, k := 0, 0, 0
+	for {
+		// Copy the lines that neither side touched.
+		for i < len(baseLines) && toLocal[i] == j && toUpstream[i] == k {
+			out.WriteString(baseLines[i])
+			i, j, k = i+1, j+1, k+1
+		}
+
+		// The changed region runs up to the next base line both sides kept.
+		ni, nj, nk := i, len(localLines), len(upstreamLines)
+		for ni < len(baseLines) && (toLocal[ni] < 0 || toUpstream[ni] < 0) {
+			ni++
+		}
+		if ni < len(baseLines) {
+			nj, nk = toLocal[ni], toUpstream[ni]
+		}
+		if ni == i && nj == j && nk == k {
+			break
+		}
+
+		b, l, u := baseLines[i:ni], localLines[j:nj], upstreamLines[k:nk]
+		switch {
+		case equalLines(l, b), equalLines(l, u):
+			writeLines(&out, u)
+		case equalLines(u, b):
+			writeLines(&out, l)
+		default:
+			conflicts++
+			writeConflict(&out, l, u)
+		}
+		i, j, k = ni, nj, nk
+	}
+
+	return out.Bytes(), conflicts
+}
+
+// isBinary reports whether content looks like something Merge3 should not
+// touch.
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) >= 0
+}
+
+// splitLines splits content after each newline, keeping the newlines so
+// that the lines join back into the exact content.
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func equalLines(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func writeLines(out *bytes.Buffer, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+	}
+}
+
+func writeConflict(out *bytes.Buffer, local, upstream []string) {
+	out.WriteString(markerLocal + "\n")
+	writeSide(out, local)
+	out.WriteString(markerSep + "\n")
+	writeSide(out, upstream)
+	out.WriteString(markerUpstream + "\n")
+}
+
+// writeSide writes one side of a conflict, ending it with a newline so the
+// following marker starts on a line of its own.
+func writeSide(out *bytes.Buffer, lines []string) {
+	writeLines(out, lines)
+	if len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+		out.WriteString("\n")
+	}
+}
+
+// matchLines returns, for each line of a, the index of the line of b it
+// corresponds to in a shortest edit script from a to b, or -1 if the line
+// was deleted.
+func matchLines(a, b []string) []int {
+	match := make([]int, len(a))
+	for i := range match {
+		match[i] = -1
+	}
+
+	// Most edits are small, so strip the common ends before diffing.
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		match[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		match[len(a)-1-suffix] = len(b) - 1 - suffix
+		suffix++
+	}
+
+	myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix], func(i, j int) {
+		match[prefix+i] = prefix + j
+	})
+	return match
+}
+
+// myersDiff calls matched for every pair of equal lines kept by a shortest
+// edit script from a to b, found with Myers' O(ND) algorithm.
+func myersDiff(a, b []string, matched func(i, j int)) {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k = x - y. trace[d]
+	// keeps the diagonals -d..d after d edits, for the walk back.
+	offset := n + m
+	v := make([]int, 2*(n+m)+2)
+	var trace [][]int
+	end := -1
+	for d := 0; d <= n+m && end < 0; d++ {
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1] // Insertion
+			} else {
+				x = v[offset+k-1] + 1 // Deletion
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				end = d
+				break
+			}
+		}
+		trace = append(trace, append([]int(nil), v[offset-d:offset+d+1]...))
+	}
+
+	x, y := n, m
+	for d := end; d > 0; d-- {
+		prev := trace[d-1]
+		at := func(k int) int { return prev[k+d-1] }
+
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			x, y = x-1, y-1
+			matched(x, y)
+		}
+		x, y = prevX, prevY
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		matched(x, y)
+	}
+}
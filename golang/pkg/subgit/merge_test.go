@@ -0,0 +1,230 @@
+package subgit
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestMerge3(t *testing.T) {
+	tests := []struct {
+		name                  string
+		base, local, upstream string
+		want                  string
+		wantConflicts         int
+	}{
+		{
+			name: "unchanged",
+			base: "1\n2\n3\n", local: "1\n2\n3\n", upstream: "1\n2\n3\n",
+			want: "1\n2\n3\n",
+		},
+		{
+			name: "only local changed",
+			base: "1\n2\n3\n", local: "1\nL\n3\n", upstream: "1\n2\n3\n",
+			want: "1\nL\n3\n",
+		},
+		{
+			name: "only upstream changed",
+			base: "1\n2\n3\n", local: "1\n2\n3\n", upstream: "1\nU\n3\n",
+			want: "1\nU\n3\n",
+		},
+		{
+			name: "same change on both sides",
+			base: "1\n2\n3\n", local: "1\nX\n3\n", upstream: "1\nX\n3\n",
+			want: "1\nX\n3\n",
+		},
+		{
+			name: "separate changes",
+			base: "1\n2\n3\n4\n5\n", local: "1\nL\n3\n4\n5\n", upstream: "1\n2\n3\nU\n5\n",
+			want: "1\nL\n3\nU\n5\n",
+		},
+		{
+			name: "separate deletion and change",
+			base: "1\n2\n3\n4\n5\n", local: "1\n3\n4\n5\n", upstream: "1\n2\n3\nU\n5\n",
+			want: "1\n3\nU\n5\n",
+		},
+		{
+			name: "separate insertions",
+			base: "1\n2\n3\n", local: "1\nL\n2\n3\n", upstream: "1\n2\nU\n3\n",
+			want: "1\nL\n2\nU\n3\n",
+		},
+		{
+			name: "overlapping changes",
+			base: "1\n2\n3\n", local: "1\nL\n3\n", upstream: "1\nU\n3\n",
+			want:          "1\n<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n3\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "partly overlapping changes",
+			base: "1\n2\n3\n4\n", local: "1\nL\nL\n4\n", upstream: "1\n2\nU\n4\n",
+			want:          "1\n<<<<<<< local\nL\nL\n=======\n2\nU\n>>>>>>> upstream\n4\n",
+			wantConflicts: 1,
+		},
+		{
+			// Like git, changes to neighbouring lines conflict, since there
+			// is no unchanged line between them to anchor the merge.
+			name: "adjacent changes",
+			base: "1\n2\n3\n4\n", local: "1\nL\n3\n4\n", upstream: "1\n2\nU\n4\n",
+			want:          "1\n<<<<<<< local\nL\n3\n=======\n2\nU\n>>>>>>> upstream\n4\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "two conflicts",
+			base: "1\n2\n3\n4\n5\n", local: "L\n2\n3\n4\nL\n", upstream: "U\n2\n3\n4\nU\n",
+			want:          "<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n2\n3\n4\n<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n",
+			wantConflicts: 2,
+		},
+		{
+			name: "deletion against change",
+			base: "1\n2\n3\n", local: "1\n3\n", upstream: "1\nU\n3\n",
+			want:          "1\n<<<<<<< local\n=======\nU\n>>>>>>> upstream\n3\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "same deletion on both sides",
+			base: "1\n2\n3\n", local: "1\n3\n", upstream: "1\n3\n",
+			want: "1\n3\n",
+		},
+		{
+			name: "insertions at the same point",
+			base: "1\n2\n", local: "1\nL\n2\n", upstream: "1\nU\n2\n",
+			want:          "1\n<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n2\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "same insertion at the same point",
+			base: "1\n2\n", local: "1\nX\n2\n", upstream: "1\nX\n2\n",
+			want: "1\nX\n2\n",
+		},
+		{
+			name: "insertions at the end",
+			base: "1\n", local: "1\nL\n", upstream: "1\nU\n",
+			want:          "1\n<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "empty base, local only",
+			base: "", local: "L\n", upstream: "",
+			want: "L\n",
+		},
+		{
+			name: "empty base, same content",
+			base: "", local: "X\n", upstream: "X\n",
+			want: "X\n",
+		},
+		{
+			name: "empty base, different content",
+			base: "", local: "L\n", upstream: "U\n",
+			want:          "<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "everything deleted upstream",
+			base: "1\n2\n", local: "1\n2\n", upstream: "",
+			want: "",
+		},
+		{
+			name: "missing trailing newline kept",
+			base: "1\n2", local: "L\n2", upstream: "1\n2",
+			want: "L\n2",
+		},
+		{
+			name: "trailing newline added on both sides",
+			base: "1\n2\n3", local: "L\n2\n3\n", upstream: "1\n2\n3\n",
+			want: "L\n2\n3\n",
+		},
+		{
+			name: "trailing newline added on one side, change on the other",
+			base: "1\n2\n3", local: "1\n2\n3\n", upstream: "U\n2\n3",
+			want: "U\n2\n3\n",
+		},
+		{
+			// The marker after a side without a final newline still starts
+			// on a line of its own.
+			name: "conflict without trailing newlines",
+			base: "1\n2", local: "1\nL", upstream: "1\nU",
+			want:          "1\n<<<<<<< local\nL\n=======\nU\n>>>>>>> upstream\n",
+			wantConflicts: 1,
+		},
+		{
+			name: "conflict between newline and none",
+			base: "1\n2", local: "1\n2\n", upstream: "1\n2\n3",
+			want:          "1\n<<<<<<< local\n2\n=======\n2\n3\n>>>>>>> upstream\n",
+			wantConflicts: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			merged, conflicts := Merge3([]byte(tt.base), []byte(tt.local), []byte(tt.upstream))
+			if string(merged) != tt.want || conflicts != tt.wantConflicts {
+				t.Errorf("Merge3 = %q, %d conflicts, want %q, %d", merged, conflicts, tt.want, tt.wantConflicts)
+			}
+		})
+	}
+}
+
+// TestMatchLinesIsShortest checks matchLines against the length of the
+// longest common subsequence, on random inputs with many repeated lines.
+func TestMatchLinesIsShortest(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomLines := func() []string {
+		lines := make([]string, rng.Intn(30))
+		for i := range lines {
+			lines[i] = string(rune('a'+rng.Intn(4))) + "\n"
+		}
+		return lines
+	}
+
+	for n := 0; n < 500; n++ {
+		a, b := randomLines(), randomLines()
+		match := matchLines(a, b)
+
+		matched, last := 0, -1
+		for i, j := range match {
+			if j < 0 {
+				continue
+			}
+			if j <= last || j >= len(b) || a[i] != b[j] {
+				t.Fatalf("matchLines(%q, %q) = %v: line %d matched to %d", a, b, match, i, j)
+			}
+			last = j
+			matched++
+		}
+		if want := lcsLength(a, b); matched != want {
+			t.Fatalf("matchLines(%q, %q) = %v: %d lines matched, want %d", a, b, match, matched, want)
+		}
+	}
+}
+
+func lcsLength(a, b []string) int {
+	prev := make([]int, len(b)+1)
+	for i := range a {
+		cur := make([]int, len(b)+1)
+		for j := range b {
+			if a[i] == b[j] {
+				cur[j+1] = prev[j] + 1
+			} else {
+				cur[j+1] = max(prev[j+1], cur[j])
+			}
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func TestMyersDiffEmpty(t *testing.T) {
+	lines := strings.SplitAfter("a\nb\n", "\n")
+	for _, pair := range [][2][]string{{nil, nil}, {nil, lines}, {lines, nil}} {
+		myersDiff(pair[0], pair[1], func(i, j int) {
+			t.Errorf("myersDiff(%q, %q) matched %d to %d", pair[0], pair[1], i, j)
+		})
+	}
+}
+
+func TestSplitLinesJoinsBack(t *testing.T) {
+	for _, content := range []string{"", "\n", "a", "a\n", "a\nb", "a\n\nb\n"} {
+		if got := strings.Join(splitLines([]byte(content)), ""); got != content {
+			t.Errorf("splitLines(%q) joins to %q", content, got)
+		}
+	}
+}
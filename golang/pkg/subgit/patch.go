@@ -0,0 +1,423 @@
+package subgit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// maxFuzz is how many context lines at either end of a hunk may be ignored
+// when it does not apply as is, like the default of GNU patch.
+const maxFuzz = 2
+
+// diffContext is the number of context lines around generated hunks.
+const diffContext = 3
+
+var hunkHeader = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// Patch is a parsed unified diff, as written by diff -u, git diff or git
+// format-patch.
+type Patch struct {
+	Header string // Everything before the first file, e.g. the commit message
+	Files  []*FilePatch
+}
+
+// FilePatch is the part of a patch changing one file.
+type FilePatch struct {
+	OldPath string // Repository path before the change, empty for a new file
+	NewPath string // Repository path after the change, empty for a deleted file
+	NewMode string // Git file mode after the change, if the patch sets one
+	Hunks   []*Hunk
+}
+
+// Hunk is one @@ section of a file patch.
+type Hunk struct {
+	OldStart, OldLines int
+	NewStart, NewLines int
+	Lines              []string // Prefixed with ' ', '-' or '+', newline included unless missing in the file
+}
+
+// ParsePatch parses a unified diff. Paths are taken from the diff --git,
+// --- and +++ lines with their first component (a/, b/) removed.
+func ParsePatch(data []byte) (*Patch, error) {
+	patch := &Patch{}
+	lines := splitLines(data)
+	header := true
+	var file *FilePatch
+
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSuffix(lines[i], "\n")
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			oldPath, newPath := parseGitDiffLine(line)
+			file = &FilePatch{OldPath: oldPath, NewPath: newPath}
+			patch.Files = append(patch.Files, file)
+			header = false
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			oldPath := parsePatchPath(line[4:])
+			newPath := parsePatchPath(strings.TrimSuffix(lines[i+1], "\n")[4:])
+			if file == nil || len(file.Hunks) > 0 {
+				file = &FilePatch{}
+				patch.Files = append(patch.Files, file)
+			}
+			file.OldPath, file.NewPath = oldPath, newPath
+			header = false
+			i++
+		case file != nil && strings.HasPrefix(line, "new file mode "):
+			file.OldPath = ""
+			file.NewMode = strings.TrimPrefix(line, "new file mode ")
+		case file != nil && strings.HasPrefix(line, "new mode "):
+			file.NewMode = strings.TrimPrefix(line, "new mode ")
+		case file != nil && strings.HasPrefix(line, "deleted file mode "):
+			file.NewPath = ""
+		case file != nil && (strings.HasPrefix(line, "GIT binary patch") || strings.HasPrefix(line, "Binary files ")):
+			return nil, fmt.Errorf("error parsing patch: binary patches are not supported")
+		case file != nil && strings.HasPrefix(line, "@@ "):
+			hunk, next, err := parseHunk(lines, i)
+			if err != nil {
+				return nil, err
+			}
+			file.Hunks = append(file.Hunks, hunk)
+			i = next - 1
+		case header:
+			patch.Header += lines[i]
+		}
+	}
+	return patch, nil
+}
+
+// parseHunk parses the hunk whose header is lines[start] and returns the
+// index of the line after it.
+func parseHunk(lines []string, start int) (*Hunk, int, error) {
+	m := hunkHeader.FindStringSubmatch(lines[start])
+	if m == nil {
+		return nil, 0, fmt.Errorf("error parsing patch: invalid hunk header on line %d", start+1)
+	}
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	hunk := &Hunk{OldLines: count(m[2]), NewLines: count(m[4])}
+	hunk.OldStart, _ = strconv.Atoi(m[1])
+	hunk.NewStart, _ = strconv.Atoi(m[3])
+
+	oldLeft, newLeft := hunk.OldLines, hunk.NewLines
+	i := start + 1
+	for ; i < len(lines) && (oldLeft > 0 || newLeft > 0 || strings.HasPrefix(lines[i], `\`)); i++ {
+		line := lines[i]
+		if line == "\n" {
+			line = " \n" // Context line whose trailing space was stripped
+		}
+		switch line[0] {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			// "\ No newline at end of file" applies to the previous line.
+			if n := len(hunk.Lines); n > 0 {
+				hunk.Lines[n-1] = strings.TrimSuffix(hunk.Lines[n-1], "\n")
+			}
+			continue
+		default:
+			return nil, 0, fmt.Errorf("error parsing patch: unexpected line %d in hunk", i+1)
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, 0, fmt.Errorf("error parsing patch: hunk on line %d is longer than its header says", start+1)
+		}
+		hunk.Lines = append(hunk.Lines, line)
+	}
+	if oldLeft > 0 || newLeft > 0 {
+		return nil, 0, fmt.Errorf("error parsing patch: hunk on line %d is truncated", start+1)
+	}
+	return hunk, i, nil
+}
+
+// parseGitDiffLine returns the paths of a "diff --git a/x b/x" line.
+func parseGitDiffLine(line string) (string, string) {
+	rest := strings.TrimPrefix(line, "diff --git ")
+	if strings.HasPrefix(rest, `"`) {
+		fields := strings.SplitN(rest, `" `, 2)
+		if len(fields) == 2 {
+			return parsePatchPath(fields[0] + `"`), parsePatchPath(fields[1])
+		}
+	}
+	// Without quotes the paths are only unambiguous when they are equal.
+	if half := len(rest) / 2; len(rest)%2 == 1 && rest[half] == ' ' {
+		return parsePatchPath(rest[:half]), parsePatchPath(rest[half+1:])
+	}
+	fields := strings.Fields(rest)
+	if len(fields) != 2 {
+		return "", ""
+	}
+	return parsePatchPath(fields[0]), parsePatchPath(fields[1])
+}
+
+// parsePatchPath turns the path of a --- or +++ line into a repository
+// path, empty for /dev/null.
+func parsePatchPath(s string) string {
+	if tab := strings.IndexByte(s, '\t'); tab >= 0 {
+		s = s[:tab] // Timestamp written by diff -u
+	}
+	s = strings.TrimSpace(s)
+	if unquoted, err := strconv.Unquote(s); err == nil {
+		s = unquoted
+	}
+	if s == "/dev/null" {
+		return ""
+	}
+	if slash := strings.IndexByte(s, '/'); slash >= 0 {
+		return s[slash+1:]
+	}
+	return s
+}
+
+// HunkError describes a part of a patch that did not apply.
+type HunkError struct {
+	Path   string
+	Hunk   int // Counting from 1, 0 if the file could not be patched at all
+	Line   int // Line of the hunk in the original file
+	Reason string
+}
+
+func (e HunkError) Error() string {
+	if e.Hunk == 0 {
+		return fmt.Sprintf("%s: %s", e.Path, e.Reason)
+	}
+	return fmt.Sprintf("%s: hunk #%d at line %d %s", e.Path, e.Hunk, e.Line, e.Reason)
+}
+
+// Apply applies the hunks to content. Hunks are looked for near the line
+// their header gives, shifted by the offset of the hunks before them, and,
+// failing that, with up to maxFuzz context lines ignored at either end.
+// The content is only usable if no errors are returned.
+func (fp *FilePatch) Apply(content []byte) ([]byte, []HunkError) {
+	path := fp.NewPath
+	if path == "" {
+		path = fp.OldPath
+	}
+	lines := splitLines(content)
+
+	var out bytes.Buffer
+	var failures []HunkError
+	pos, offset := 0, 0
+	for n, hunk := range fp.Hunks {
+		oldLines, newLines := hunk.split()
+		at, lead, trail := -1, 0, 0
+		for fuzz := 0; fuzz <= maxFuzz && at < 0; fuzz++ {
+			lead = min(fuzz, hunk.leadingContext())
+			trail = min(fuzz, hunk.trailingContext())
+			if lead+trail > len(oldLines) {
+				break
+			}
+			want := hunk.OldStart - 1 + offset + lead
+			if hunk.OldLines == 0 {
+				want = hunk.OldStart + offset // Inserted after line OldStart
+			}
+			at = findLines(lines, oldLines[lead:len(oldLines)-trail], want, pos)
+		}
+		if at < 0 {
+			failures = append(failures, HunkError{Path: path, Hunk: n + 1, Line: hunk.OldStart, Reason: "does not apply"})
+			continue
+		}
+
+		writeLines(&out, lines[pos:at])
+		writeLines(&out, newLines[lead:len(newLines)-trail])
+		pos = at + len(oldLines) - lead - trail
+		offset = at - lead - (hunk.OldStart - 1)
+		if hunk.OldLines == 0 {
+			offset = at - hunk.OldStart
+		}
+	}
+	writeLines(&out, lines[pos:])
+	return out.Bytes(), failures
+}
+
+// split returns the lines the hunk expects and the lines it writes.
+func (h *Hunk) split() ([]string, []string) {
+	var oldLines, newLines []string
+	for _, line := range h.Lines {
+		switch line[0] {
+		case ' ':
+			oldLines = append(oldLines, line[1:])
+			newLines = append(newLines, line[1:])
+		case '-':
+			oldLines = append(oldLines, line[1:])
+		case '+':
+			newLines = append(newLines, line[1:])
+		}
+	}
+	return oldLines, newLines
+}
+
+func (h *Hunk) leadingContext() int {
+	n := 0
+	for n < len(h.Lines) && h.Lines[n][0] == ' ' {
+		n++
+	}
+	return n
+}
+
+func (h *Hunk) trailingContext() int {
+	n := 0
+	for n < len(h.Lines) && h.Lines[len(h.Lines)-1-n][0] == ' ' {
+		n++
+	}
+	return n
+}
+
+// findLines returns the index closest to want, and not before from, at
+// which lines contains find, or -1.
+func findLines(lines, find []string, want, from int) int {
+	last := len(lines) - len(find)
+	want = max(from, min(want, last))
+	for d := 0; want-d >= from || want+d <= last; d++ {
+		if i := want - d; i >= from && i <= last && equalLines(lines[i:i+len(find)], find) {
+			return i
+		}
+		if i := want + d; d > 0 && i >= from && i <= last && equalLines(lines[i:i+len(find)], find) {
+			return i
+		}
+	}
+	return -1
+}
+
+// writeFileDiff writes a git-style diff turning oldFile into newFile, where
+// nil stands for a missing file, and returns the number of lines added and
+// removed.
+func writeFileDiff(w io.Writer, path string, oldFile, newFile *patchFile) (insertions, deletions int) {
+	fmt.Fprintf(w, "diff --git a/%s b/%s\n", path, path)
+	oldName, newName := "a/"+path, "b/"+path
+	var oldContent, newContent []byte
+	switch {
+	case oldFile == nil:
+		fmt.Fprintf(w, "new file mode %s\n", gitFileMode(newFile.mode))
+		oldName, newContent = "/dev/null", newFile.content
+	case newFile == nil:
+		fmt.Fprintf(w, "deleted file mode %s\n", gitFileMode(oldFile.mode))
+		newName, oldContent = "/dev/null", oldFile.content
+	default:
+		oldContent, newContent = oldFile.content, newFile.content
+		if gitFileMode(oldFile.mode) != gitFileMode(newFile.mode) {
+			fmt.Fprintf(w, "old mode %s\nnew mode %s\n", gitFileMode(oldFile.mode), gitFileMode(newFile.mode))
+		}
+	}
+	if bytes.Equal(oldContent, newContent) {
+		return 0, 0
+	}
+	if isBinary(oldContent) || isBinary(newContent) {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return 0, 0
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", oldName, newName)
+
+	a, b := splitLines(oldContent), splitLines(newContent)
+	match := matchLines(a, b)
+
+	// The edit script as (operation, line) pairs, deletions first.
+	type op struct {
+		kind byte
+		line string
+	}
+	var ops []op
+	j := 0
+	for i := 0; i < len(a) || j < len(b); {
+		switch {
+		case i < len(a) && match[i] == j:
+			ops = append(ops, op{' ', a[i]})
+			i, j = i+1, j+1
+		case i < len(a) && match[i] < 0:
+			ops = append(ops, op{'-', a[i]})
+			deletions++
+			i++
+		default:
+			ops = append(ops, op{'+', b[j]})
+			insertions++
+			j++
+		}
+	}
+
+	for start := 0; start < len(ops); {
+		// Find the next change and extend the hunk while the gap to the
+		// following one is short enough to share context.
+		first := start
+		for first < len(ops) && ops[first].kind == ' ' {
+			first++
+		}
+		if first == len(ops) {
+			break
+		}
+		last := first
+		for k := first; k < len(ops); k++ {
+			if ops[k].kind != ' ' {
+				if k-last-1 > 2*diffContext {
+					break
+				}
+				last = k
+			}
+		}
+		from := max(start, first-diffContext)
+		to := min(len(ops), last+1+diffContext)
+
+		oldStart, newStart := 0, 0
+		for _, o := range ops[:from] {
+			if o.kind != '+' {
+				oldStart++
+			}
+			if o.kind != '-' {
+				newStart++
+			}
+		}
+		oldLines, newLines := 0, 0
+		for _, o := range ops[from:to] {
+			if o.kind != '+' {
+				oldLines++
+			}
+			if o.kind != '-' {
+				newLines++
+			}
+		}
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLines), hunkRange(newStart, newLines))
+		for _, o := range ops[from:to] {
+			fmt.Fprintf(w, "%c%s", o.kind, o.line)
+			if !strings.HasSuffix(o.line, "\n") {
+				io.WriteString(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		start = to
+	}
+	return insertions, deletions
+}
+
+// gitFileMode returns the git mode of a file with the given mode.
+func gitFileMode(mode os.FileMode) string {
+	if mode&os.ModeSymlink != 0 {
+		return ModeSymlink
+	}
+	if mode&0111 != 0 {
+		return ModeExecutable
+	}
+	return ModeFile
+}
+
+// hunkRange formats the start and length of a hunk as git does: lines count
+// from 1, and an empty range starts at the line before it.
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if lines == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
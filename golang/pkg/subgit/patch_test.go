@@ -0,0 +1,547 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// numbered returns lines l<from> to l<to>.
+func numbered(from, to int) string {
+	var b strings.Builder
+	for i := from; i <= to; i++ {
+		fmt.Fprintf(&b, "l%d\n", i)
+	}
+	return b.String()
+}
+
+// changeL5 replaces l5 with X, with three lines of context.
+const changeL5 = `--- a/f.txt
++++ b/f.txt
+@@ -2,7 +2,7 @@
+ l2
+ l3
+ l4
+-l5
++X
+ l6
+ l7
+ l8
+`
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   string
+		content string
+		want    string
+		failed  []int // Hunks that do not apply
+	}{
+		{
+			name:    "exact",
+			patch:   changeL5,
+			content: numbered(1, 10),
+			want:    strings.Replace(numbered(1, 10), "l5\n", "X\n", 1),
+		},
+		{
+			name:    "offset",
+			patch:   changeL5,
+			content: "a\nb\nc\n" + numbered(1, 10),
+			want:    "a\nb\nc\n" + strings.Replace(numbered(1, 10), "l5\n", "X\n", 1),
+		},
+		{
+			name:    "negative offset",
+			patch:   changeL5,
+			content: numbered(2, 10),
+			want:    strings.Replace(numbered(2, 10), "l5\n", "X\n", 1),
+		},
+		{
+			name:    "fuzz 1",
+			patch:   changeL5,
+			content: strings.Replace(numbered(1, 10), "l2\n", "changed\n", 1),
+			want:    strings.NewReplacer("l2\n", "changed\n", "l5\n", "X\n").Replace(numbered(1, 10)),
+		},
+		{
+			name:    "fuzz 1 at the end",
+			patch:   changeL5,
+			content: strings.Replace(numbered(1, 10), "l8\n", "changed\n", 1),
+			want:    strings.NewReplacer("l8\n", "changed\n", "l5\n", "X\n").Replace(numbered(1, 10)),
+		},
+		{
+			name:    "fuzz 2",
+			patch:   changeL5,
+			content: strings.NewReplacer("l2\n", "changed\n", "l7\n", "changed\n").Replace(numbered(1, 10)),
+			want:    strings.NewReplacer("l2\n", "changed\n", "l7\n", "changed\n", "l5\n", "X\n").Replace(numbered(1, 10)),
+		},
+		{
+			name:    "more fuzz than allowed",
+			patch:   changeL5,
+			content: strings.NewReplacer("l2\n", "changed\n", "l3\n", "changed\n", "l4\n", "changed\n").Replace(numbered(1, 10)),
+			failed:  []int{1},
+		},
+		{
+			name:    "removed line differs",
+			patch:   changeL5,
+			content: strings.Replace(numbered(1, 10), "l5\n", "other\n", 1),
+			failed:  []int{1},
+		},
+		{
+			name: "second hunk shifted by the first",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -1,2 +1,4 @@
+ l1
++new1
++new2
+ l2
+@@ -20,2 +22,2 @@
+-l20
++X
+ l21
+`,
+			content: numbered(1, 25),
+			want:    strings.NewReplacer("l1\n", "l1\nnew1\nnew2\n", "l20\n", "X\n").Replace(numbered(1, 25)),
+		},
+		{
+			name: "one of two hunks fails",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -1,2 +1,2 @@
+-l1
++X
+ l2
+@@ -20,2 +20,2 @@
+-missing
++Y
+ l21
+`,
+			content: numbered(1, 25),
+			failed:  []int{2},
+		},
+		{
+			name: "insertion without context",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -2,0 +3 @@
++X
+`,
+			content: numbered(1, 4),
+			want:    "l1\nl2\nX\nl3\nl4\n",
+		},
+		{
+			name: "add missing newline",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -1,2 +1,2 @@
+ a
+-b
+\ No newline at end of file
++b
+`,
+			content: "a\nb",
+			want:    "a\nb\n",
+		},
+		{
+			name: "remove newline",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -1,2 +1,2 @@
+ a
+-b
++b
+\ No newline at end of file
+`,
+			content: "a\nb\n",
+			want:    "a\nb",
+		},
+		{
+			name: "missing newline does not match",
+			patch: `--- a/f.txt
++++ b/f.txt
+@@ -1,2 +1,2 @@
+ a
+-b
++c
+`,
+			content: "a\nb",
+			failed:  []int{1},
+		},
+		{
+			name: "new file",
+			patch: `diff --git a/f.txt b/f.txt
+new file mode 100644
+--- /dev/null
++++ b/f.txt
+@@ -0,0 +1,2 @@
++a
++b
+`,
+			content: "",
+			want:    "a\nb\n",
+		},
+		{
+			name: "deleted file",
+			patch: `diff --git a/f.txt b/f.txt
+deleted file mode 100644
+--- a/f.txt
++++ /dev/null
+@@ -1,2 +0,0 @@
+-a
+-b
+`,
+			content: "a\nb\n",
+			want:    "",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := ParsePatch([]byte(tt.patch))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(patch.Files) != 1 {
+				t.Fatalf("parsed %d files, want 1", len(patch.Files))
+			}
+			got, failures := patch.Files[0].Apply([]byte(tt.content))
+			var failed []int
+			for _, failure := range failures {
+				if failure.Path != "f.txt" {
+					t.Errorf("failure %v is for %s, want f.txt", failure, failure.Path)
+				}
+				failed = append(failed, failure.Hunk)
+			}
+			if fmt.Sprint(failed) != fmt.Sprint(tt.failed) {
+				t.Fatalf("failed hunks %v, want %v", failed, tt.failed)
+			}
+			if tt.failed == nil && string(got) != tt.want {
+				t.Errorf("Apply = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePatch(t *testing.T) {
+	patch, err := ParsePatch([]byte(`From 1234 Mon Sep 17 00:00:00 2001
+Subject: [PATCH] Local changes
+
+---
+diff --git a/new.sh b/new.sh
+new file mode 100755
+--- /dev/null
++++ b/new.sh
+@@ -0,0 +1 @@
++echo hi
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+diff --git "a/with space.txt" "b/with space.txt"
+--- "a/with space.txt"
++++ "b/with space.txt"
+@@ -1 +1 @@
+-a
++b
+--- a/plain.txt	2026-01-01 00:00:00.000000000 +0000
++++ b/plain.txt	2026-01-02 00:00:00.000000000 +0000
+@@ -1,3 +1,3 @@
+-a
+
++b
+ c
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "From 1234 Mon Sep 17 00:00:00 2001\nSubject: [PATCH] Local changes\n\n---\n"; patch.Header != want {
+		t.Errorf("Header = %q, want %q", patch.Header, want)
+	}
+	want := []FilePatch{
+		{OldPath: "", NewPath: "new.sh", NewMode: ModeExecutable},
+		{OldPath: "gone.txt", NewPath: ""},
+		{OldPath: "run.sh", NewPath: "run.sh", NewMode: ModeExecutable},
+		{OldPath: "with space.txt", NewPath: "with space.txt"},
+		{OldPath: "plain.txt", NewPath: "plain.txt"},
+	}
+	if len(patch.Files) != len(want) {
+		t.Fatalf("parsed %d files, want %d", len(patch.Files), len(want))
+	}
+	for i, fp := range patch.Files {
+		if fp.OldPath != want[i].OldPath || fp.NewPath != want[i].NewPath || fp.NewMode != want[i].NewMode {
+			t.Errorf("file %d = %q -> %q mode %q, want %q -> %q mode %q", i, fp.OldPath, fp.NewPath, fp.NewMode, want[i].OldPath, want[i].NewPath, want[i].NewMode)
+		}
+	}
+	if len(patch.Files[2].Hunks) != 0 {
+		t.Errorf("mode change has %d hunks, want none", len(patch.Files[2].Hunks))
+	}
+	// A context line whose trailing space was stripped is still context.
+	if lines := patch.Files[4].Hunks[0].Lines; len(lines) != 4 || lines[1] != " \n" {
+		t.Errorf("plain.txt hunk lines = %q", lines)
+	}
+}
+
+func TestParsePatchErrors(t *testing.T) {
+	for name, patch := range map[string]string{
+		"binary":    "diff --git a/x b/x\nGIT binary patch\nliteral 1\n",
+		"truncated": "--- a/x\n+++ b/x\n@@ -1,3 +1,3 @@\n a\n-b\n",
+		"too long":  "--- a/x\n+++ b/x\n@@ -1 +1 @@\n-a\n-b\n+c\n",
+		"header":    "--- a/x\n+++ b/x\n@@ -a +1 @@\n-a\n",
+	} {
+		if _, err := ParsePatch([]byte(patch)); err == nil {
+			t.Errorf("%s: parsed without error", name)
+		}
+	}
+}
+
+func TestPatchFilesApply(t *testing.T) {
+	patch, err := ParsePatch([]byte(`diff --git a/new.sh b/new.sh
+new file mode 100755
+--- /dev/null
++++ b/new.sh
+@@ -0,0 +1 @@
++echo hi
+diff --git a/gone.txt b/gone.txt
+deleted file mode 100644
+--- a/gone.txt
++++ /dev/null
+@@ -1 +0,0 @@
+-bye
+diff --git a/run.sh b/run.sh
+old mode 100644
+new mode 100755
+diff --git a/missing.txt b/missing.txt
+--- a/missing.txt
++++ b/missing.txt
+@@ -1 +1 @@
+-a
++b
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := patchFiles{
+		"gone.txt":    {content: []byte("bye\n"), mode: 0644},
+		"run.sh":      {content: []byte("echo run\n"), mode: 0644},
+		"missing.txt": nil,
+	}
+	changed, failures := files.apply(patch)
+	if fmt.Sprint(changed) != "[new.sh gone.txt run.sh]" {
+		t.Errorf("changed = %v", changed)
+	}
+	if len(failures) != 1 || failures[0].Path != "missing.txt" || failures[0].Hunk != 0 {
+		t.Errorf("failures = %v, want missing.txt not found", failures)
+	}
+	if f := files["new.sh"]; f == nil || string(f.content) != "echo hi\n" || f.mode != 0755 {
+		t.Errorf("new.sh = %+v", f)
+	}
+	if f := files["gone.txt"]; f != nil {
+		t.Errorf("gone.txt = %+v, want deleted", f)
+	}
+	if f := files["run.sh"]; string(f.content) != "echo run\n" || f.mode != 0755 {
+		t.Errorf("run.sh = %+v, want the mode changed", f)
+	}
+
+	// Applying the queue again to its own output is harmless for created
+	// and deleted files.
+	if _, failures := files.apply(patch); len(failures) != 1 {
+		t.Errorf("second apply failures = %v, want only missing.txt", failures)
+	}
+
+	files["new.sh"] = &patchFile{content: []byte("other\n"), mode: 0644}
+	if _, failures := files.apply(patch); len(failures) != 2 || failures[0].Reason != "file already exists" {
+		t.Errorf("failures = %v, want new.sh to exist already", failures)
+	}
+}
+
+// roundTrip diffs old into new with writeFileDiff and applies the result
+// to old.
+func roundTrip(t *testing.T, oldFile, newFile *patchFile) {
+	t.Helper()
+	var diff bytes.Buffer
+	writeFileDiff(&diff, "dir/f.txt", oldFile, newFile)
+	patch, err := ParsePatch(diff.Bytes())
+	if err != nil {
+		t.Fatalf("ParsePatch: %v\n%s", err, diff.String())
+	}
+	if len(patch.Files) != 1 {
+		t.Fatalf("parsed %d files, want 1:\n%s", len(patch.Files), diff.String())
+	}
+	fp := patch.Files[0]
+	if (oldFile == nil) != (fp.OldPath == "") || (newFile == nil) != (fp.NewPath == "") {
+		t.Fatalf("paths %q -> %q:\n%s", fp.OldPath, fp.NewPath, diff.String())
+	}
+
+	var content []byte
+	if oldFile != nil {
+		content = oldFile.content
+	}
+	got, failures := fp.Apply(content)
+	if len(failures) > 0 {
+		t.Fatalf("Apply failed: %v\n%s", failures, diff.String())
+	}
+	if newFile != nil && !bytes.Equal(got, newFile.content) {
+		t.Fatalf("Apply = %q, want %q\n%s", got, newFile.content, diff.String())
+	}
+	if newFile == nil && len(got) != 0 {
+		t.Fatalf("Apply = %q for a deleted file\n%s", got, diff.String())
+	}
+	if newFile != nil && gitFileMode(newFile.mode) == ModeExecutable && fp.NewMode != ModeExecutable {
+		t.Fatalf("NewMode = %q, want %s\n%s", fp.NewMode, ModeExecutable, diff.String())
+	}
+}
+
+func TestWriteFileDiffRoundTrip(t *testing.T) {
+	file := func(content string) *patchFile {
+		return &patchFile{content: []byte(content), mode: 0644}
+	}
+	cases := []struct {
+		name     string
+		old, new *patchFile
+	}{
+		{"change", file(numbered(1, 30)), file(strings.Replace(numbered(1, 30), "l15\n", "X\n", 1))},
+		{"changes in separate hunks", file(numbered(1, 30)), file(strings.NewReplacer("l2\n", "", "l28\n", "X\nY\n").Replace(numbered(1, 30)))},
+		{"changes sharing context", file(numbered(1, 30)), file(strings.NewReplacer("l10\n", "X\n", "l16\n", "Y\n").Replace(numbered(1, 30)))},
+		{"add newline", file("a\nb"), file("a\nb\n")},
+		{"remove newline", file("a\nb\n"), file("a\nb")},
+		{"change without newline", file("a\nb"), file("a\nc")},
+		{"empty to content", file(""), file("a\n")},
+		{"content to empty", file("a\n"), file("")},
+		{"new file", nil, file("a\nb\n")},
+		{"new file without newline", nil, file("a")},
+		{"deleted file", file("a\nb\n"), nil},
+		{"mode change", file("a\n"), &patchFile{content: []byte("b\n"), mode: 0755}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			roundTrip(t, c.old, c.new)
+		})
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	randomContent := func() string {
+		var b strings.Builder
+		for i := rng.Intn(40); i > 0; i-- {
+			fmt.Fprintf(&b, "%c\n", 'a'+rng.Intn(5))
+		}
+		if rng.Intn(4) == 0 {
+			b.WriteString("last")
+		}
+		return b.String()
+	}
+	for n := 0; n < 300; n++ {
+		roundTrip(t, file(randomContent()), file(randomContent()))
+	}
+}
+
+func TestWriteFileDiffModeOnly(t *testing.T) {
+	var diff bytes.Buffer
+	insertions, deletions := writeFileDiff(&diff, "run.sh", &patchFile{content: []byte("a\n"), mode: 0644}, &patchFile{content: []byte("a\n"), mode: 0755})
+	want := "diff --git a/run.sh b/run.sh\nold mode 100644\nnew mode 100755\n"
+	if diff.String() != want || insertions != 0 || deletions != 0 {
+		t.Errorf("writeFileDiff = %q, %d, %d, want %q", diff.String(), insertions, deletions, want)
+	}
+}
+
+func TestRefreshPatches(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		"a.txt": numbered(1, 20),
+		"b.txt": "b\n",
+	})
+	rootDir := t.TempDir()
+	patchDir := filepath.Join(rootDir, "patches")
+	opts := f.options(rootDir)
+	opts.PatchDir = patchDir
+	if err := os.MkdirAll(patchDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.fetch(t, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing changed yet.
+	gf, err := NewGithubFetcher(f.options(rootDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if patchPath, err := gf.RefreshPatches(context.Background()); err != nil || patchPath != "" {
+		t.Fatalf("RefreshPatches = %q, %v, want nothing to do", patchPath, err)
+	}
+
+	localA := strings.Replace(numbered(1, 20), "l3\n", "local\n", 1)
+	writeTestFile(t, rootDir, "a.txt", localA)
+	if err := os.Remove(filepath.Join(rootDir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	patchPath, err := gf.RefreshPatches(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(patchDir, defaultPatchName); patchPath != want {
+		t.Fatalf("RefreshPatches wrote %s, want %s", patchPath, want)
+	}
+	data, err := os.ReadFile(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"-l3\n+local\n", "deleted file mode 100644\n--- a/b.txt\n+++ /dev/null\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("patch does not contain %q:\n%s", want, data)
+		}
+	}
+	state, err := LoadState(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Patches != "patches" || state.Files["a.txt"].Patched != GitBlobSHA([]byte(localA)) {
+		t.Errorf("state = %+v, want the patch directory and the patched a.txt recorded", state)
+	}
+
+	// Upstream moves on; the next fetch reapplies the queue on top of it
+	// without taking the patched files for local changes.
+	f.setFiles(map[string]string{
+		"a.txt": strings.Replace(numbered(1, 20), "l18\n", "upstream\n", 1),
+		"b.txt": "b2\n",
+	})
+	result, err := f.fetch(t, f.options(rootDir))
+	var patchErr *PatchError
+	if !errors.As(err, &patchErr) || len(patchErr.Patches) != 1 {
+		t.Fatalf("Fetch = %v, want the deletion of the changed b.txt to fail", err)
+	}
+	if failed := patchErr.Patches[0].Failed; len(failed) != 1 || failed[0].Path != "b.txt" {
+		t.Errorf("failed hunks = %v, want b.txt", failed)
+	}
+	if len(result.Patches) != 1 || result.Patches[0].Name != defaultPatchName {
+		t.Errorf("result patches = %+v", result.Patches)
+	}
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt": strings.NewReplacer("l3\n", "local\n", "l18\n", "upstream\n").Replace(numbered(1, 20)),
+		"b.txt": "b2\n",
+	})
+
+	// Refreshing keeps the header of the last patch and drops the change
+	// that no longer applies.
+	header := "Subject: keep local edits\n\n"
+	if err := os.WriteFile(patchPath, append([]byte(header), data...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gf.RefreshPatches(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	data, err = os.ReadFile(patchPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(data), header+"diff --git a/a.txt b/a.txt\n") || strings.Contains(string(data), "b.txt") {
+		t.Errorf("refreshed patch:\n%s", data)
+	}
+}
@@ -0,0 +1,344 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defaultPatchName is the patch RefreshPatches creates in an empty queue.
+const defaultPatchName = "0001-local-changes.patch"
+
+// PatchResult reports how one patch of the queue applied.
+type PatchResult struct {
+	Name   string      // File name in the patch directory
+	Files  []string    // Repository paths the patch changed
+	Failed []HunkError // Files with failed hunks are left as they were before the patch
+}
+
+// PatchError is returned by Fetch when patches from PatchDir did not apply
+// cleanly. The files were fetched.
+type PatchError struct {
+	Patches []PatchResult // The patches that failed
+}
+
+func (e *PatchError) Error() string {
+	if len(e.Patches) == 1 {
+		return fmt.Sprintf("patch %s did not apply cleanly", e.Patches[0].Name)
+	}
+	return fmt.Sprintf("%d patches did not apply cleanly", len(e.Patches))
+}
+
+// readPatchQueue parses the .patch and .diff files in dir, in name order.
+func readPatchQueue(dir string) ([]string, []*Patch, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading patch directory: %w", err)
+	}
+
+	var names []string
+	var patches []*Patch
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if dirEntry.IsDir() || (!strings.HasSuffix(name, ".patch") && !strings.HasSuffix(name, ".diff")) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, nil, fmt.Errorf("error reading patch %s: %w", name, err)
+		}
+		patch, err := ParsePatch(data)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", name, err)
+		}
+		names = append(names, name)
+		patches = append(patches, patch)
+	}
+	return names, patches, nil
+}
+
+// patchFile is a file the patch queue works on; nil stands for a file
+// that does not exist.
+type patchFile struct {
+	content   []byte
+	mode      os.FileMode
+	irregular bool // Symlinks and directories cannot be patched
+}
+
+type patchFiles map[string]*patchFile
+
+// apply applies patch to files. A file whose hunks do not all apply is
+// left as it was.
+func (files patchFiles) apply(patch *Patch) ([]string, []HunkError) {
+	var changed []string
+	var failures []HunkError
+	for _, fp := range patch.Files {
+		var old *patchFile
+		if fp.OldPath != "" {
+			old = files[fp.OldPath]
+			if old == nil && fp.NewPath == "" {
+				continue // Already deleted
+			}
+			if old == nil {
+				failures = append(failures, HunkError{Path: fp.OldPath, Reason: "file not found"})
+				continue
+			}
+		}
+		if old != nil && old.irregular {
+			failures = append(failures, HunkError{Path: fp.OldPath, Reason: "not a regular file"})
+			continue
+		}
+
+		var content []byte
+		mode := os.FileMode(0644)
+		if old != nil {
+			content, mode = old.content, old.mode
+		}
+		newContent, hunkErrors := fp.Apply(content)
+		if len(hunkErrors) > 0 {
+			failures = append(failures, hunkErrors...)
+			continue
+		}
+		if fp.NewMode != "" {
+			mode = TreeEntry{Mode: fp.NewMode}.FileMode()
+		}
+
+		if fp.OldPath == "" {
+			// Applying a patch again must not fail on the files it created.
+			if existing := files[fp.NewPath]; existing != nil && !bytes.Equal(existing.content, newContent) {
+				failures = append(failures, HunkError{Path: fp.NewPath, Reason: "file already exists"})
+				continue
+			}
+		}
+		if fp.OldPath != "" && fp.OldPath != fp.NewPath {
+			files[fp.OldPath] = nil
+			changed = append(changed, fp.OldPath)
+		}
+		if fp.NewPath != "" {
+			files[fp.NewPath] = &patchFile{content: newContent, mode: mode}
+			changed = append(changed, fp.NewPath)
+		}
+	}
+	return changed, failures
+}
+
+// touchedPaths returns the paths the patches read or write.
+func touchedPaths(patches []*Patch) []string {
+	seen := map[string]bool{}
+	var paths []string
+	for _, patch := range patches {
+		for _, fp := range patch.Files {
+			for _, p := range []string{fp.OldPath, fp.NewPath} {
+				if p != "" && !seen[p] {
+					seen[p] = true
+					paths = append(paths, p)
+				}
+			}
+		}
+	}
+	return paths
+}
+
+// readLocalFile loads a file from RootDir for the patch queue.
+func (gf *GithubFetcher) readLocalFile(repoPath string) (*patchFile, error) {
+	fullPath := filepath.Join(gf.RootDir, repoPath)
+	info, err := os.Lstat(fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", fullPath, err)
+	}
+	if !info.Mode().IsRegular() {
+		return &patchFile{irregular: true}, nil
+	}
+	content, err := os.ReadFile(fullPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", fullPath, err)
+	}
+	return &patchFile{content: content, mode: info.Mode().Perm()}, nil
+}
+
+// applyPatches applies the queue in patchDir to the files in RootDir and
+// remembers the blob SHA of every patched file for the state file.
+func (gf *GithubFetcher) applyPatches() ([]PatchResult, error) {
+	names, patches, err := readPatchQueue(gf.patchDir)
+	if err != nil {
+		return nil, err
+	}
+
+	original := map[string]*patchFile{}
+	files := patchFiles{}
+	for _, p := range touchedPaths(patches) {
+		file, err := gf.readLocalFile(p)
+		if err != nil {
+			return nil, err
+		}
+		original[p] = file
+		files[p] = file
+	}
+
+	results := make([]PatchResult, len(patches))
+	for i, patch := range patches {
+		results[i].Name = names[i]
+		results[i].Files, results[i].Failed = files.apply(patch)
+	}
+
+	for p, file := range files {
+		before := original[p]
+		switch {
+		case file == before:
+			continue
+		case file == nil:
+			if err := os.Remove(filepath.Join(gf.RootDir, p)); err != nil {
+				return results, fmt.Errorf("error deleting %s: %w", p, err)
+			}
+		case before == nil || !bytes.Equal(file.content, before.content) || file.mode != before.mode:
+			if err := gf.SaveFileContent(p, string(file.content), file.mode); err != nil {
+				return results, err
+			}
+		}
+		if file != nil {
+			gf.patched[p] = GitBlobSHA(file.content)
+		}
+	}
+	return results, nil
+}
+
+// RefreshPatches regenerates the last patch in the patch directory, or
+// creates one if there is none, so that the queue turns the upstream files
+// recorded in the state file into the current files in RootDir. Earlier
+// patches are kept as they are. It returns the path of the patch written,
+// or "" if there is nothing to write.
+func (gf *GithubFetcher) RefreshPatches(ctx context.Context) (string, error) {
+	state, err := LoadState(gf.RootDir)
+	if err != nil {
+		return "", err
+	}
+	if state == nil {
+		return "", fmt.Errorf("no %s in %s", StateFileName, gf.RootDir)
+	}
+	dir := gf.PatchDir
+	if dir == "" {
+		dir = state.patchDir(gf.RootDir)
+	}
+	if dir == "" {
+		return "", fmt.Errorf("no patch directory given or recorded in %s", StateFileName)
+	}
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return "", fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	names, patches, err := readPatchQueue(dir)
+	if err != nil {
+		return "", err
+	}
+
+	// The files to diff are those the queue touches and those changed since
+	// they were fetched.
+	paths := touchedPaths(patches)
+	for p, recorded := range state.Files {
+		if localSha, exists := localBlobSHA(filepath.Join(gf.RootDir, p)); !exists || localSha != recorded.Sha {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	before := patchFiles{}
+	local := patchFiles{}
+	for i, p := range paths {
+		if i > 0 && paths[i-1] == p {
+			continue
+		}
+		localFile, err := gf.readLocalFile(p)
+		if err != nil {
+			return "", err
+		}
+		local[p] = localFile
+
+		recorded, ok := state.Files[p]
+		if !ok {
+			before[p] = nil
+			continue
+		}
+		upstream := &patchFile{mode: TreeEntry{Mode: recorded.Mode}.FileMode(), irregular: recorded.Mode == ModeSymlink}
+		if localFile != nil && !localFile.irregular && GitBlobSHA(localFile.content) == recorded.Sha {
+			upstream.content = localFile.content
+		} else if !upstream.irregular {
+			content, err := gf.GetBlob(ctx, recorded.Sha)
+			if err != nil {
+				return "", err
+			}
+			upstream.content = []byte(content)
+		}
+		before[p] = upstream
+	}
+
+	name, header := defaultPatchName, ""
+	if len(patches) > 0 {
+		name, header = names[len(names)-1], patches[len(patches)-1].Header
+		for i, patch := range patches[:len(patches)-1] {
+			if _, failed := before.apply(patch); len(failed) > 0 {
+				return "", fmt.Errorf("patch %s does not apply to the recorded upstream files: %w", names[i], failed[0])
+			}
+		}
+	}
+
+	var diff bytes.Buffer
+	for _, p := range sortedKeys(local) {
+		oldFile, newFile := before[p], local[p]
+		if (oldFile != nil && oldFile.irregular) || (newFile != nil && newFile.irregular) {
+			continue
+		}
+		switch {
+		case oldFile == nil && newFile == nil:
+		case (oldFile != nil && isBinary(oldFile.content)) || (newFile != nil && isBinary(newFile.content)):
+			if oldFile == nil || newFile == nil || !bytes.Equal(oldFile.content, newFile.content) {
+				return "", fmt.Errorf("error refreshing patches: %s is a binary file", p)
+			}
+		case oldFile == nil, newFile == nil, !bytes.Equal(oldFile.content, newFile.content), gitFileMode(oldFile.mode) != gitFileMode(newFile.mode):
+			writeFileDiff(&diff, p, oldFile, newFile)
+		}
+	}
+	if diff.Len() == 0 && len(patches) == 0 {
+		return "", nil
+	}
+
+	patchPath := filepath.Join(dir, name)
+	if err := os.WriteFile(patchPath, append([]byte(header), diff.Bytes()...), 0644); err != nil {
+		return "", fmt.Errorf("error writing patch %s: %w", patchPath, err)
+	}
+
+	// The local files are now what the queue produces, so that the next
+	// run does not take them for local changes.
+	for p, localFile := range local {
+		recorded, ok := state.Files[p]
+		if !ok || localFile == nil || localFile.irregular {
+			continue
+		}
+		recorded.Patched = ""
+		if sha := GitBlobSHA(localFile.content); sha != recorded.Sha {
+			recorded.Patched = sha
+		}
+		state.Files[p] = recorded
+	}
+	gf.patchDir = dir
+	state.Patches = gf.relativePatchDir()
+	if err := state.Save(gf.RootDir); err != nil {
+		return "", err
+	}
+	return patchPath, nil
+}
+
+func sortedKeys(files patchFiles) []string {
+	keys := make([]string, 0, len(files))
+	for key := range files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
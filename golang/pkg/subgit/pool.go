@@ -0,0 +1,255 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DefaultJobs    = 8
+	DefaultMaxJobs = 32
+
+	maxAttempts   = 3
+	maxRetryAfter = time.Minute // Longer waits are reported instead of slept
+)
+
+// errNotAttempted is returned for entries dequeued after cancellation, or
+// whose only attempt was cut short by it.
+var errNotAttempted = errors.New("download not attempted")
+
+// concurrencyLimiter bounds how many downloads run at once. In adaptive mode
+// the limit follows AIMD: it grows by one for every window of requests whose
+// latency stays stable, and is halved on throttling or timeouts.
+type concurrencyLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	active   int
+	limit    int
+	max      int
+	adaptive bool
+
+	successes    int
+	latency      time.Duration // Moving average of request latency
+	lastDecrease time.Time
+}
+
+func newConcurrencyLimiter(limit, max int, adaptive bool) *concurrencyLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	if !adaptive || max < limit {
+		max = limit
+	}
+	l := &concurrencyLimiter{limit: limit, max: max, adaptive: adaptive}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// Acquire blocks until a slot is free or ctx is done.
+func (l *concurrencyLimiter) Acquire(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.mu.Lock()
+		l.cond.Broadcast()
+		l.mu.Unlock()
+	})
+	defer stop()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.active >= l.limit {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		l.cond.Wait()
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	l.active++
+	return nil
+}
+
+// Release frees a slot and, in adaptive mode, feeds the outcome of the
+// request back into the limit.
+func (l *concurrencyLimiter) Release(latency time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	defer l.cond.Broadcast()
+
+	if !l.adaptive {
+		return
+	}
+
+	if isThrottled(err) {
+		// Requests in flight when throttling starts fail together; only
+		// back off once per round trip.
+		if time.Since(l.lastDecrease) > l.latency {
+			l.limit = max(1, l.limit/2)
+			l.lastDecrease = time.Now()
+		}
+		l.successes = 0
+		return
+	}
+	if err != nil {
+		return
+	}
+
+	stable := l.latency == 0 || latency < 2*l.latency
+	if l.latency == 0 {
+		l.latency = latency
+	} else {
+		l.latency = (4*l.latency + latency) / 5
+	}
+	if !stable {
+		l.successes = 0
+		return
+	}
+
+	l.successes++
+	if l.successes >= l.limit && l.limit < l.max {
+		l.limit++
+		l.successes = 0
+	}
+}
+
+// isThrottled reports whether err means the server or the network is
+// asking us to slow down.
+func isThrottled(err error) bool {
+	if err == nil {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.RateLimited
+	}
+	var timeoutErr *TimeoutError
+	if errors.As(err, &timeoutErr) {
+		return timeoutErr.Phase != PhaseDeadline
+	}
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// isRetryable reports whether a failed download is worth another attempt.
+func isRetryable(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.StatusCode >= http.StatusInternalServerError {
+		return true
+	}
+	return isThrottled(err)
+}
+
+// retryDelay returns how long to wait before the given retry attempt,
+// honoring Retry-After when the server sent one.
+func retryDelay(err error, attempt int) time.Duration {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && httpErr.RetryAfter > 0 {
+		return httpErr.RetryAfter
+	}
+	return time.Second << (attempt - 1)
+}
+
+// downloadAll runs ProcessFile for every entry on a fixed pool of workers
+// fed through a bounded queue. It returns the number of entries that were
+// never attempted because the run was cancelled.
+func (gf *GithubFetcher) downloadAll(ctx context.Context, cancel context.CancelFunc, entries []TreeEntry) int {
+	workers := gf.Jobs
+	if gf.Adaptive {
+		workers = max(gf.Jobs, gf.MaxJobs)
+	}
+	workers = max(1, min(workers, len(entries)))
+	limiter := newConcurrencyLimiter(gf.Jobs, gf.MaxJobs, gf.Adaptive)
+
+	queue := make(chan TreeEntry, 2*workers)
+	go func() {
+		defer close(queue)
+		for _, entry := range entries {
+			select {
+			case queue <- entry:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var attempted atomic.Int64
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range queue {
+				err := gf.processWithRetry(ctx, limiter, entry)
+				if errors.Is(err, errNotAttempted) {
+					continue
+				}
+				attempted.Add(1)
+				if err != nil && gf.FailFast {
+					cancel()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return len(entries) - int(attempted.Load())
+}
+
+// processWithRetry downloads entry, retrying transient failures, and
+// records the outcome.
+func (gf *GithubFetcher) processWithRetry(ctx context.Context, limiter *concurrencyLimiter, entry TreeEntry) (err error) {
+	attempts := 0
+	var elapsed time.Duration
+	defer func() {
+		if err != nil && !errors.Is(err, errNotAttempted) {
+			gf.recordFailureEvent(Event{Path: entry.Path, Sha: entry.Sha, Size: entry.Size, Attempt: attempts, Duration: elapsed, Err: err})
+		}
+	}()
+
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if attempt > 1 {
+			delay := retryDelay(err, attempt-1)
+			if delay > maxRetryAfter {
+				return err
+			}
+			gf.emit(Event{Type: EventRetryWait, Path: entry.Path, Attempt: attempt, Delay: delay, RateLimited: isThrottled(err), Err: err})
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return err
+			}
+		}
+
+		if acquireErr := limiter.Acquire(ctx); acquireErr != nil {
+			if err == nil {
+				return errNotAttempted
+			}
+			return err
+		}
+		attempts = attempt
+		gf.emit(Event{Type: EventFileStart, Path: entry.Path, Sha: entry.Sha, Size: entry.Size, Attempt: attempt})
+		start := time.Now()
+		var file FileResult
+		file, err = gf.ProcessFile(ctx, entry)
+		elapsed = time.Since(start)
+		limiter.Release(elapsed, err)
+
+		if ctx.Err() != nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+			return errNotAttempted
+		}
+		if err == nil {
+			gf.recordFile(file, attempt, elapsed)
+			return nil
+		}
+		if !isRetryable(err) {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,209 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// throttledError gets a rate limit error from a real 429 response.
+func throttledError(t *testing.T) error {
+	t.Helper()
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, "slow down", http.StatusTooManyRequests)
+		return true
+	}
+	gf, err := NewGithubFetcher(f.options(t.TempDir()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = gf.getRaw(context.Background(), "main", "a.txt")
+	if !isThrottled(err) {
+		t.Fatalf("getRaw = %v, want a rate limit error", err)
+	}
+	return err
+}
+
+func TestConcurrencyLimiterIncreasesAdditively(t *testing.T) {
+	l := newConcurrencyLimiter(2, 4, true)
+	release := func(n int) {
+		for i := 0; i < n; i++ {
+			if err := l.Acquire(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			l.Release(10*time.Millisecond, nil)
+		}
+	}
+
+	// One more slot for every window of limit stable requests.
+	release(1)
+	if l.limit != 2 {
+		t.Fatalf("limit = %d after 1 success, want 2", l.limit)
+	}
+	release(1)
+	if l.limit != 3 {
+		t.Fatalf("limit = %d after 2 successes, want 3", l.limit)
+	}
+	release(3)
+	if l.limit != 4 {
+		t.Fatalf("limit = %d after 5 successes, want 4", l.limit)
+	}
+	release(10)
+	if l.limit != 4 {
+		t.Fatalf("limit = %d, want it capped at max 4", l.limit)
+	}
+}
+
+func TestConcurrencyLimiterIgnoresSlowRequests(t *testing.T) {
+	l := newConcurrencyLimiter(2, 4, true)
+	l.Acquire(context.Background())
+	l.Release(10*time.Millisecond, nil)
+	l.Acquire(context.Background())
+	l.Release(time.Second, nil) // More than twice the average
+	if l.limit != 2 || l.successes != 0 {
+		t.Fatalf("limit = %d, successes = %d after a slow request, want 2 and 0", l.limit, l.successes)
+	}
+}
+
+func TestConcurrencyLimiterHalvesOncePerRoundTrip(t *testing.T) {
+	throttled := throttledError(t)
+	l := newConcurrencyLimiter(8, 16, true)
+	l.Acquire(context.Background())
+	l.Release(50*time.Millisecond, nil)
+
+	l.Acquire(context.Background())
+	l.Release(50*time.Millisecond, throttled)
+	if l.limit != 4 {
+		t.Fatalf("limit = %d after a 429, want 4", l.limit)
+	}
+
+	// Requests that were in flight together fail together.
+	l.Acquire(context.Background())
+	l.Release(50*time.Millisecond, throttled)
+	if l.limit != 4 {
+		t.Fatalf("limit = %d after a second 429 in the same round trip, want 4", l.limit)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	l.Acquire(context.Background())
+	l.Release(50*time.Millisecond, throttled)
+	if l.limit != 2 {
+		t.Fatalf("limit = %d after a 429 in the next round trip, want 2", l.limit)
+	}
+}
+
+func TestConcurrencyLimiterFixedWithoutAdaptive(t *testing.T) {
+	throttled := throttledError(t)
+	l := newConcurrencyLimiter(4, 16, false)
+	for i := 0; i < 10; i++ {
+		l.Acquire(context.Background())
+		l.Release(time.Millisecond, nil)
+	}
+	l.Acquire(context.Background())
+	l.Release(time.Millisecond, throttled)
+	if l.limit != 4 {
+		t.Fatalf("limit = %d, want 4", l.limit)
+	}
+}
+
+func TestRetryAfterIsHonored(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	var once sync.Once
+	f.intercept = func(w http.ResponseWriter, r *http.Request) bool {
+		throttle := false
+		if strings.HasSuffix(r.URL.Path, "/a.txt") {
+			once.Do(func() { throttle = true })
+		}
+		if throttle {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "slow down", http.StatusTooManyRequests)
+		}
+		return throttle
+	}
+
+	var mu sync.Mutex
+	var waits []Event
+	opts := f.options(t.TempDir())
+	opts.Progress = func(event Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		if event.Type == EventRetryWait {
+			waits = append(waits, event)
+		}
+	}
+	result, err := f.fetch(t, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Files) != 1 {
+		t.Fatalf("fetched %d files, want 1", len(result.Files))
+	}
+	if len(waits) != 1 || waits[0].Delay != time.Second || !waits[0].RateLimited || waits[0].Attempt != 2 {
+		t.Fatalf("retry waits = %+v, want one rate limited wait of 1s before attempt 2", waits)
+	}
+}
+
+func TestMissingFileIsNotRetried(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	f.intercept = failFile("a.txt", "a\n")
+	_, err := f.fetch(t, f.options(t.TempDir()))
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || len(fetchErr.Failed) != 1 {
+		t.Fatalf("Fetch = %v, want one failed file", err)
+	}
+	if n := f.requests("/raw/o/r/" + f.commit + "/a.txt"); n != 1 {
+		t.Fatalf("a.txt was requested %d times, want 1", n)
+	}
+}
+
+func TestFailFastSkipsRemainingFiles(t *testing.T) {
+	files := map[string]string{"a.txt": "a\n"}
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("b%02d.txt", i)] = fmt.Sprintf("%d\n", i)
+	}
+
+	for _, failFast := range []bool{false, true} {
+		t.Run(fmt.Sprint("fail-fast=", failFast), func(t *testing.T) {
+			f := newFakeGitHub(t, files)
+			f.intercept = failFile("a.txt", "a\n")
+			opts := f.options(t.TempDir())
+			opts.Jobs = 1
+			opts.FailFast = failFast
+			result, err := f.fetch(t, opts)
+
+			var fetchErr *FetchError
+			if !errors.As(err, &fetchErr) || len(fetchErr.Failed) != 1 || fetchErr.Failed[0].Path != "a.txt" {
+				t.Fatalf("Fetch = %v, want a.txt to fail", err)
+			}
+			wantSkipped := 0
+			if failFast {
+				wantSkipped = 20
+			}
+			if fetchErr.Skipped != wantSkipped || result.Skipped != wantSkipped {
+				t.Fatalf("skipped %d (result %d), want %d", fetchErr.Skipped, result.Skipped, wantSkipped)
+			}
+			if got := fetchErr.Completed(); got != 20-wantSkipped || len(result.Files) != got {
+				t.Fatalf("completed %d, %d files in result, want %d", got, len(result.Files), 20-wantSkipped)
+			}
+		})
+	}
+}
+
+// failFile makes every way of downloading name fail with 404.
+func failFile(name, content string) func(http.ResponseWriter, *http.Request) bool {
+	sha := GitBlobSHA([]byte(content))
+	return func(w http.ResponseWriter, r *http.Request) bool {
+		if strings.HasSuffix(r.URL.Path, "/"+name) || strings.HasSuffix(r.URL.Path, "/"+sha) {
+			http.NotFound(w, r)
+			return true
+		}
+		return false
+	}
+}
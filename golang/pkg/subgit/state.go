@@ -0,0 +1,247 @@
+package subgit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// StateFileName is the file in RootDir recording what the last run wrote.
+const StateFileName = ".subgit-state.json"
+
+// Policies for files that were changed locally since subgit wrote them.
+const (
+	PolicyAbort     = "abort"     // Fail before writing anything
+	PolicySkip      = "skip"      // Keep the local file, do not update it
+	PolicyOverwrite = "overwrite" // Replace the local file
+	PolicyBackup    = "backup"    // Rename the local file to .orig, then replace it
+	PolicyMerge     = "merge"     // Merge local and upstream changes, failing on conflicts
+)
+
+// State records the blob each file in RootDir was written from, so that a
+// later run can tell local changes from upstream ones.
+type State struct {
+	Host      string               `json:"host"`
+	Repo      string               `json:"repo"`
+	Local     string               `json:"local,omitempty"` // Local repository, instead of Host and Repo
+	Branch    string               `json:"branch"`
+	Commit    string               `json:"commit"` // The commit the files were fetched from
+	Subfolder string               `json:"subfolder"`
+	Tree      string               `json:"tree"`
+	Patches   string               `json:"patches,omitempty"` // Patch directory, relative to the root directory
+	Hooks     []string             `json:"hooks,omitempty"`   // Commands run after a fetch that changed files
+	Files     map[string]StateFile `json:"files"`             // Keyed by repository path
+}
+
+type StateFile struct {
+	Sha     string `json:"sha"`
+	Mode    string `json:"mode"`
+	Patched string `json:"patched,omitempty"` // Blob SHA after the patch queue was applied
+}
+
+// LoadState reads the state file in rootDir. It returns nil without error
+// if there is none.
+func LoadState(rootDir string) (*State, error) {
+	statePath := filepath.Join(rootDir, StateFileName)
+	data, err := os.ReadFile(statePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", statePath, err)
+	}
+
+	var state State
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", statePath, err)
+	}
+	return &state, nil
+}
+
+// Save writes the state file to rootDir.
+func (s *State) Save(rootDir string) error {
+	statePath := filepath.Join(rootDir, StateFileName)
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", statePath, err)
+	}
+
+	return writeFileAtomic(statePath, append(data, '\n'), 0644)
+}
+
+// URL returns the GitHub URL of the subfolder the state was written for,
+// or the file:// URL of a local repository.
+func (s *State) URL() string {
+	if s.Local != "" {
+		return LocalURL(s.Local, s.Branch, s.Subfolder)
+	}
+	u := fmt.Sprintf("https://%s/%s/tree/%s", s.Host, s.Repo, s.Branch)
+	if s.Subfolder != "" {
+		u += "/" + s.Subfolder
+	}
+	return u
+}
+
+// patchDir returns the recorded patch directory, or "" if there is none.
+func (s *State) patchDir(rootDir string) string {
+	if s.Patches == "" || filepath.IsAbs(s.Patches) {
+		return s.Patches
+	}
+	return filepath.Join(rootDir, filepath.FromSlash(s.Patches))
+}
+
+// sameSource reports whether s was written for the same subfolder.
+func (s *State) sameSource(gf *GithubFetcher) bool {
+	return s != nil && s.Host == gf.Host && s.Repo == gf.RepoName && s.Local == gf.LocalRepo && s.Subfolder == gf.Subfolder
+}
+
+// relativePatchDir returns the patch directory as recorded in the state
+// file, relative to RootDir if possible.
+func (gf *GithubFetcher) relativePatchDir() string {
+	if gf.patchDir == "" {
+		return ""
+	}
+	root, rootErr := filepath.Abs(gf.RootDir)
+	dir, dirErr := filepath.Abs(gf.patchDir)
+	if rel, err := filepath.Rel(root, dir); rootErr == nil && dirErr == nil && err == nil {
+		return filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(gf.patchDir)
+}
+
+// localBlobSHA returns the blob SHA of what is at fullPath now, and false if
+// there is nothing there.
+func localBlobSHA(fullPath string) (string, bool) {
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return "", false
+	}
+	switch {
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(fullPath)
+		if err != nil {
+			return "", true
+		}
+		return GitBlobSHA([]byte(filepath.ToSlash(target))), true
+	case info.Mode().IsRegular():
+		content, err := os.ReadFile(fullPath)
+		if err != nil {
+			return "", true
+		}
+		return GitBlobSHA(content), true
+	}
+	return "", true // A directory or device where a file should be
+}
+
+// findLocalChanges returns the entries whose local copy differs both from
+// the new blob and from the blob subgit last wrote. Files that were never
+// recorded count as changed, since they were not written by subgit.
+func (gf *GithubFetcher) findLocalChanges(entries []TreeEntry) []string {
+	changed := []string{}
+	for _, entry := range entries {
+		if entry.IsSymlink() && gf.CopySymlinks {
+			continue // The copy cannot be compared with the link
+		}
+		localSha, exists := localBlobSHA(filepath.Join(gf.RootDir, entry.Path))
+		if !exists || localSha == entry.Sha {
+			continue
+		}
+		if recorded, ok := gf.baseFiles[entry.Path]; ok && (recorded.Sha == localSha || recorded.Patched == localSha) {
+			continue
+		}
+		changed = append(changed, entry.Path)
+	}
+	return changed
+}
+
+// saveState records the files written by this run, keeping the previous
+// record of files that were not updated.
+func (gf *GithubFetcher) saveState(commit, tree string, entries []TreeEntry, files []FileResult) error {
+	state := &State{
+		Host:      gf.Host,
+		Repo:      gf.RepoName,
+		Local:     gf.LocalRepo,
+		Branch:    gf.Branch,
+		Commit:    commit,
+		Subfolder: gf.Subfolder,
+		Tree:      tree,
+		Files:     map[string]StateFile{},
+	}
+	state.Patches = gf.relativePatchDir()
+	state.Hooks = gf.hooks
+	for _, entry := range entries {
+		if recorded, ok := gf.baseFiles[entry.Path]; ok {
+			state.Files[entry.Path] = recorded
+		}
+	}
+	for _, file := range files {
+		if file.Local == PolicySkip {
+			continue // The local file is still based on the old blob
+		}
+		state.Files[file.Path] = StateFile{Sha: file.Sha, Mode: file.Mode, Patched: gf.patched[file.Path]}
+	}
+	return state.Save(gf.RootDir)
+}
+
+// backupFile moves the local copy of repoPath aside to repoPath.orig,
+// replacing an older backup.
+func (gf *GithubFetcher) backupFile(repoPath string) error {
+	fullPath := filepath.Join(gf.RootDir, repoPath)
+	if _, err := os.Lstat(fullPath); errors.Is(err, fs.ErrNotExist) {
+		return nil // Moved by an earlier attempt
+	}
+	if err := os.Rename(fullPath, fullPath+".orig"); err != nil {
+		return fmt.Errorf("error backing up %s: %w", fullPath, err)
+	}
+	return nil
+}
+
+// mergeFile merges the local changes to entry, relative to the blob the
+// last run wrote, with the upstream changes. The local file is left alone
+// unless the merge is clean or WriteConflicts is set.
+func (gf *GithubFetcher) mergeFile(ctx context.Context, entry TreeEntry, file FileResult) (FileResult, error) {
+	fullPath := filepath.Join(gf.RootDir, entry.Path)
+	recorded, ok := gf.baseFiles[entry.Path]
+	if !ok {
+		return file, fmt.Errorf("error merging %s: no recorded base version: %w", fullPath, ErrMergeConflict)
+	}
+	info, err := os.Lstat(fullPath)
+	if err != nil {
+		return file, fmt.Errorf("error merging %s: %w", fullPath, err)
+	}
+	if entry.IsSymlink() || recorded.Mode == ModeSymlink || !info.Mode().IsRegular() {
+		return file, fmt.Errorf("error merging %s: not a regular file: %w", fullPath, ErrMergeConflict)
+	}
+
+	local, err := os.ReadFile(fullPath)
+	if err != nil {
+		return file, fmt.Errorf("error merging %s: %w", fullPath, err)
+	}
+	base, err := gf.GetBlob(ctx, recorded.Sha)
+	if err != nil {
+		return file, err
+	}
+	upstream, err := gf.getFileContent(ctx, entry)
+	if err != nil {
+		return file, err
+	}
+	if isBinary(local) || isBinary([]byte(base)) || isBinary([]byte(upstream)) {
+		return file, fmt.Errorf("error merging %s: binary file: %w", fullPath, ErrMergeConflict)
+	}
+
+	merged, conflicts := Merge3([]byte(base), local, []byte(upstream))
+	if conflicts > 0 && !gf.WriteConflicts {
+		return file, fmt.Errorf("error merging %s: %d conflicting changes: %w", fullPath, conflicts, ErrMergeConflict)
+	}
+	if err := gf.SaveFileContent(entry.Path, string(merged), entry.FileMode()); err != nil {
+		return file, err
+	}
+
+	file.Size = int64(len(upstream))
+	file.Local = PolicyMerge
+	file.Conflicts = conflicts
+	return file, nil
+}
@@ -0,0 +1,224 @@
+package subgit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// localChangesSetup fetches a first version into a new root directory,
+// then edits a.txt, creates c.txt, which subgit never wrote, and moves
+// upstream to a version that changes every file.
+func localChangesSetup(t *testing.T) (*fakeGitHub, string, *State) {
+	t.Helper()
+	f := newFakeGitHub(t, map[string]string{
+		"a.txt": "1\n2\n3\n4\n",
+		"b.txt": "b1\n",
+	})
+	rootDir := t.TempDir()
+	if _, err := f.fetch(t, f.options(rootDir)); err != nil {
+		t.Fatal(err)
+	}
+	before, err := LoadState(rootDir)
+	if err != nil || before == nil {
+		t.Fatalf("LoadState = %v, %v", before, err)
+	}
+
+	writeTestFile(t, rootDir, "a.txt", "1\nlocal\n3\n4\n")
+	writeTestFile(t, rootDir, "c.txt", "c local\n")
+	f.setFiles(map[string]string{
+		"a.txt": "1\n2\n3\nupstream\n",
+		"b.txt": "b2\n",
+		"c.txt": "c2\n",
+	})
+	return f, rootDir, before
+}
+
+func writeTestFile(t *testing.T, rootDir, name, content string) {
+	t.Helper()
+	if err := os.WriteFile(filepath.Join(rootDir, name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func checkFiles(t *testing.T, rootDir string, want map[string]string) {
+	t.Helper()
+	for name, content := range want {
+		data, err := os.ReadFile(filepath.Join(rootDir, name))
+		if content == "" {
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s exists, want it missing", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("reading %s: %v", name, err)
+		} else if string(data) != content {
+			t.Errorf("%s = %q, want %q", name, data, content)
+		}
+	}
+}
+
+func TestLocalChangesAbort(t *testing.T) {
+	f, rootDir, before := localChangesSetup(t)
+	opts := f.options(rootDir)
+	opts.LocalChanges = PolicyAbort
+	_, err := f.fetch(t, opts)
+
+	var localErr *LocalChangesError
+	if !errors.As(err, &localErr) || !reflect.DeepEqual(localErr.Paths, []string{"a.txt", "c.txt"}) {
+		t.Fatalf("Fetch = %v, want local changes to a.txt and c.txt", err)
+	}
+	if code := ExitCode(err); code != ExitLocalChanges {
+		t.Errorf("ExitCode = %d, want %d", code, ExitLocalChanges)
+	}
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt": "1\nlocal\n3\n4\n",
+		"b.txt": "b1\n", // Not changed locally, but not written either
+		"c.txt": "c local\n",
+	})
+	after, err := LoadState(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("state changed to %+v, want %+v", after, before)
+	}
+}
+
+func TestLocalChangesSkip(t *testing.T) {
+	f, rootDir, before := localChangesSetup(t)
+	opts := f.options(rootDir)
+	opts.LocalChanges = PolicySkip
+	result, err := f.fetch(t, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt": "1\nlocal\n3\n4\n",
+		"b.txt": "b2\n",
+		"c.txt": "c local\n",
+	})
+	for _, file := range result.Files {
+		if want := map[string]string{"a.txt": PolicySkip, "c.txt": PolicySkip}[file.Path]; file.Local != want {
+			t.Errorf("%s: Local = %q, want %q", file.Path, file.Local, want)
+		}
+	}
+
+	// The skipped files are still based on what was there before, so the
+	// next run must see them as changed again.
+	state, err := LoadState(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Commit != f.commit {
+		t.Errorf("state commit = %s, want %s", state.Commit, f.commit)
+	}
+	if state.Files["a.txt"] != before.Files["a.txt"] {
+		t.Errorf("a.txt state = %+v, want the old %+v", state.Files["a.txt"], before.Files["a.txt"])
+	}
+	if state.Files["b.txt"].Sha != GitBlobSHA([]byte("b2\n")) {
+		t.Errorf("b.txt state = %+v, want the new blob", state.Files["b.txt"])
+	}
+	if recorded, ok := state.Files["c.txt"]; ok {
+		t.Errorf("c.txt state = %+v, want none", recorded)
+	}
+}
+
+func TestLocalChangesBackup(t *testing.T) {
+	f, rootDir, _ := localChangesSetup(t)
+	writeTestFile(t, rootDir, "a.txt.orig", "an older backup\n")
+	opts := f.options(rootDir)
+	opts.LocalChanges = PolicyBackup
+	result, err := f.fetch(t, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt":      "1\n2\n3\nupstream\n",
+		"a.txt.orig": "1\nlocal\n3\n4\n",
+		"b.txt":      "b2\n",
+		"b.txt.orig": "",
+		"c.txt":      "c2\n",
+		"c.txt.orig": "c local\n",
+	})
+	for _, file := range result.Files {
+		if want := map[string]string{"a.txt": PolicyBackup, "c.txt": PolicyBackup}[file.Path]; file.Local != want {
+			t.Errorf("%s: Local = %q, want %q", file.Path, file.Local, want)
+		}
+	}
+	state, err := LoadState(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Files["c.txt"].Sha != GitBlobSHA([]byte("c2\n")) {
+		t.Errorf("c.txt state = %+v, want the new blob", state.Files["c.txt"])
+	}
+}
+
+func TestLocalChangesOverwrite(t *testing.T) {
+	f, rootDir, _ := localChangesSetup(t)
+	opts := f.options(rootDir)
+	opts.LocalChanges = PolicyOverwrite
+	if _, err := f.fetch(t, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt":      "1\n2\n3\nupstream\n",
+		"a.txt.orig": "",
+		"b.txt":      "b2\n",
+		"c.txt":      "c2\n",
+		"c.txt.orig": "",
+	})
+}
+
+func TestLocalChangesMerge(t *testing.T) {
+	f, rootDir, _ := localChangesSetup(t)
+	opts := f.options(rootDir)
+	opts.LocalChanges = PolicyMerge
+	_, err := f.fetch(t, opts)
+
+	// c.txt has no recorded base to merge against.
+	var fetchErr *FetchError
+	if !errors.As(err, &fetchErr) || len(fetchErr.Failed) != 1 || fetchErr.Failed[0].Path != "c.txt" || !errors.Is(fetchErr.Failed[0].Err, ErrMergeConflict) {
+		t.Fatalf("Fetch = %v, want a merge conflict in c.txt", err)
+	}
+	checkFiles(t, rootDir, map[string]string{
+		"a.txt": "1\nlocal\n3\nupstream\n",
+		"b.txt": "b2\n",
+		"c.txt": "c local\n",
+	})
+}
+
+func TestFindLocalChanges(t *testing.T) {
+	rootDir := t.TempDir()
+	writeTestFile(t, rootDir, "new.txt", "new\n")
+	writeTestFile(t, rootDir, "recorded.txt", "old\n")
+	writeTestFile(t, rootDir, "patched.txt", "patched\n")
+	writeTestFile(t, rootDir, "edited.txt", "edited\n")
+	writeTestFile(t, rootDir, "untracked.txt", "mine\n")
+
+	gf, err := NewGithubFetcher(Options{RepoName: "o/r", RootDir: rootDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gf.baseFiles = map[string]StateFile{
+		"recorded.txt": {Sha: GitBlobSHA([]byte("old\n")), Mode: ModeFile},
+		"patched.txt":  {Sha: GitBlobSHA([]byte("old\n")), Mode: ModeFile, Patched: GitBlobSHA([]byte("patched\n"))},
+		"edited.txt":   {Sha: GitBlobSHA([]byte("old\n")), Mode: ModeFile},
+	}
+	entries := []TreeEntry{}
+	for _, name := range []string{"missing.txt", "new.txt", "recorded.txt", "patched.txt", "edited.txt", "untracked.txt"} {
+		entries = append(entries, TreeEntry{Path: name, Mode: ModeFile, Type: "blob", Sha: GitBlobSHA([]byte("new\n"))})
+	}
+
+	got := gf.findLocalChanges(entries)
+	if want := []string{"edited.txt", "untracked.txt"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("findLocalChanges = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+// Package subgit downloads a subdirectory of a GitHub repository without
+// cloning it.
+//
+// A minimal fetch:
+//
+//	fetcher, err := subgit.NewGithubFetcher(subgit.Options{
+//		RepoName:  "owner/repo",
+//		Branch:    "main",
+//		Subfolder: "path/to/dir",
+//		RootDir:   "out",
+//	})
+//	if err != nil {
+//		return err
+//	}
+//	result, err := fetcher.Fetch(ctx)
+//
+// Fetch returns a Result even when some files failed, together with a
+// *FetchError describing the failures.
+package subgit
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Options configures a GithubFetcher. Only RepoName or LocalRepo, Branch
+// and either RootDir or Archive are required.
+type Options struct {
+	Host      string // github.com or a GitHub Enterprise host, github.com if empty
+	APIBase   string // Overrides the REST API URL derived from Host
+	RepoName  string // owner/repo
+	LocalRepo string // Local repository or checkout read instead of Host and RepoName
+	Branch    string
+	Subfolder string    // Path inside the repository, empty for all of it
+	RootDir   string    // Local directory the files are written to
+	At        time.Time // Fetch the last commit on Branch at or before this time instead of its head
+
+	Credential    *Credential // Token for Host, nil for anonymous access
+	ClientOptions ClientOptions
+	HTTPClient    *http.Client // Used instead of a client built from ClientOptions if set
+
+	Deadline     time.Duration  // Overall limit for Fetch, zero for none
+	CopySymlinks bool           // Copy symlink targets instead of creating links
+	FailFast     bool           // Stop scheduling downloads after the first failure
+	Jobs         int            // Concurrent downloads, the starting point in adaptive mode
+	MaxJobs      int            // Upper bound on concurrent downloads in adaptive mode
+	Adaptive     bool           // Tune concurrency with AIMD based on latency and throttling
+	Archive      *ArchiveWriter // Collect files into an archive instead of writing to RootDir
+	LocalChanges string         // Policy for files changed since the last run, PolicyAbort if empty
+	Backend      string         // How file contents are downloaded, BackendRaw if empty
+
+	// WriteConflicts makes PolicyMerge write overlapping changes between
+	// conflict markers, as git does, instead of failing the file.
+	WriteConflicts bool
+
+	// Hooks are shell commands run by RunHooks, in RootDir. If nil, the
+	// hooks recorded in the state file by an earlier run are used.
+	Hooks      []string
+	HookOutput io.Writer // Receives the output of Hooks, discarded if nil
+
+	// PatchDir is a directory of unified diffs or git format-patch files,
+	// applied in name order after the files were fetched. If empty, the
+	// directory recorded in the state file by an earlier run is used.
+	PatchDir string
+
+	// Progress is called as the fetch advances. Calls never overlap, so it
+	// may update state without locking, but it should return quickly.
+	Progress func(Event)
+}
+
+// Event types reported to Options.Progress.
+const (
+	EventListStart  = "listing_started"
+	EventListDone   = "listing_finished" // Total and Size cover all files, Sha is the tree
+	EventFileStart  = "file_started"     // A download attempt begins
+	EventFileBytes  = "file_bytes"       // Size more bytes of the file were received
+	EventFileDone   = "file_completed"   // A file was fetched, or was already up to date
+	EventFileFailed = "file_failed"      // A file failed for good; Err says why
+	EventRetryWait  = "retry_wait"       // Waiting Delay before the next Attempt
+)
+
+// Event reports the progress of a fetch.
+type Event struct {
+	Type        string
+	Path        string        // Repository path of the file
+	Sha         string        // Git blob SHA of the file, or the tree SHA for EventListDone
+	Size        int64         // Size of the file, or of all files for EventListDone
+	Total       int           // Number of files, for EventListDone
+	Attempt     int           // Download attempt, counting from 1
+	Duration    time.Duration // Time the attempt took
+	Delay       time.Duration // Wait before the next attempt, for EventRetryWait
+	RateLimited bool          // The wait is due to throttling
+	UpToDate    bool          // The local copy already matched and was not downloaded
+	Local       string        // How a locally changed file was handled, see FileResult
+	Conflicts   int           // Conflicts written into the file, see Options.WriteConflicts
+	Err         error
+}
+
+// FileResult describes a file that was fetched.
+type FileResult struct {
+	Path      string // Repository path
+	Sha       string // Git blob SHA
+	Mode      string // Git file mode, see ModeFile, ModeExecutable and ModeSymlink
+	Size      int64
+	UpToDate  bool   // The local copy already matched and was not downloaded
+	Local     string // PolicySkip, PolicyBackup or PolicyMerge if the file was changed locally
+	Conflicts int    // Conflicts written into the file, see Options.WriteConflicts
+}
+
+// Result summarizes a fetch.
+type Result struct {
+	Commit  string        // SHA of the commit Branch was resolved to
+	Tree    string        // SHA of the tree the files were listed from
+	Files   []FileResult  // Files fetched or up to date, sorted by path
+	Bytes   int64         // Bytes downloaded
+	Failed  []FileError   // Files that failed, sorted by path
+	Skipped int           // Files not attempted after fail-fast, an interrupt or the deadline
+	Patches []PatchResult // Patches applied from the patch directory, in order
+	Changed []string      // Files whose content or mode changed on disk, sorted
+}
@@ -0,0 +1,251 @@
+package subgit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxSymlinkHops mirrors the kernel's ELOOP limit.
+const maxSymlinkHops = 40
+
+var (
+	errOutsideRoot    = errors.New("symlink points outside root_dir")
+	errOutsideArchive = errors.New("symlink points outside the archive")
+)
+
+// CreateSymlinks materializes the symlinks collected during the download,
+// either as real links or, with CopySymlinks, as copies of their targets.
+// Links that resolve outside the root directory are refused.
+func (gf *GithubFetcher) CreateSymlinks() {
+	links := make([]string, 0, len(gf.symlinks))
+	for linkPath := range gf.symlinks {
+		links = append(links, linkPath)
+	}
+	sort.Strings(links)
+
+	resolvedTargets := map[string]string{}
+	pending := []string{}
+	for _, linkPath := range links {
+		target := gf.symlinks[linkPath]
+		resolved, err := resolveSymlink(linkPath, gf.symlinks)
+		if gf.Archive != nil && (errors.Is(err, errOutsideRoot) || (err == nil && !gf.inSubfolder(resolved))) {
+			err = errOutsideArchive
+		}
+		if err != nil {
+			gf.recordFailure(linkPath, fmt.Errorf("error creating symlink to %s: %w", target, err))
+			continue
+		}
+
+		if !gf.CopySymlinks && gf.Archive != nil {
+			gf.Archive.AddSymlink(gf.ArchivePath(linkPath), target)
+			continue
+		}
+		if !gf.CopySymlinks {
+			if err := gf.SaveSymlink(linkPath, target); err != nil {
+				gf.recordFailure(linkPath, err)
+			}
+			continue
+		}
+		if resolved == "" || strings.HasPrefix(linkPath, resolved+"/") {
+			gf.recordFailure(linkPath, fmt.Errorf("error copying symlink to %s: link points to its own parent", target))
+			continue
+		}
+		pending = append(pending, linkPath)
+		resolvedTargets[linkPath] = resolved
+	}
+
+	// A copied directory must not contain links that are still pending, so
+	// keep making passes until every copy has been made or no progress is
+	// possible.
+	for len(pending) > 0 {
+		deferred := []string{}
+		for _, linkPath := range pending {
+			if containsPending(resolvedTargets[linkPath], linkPath, pending) {
+				deferred = append(deferred, linkPath)
+				continue
+			}
+			var err error
+			if gf.Archive != nil {
+				err = gf.Archive.CopyEntries(gf.ArchivePath(linkPath), gf.ArchivePath(resolvedTargets[linkPath]))
+			} else {
+				err = gf.CopySymlinkTarget(linkPath, resolvedTargets[linkPath])
+			}
+			if err != nil {
+				gf.recordFailure(linkPath, err)
+			}
+		}
+		if len(deferred) == len(pending) {
+			for _, linkPath := range deferred {
+				gf.recordFailure(linkPath, fmt.Errorf("error copying symlink: cyclic directory links"))
+			}
+			break
+		}
+		pending = deferred
+	}
+}
+
+// SaveSymlink creates a symlink at filepath_ pointing to target, replacing
+// whatever a previous run left there.
+func (gf *GithubFetcher) SaveSymlink(filepath_ string, target string) error {
+	fullPath := filepath.Join(gf.RootDir, filepath_)
+	dir := filepath.Dir(fullPath)
+
+	if err := os.MkdirAll(dir, os.ModeDir|0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", dir, err)
+	}
+	if err := os.Remove(fullPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error replacing %s: %w", fullPath, err)
+	}
+	if err := os.Symlink(filepath.FromSlash(target), fullPath); err != nil {
+		return fmt.Errorf("error creating symlink %s: %w (use -copy-symlinks on filesystems without symlink support)", fullPath, err)
+	}
+
+	return nil
+}
+
+// CopySymlinkTarget copies the file or directory at the repo path resolved
+// in place of the symlink at filepath_.
+func (gf *GithubFetcher) CopySymlinkTarget(filepath_ string, resolved string) error {
+	src := filepath.Join(gf.RootDir, filepath.FromSlash(resolved))
+	dst := filepath.Join(gf.RootDir, filepath_)
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return fmt.Errorf("error copying symlink %s: target %s was not fetched: %w", filepath_, resolved, err)
+	}
+	if err := removeSymlink(dst); err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(src, dst, info.Mode().Perm())
+	}
+
+	return filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			if err := os.MkdirAll(target, os.ModeDir|0755); err != nil {
+				return fmt.Errorf("error creating directory %s: %w", target, err)
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		return copyFile(p, target, info.Mode().Perm())
+	})
+}
+
+// resolveSymlink resolves the link at linkPath to a repository path,
+// following other links from the tree along the way. It fails if any step
+// of the resolution leaves the repository root, which is root_dir locally.
+func resolveSymlink(linkPath string, links map[string]string) (string, error) {
+	target := links[linkPath]
+	if path.IsAbs(target) || filepath.IsAbs(target) {
+		return "", errOutsideRoot
+	}
+	return resolvePath(path.Dir(linkPath)+"/"+target, links)
+}
+
+// resolvePath cleans the relative path p, replacing any component that is
+// one of links by its target.
+func resolvePath(p string, links map[string]string) (string, error) {
+	// Components are consumed one at a time so that ".." is applied after a
+	// link has been replaced by its target, as the kernel would.
+	parts := strings.Split(p, "/")
+	resolved := []string{}
+	hops := 0
+	for len(parts) > 0 {
+		part := parts[0]
+		parts = parts[1:]
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", errOutsideRoot
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		current := path.Join(path.Join(resolved...), part)
+		next, ok := links[current]
+		if !ok {
+			resolved = append(resolved, part)
+			continue
+		}
+
+		hops++
+		if hops > maxSymlinkHops {
+			return "", fmt.Errorf("too many levels of symlinks")
+		}
+		if path.IsAbs(next) || filepath.IsAbs(next) {
+			return "", errOutsideRoot
+		}
+		parts = append(strings.Split(next, "/"), parts...)
+	}
+
+	return path.Join(resolved...), nil
+}
+
+// containsPending reports whether the directory at resolved holds a link,
+// other than self, that has not been copied yet.
+func containsPending(resolved string, self string, pending []string) bool {
+	for _, linkPath := range pending {
+		if linkPath != self && strings.HasPrefix(linkPath, resolved+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// removeSymlink deletes fullPath if it is a symlink so that it is not
+// written through.
+func removeSymlink(fullPath string) error {
+	info, err := os.Lstat(fullPath)
+	if err != nil || info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	if err := os.Remove(fullPath); err != nil {
+		return fmt.Errorf("error removing symlink %s: %w", fullPath, err)
+	}
+	return nil
+}
+
+func copyFile(src string, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error opening %s: %w", src, err)
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModeDir|0755); err != nil {
+		return fmt.Errorf("error creating directory %s: %w", filepath.Dir(dst), err)
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return fmt.Errorf("error creating file %s: %w", dst, err)
+	}
+	defer out.Close()
+
+	if _, err := io.Copy(out, in); err != nil {
+		return fmt.Errorf("error copying %s to %s: %w", src, dst, err)
+	}
+	return out.Chmod(mode)
+}
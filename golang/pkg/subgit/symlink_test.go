@@ -0,0 +1,172 @@
+package subgit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// errLoop stands for the error of a cycle in TestResolveSymlink.
+var errLoop = errors.New("loop")
+
+func TestResolveSymlink(t *testing.T) {
+	tests := []struct {
+		name    string
+		links   map[string]string
+		link    string
+		want    string
+		wantErr error // errOutsideRoot, or errLoop for any other error
+	}{
+		{name: "sibling", links: map[string]string{"a/link": "file"}, link: "a/link", want: "a/file"},
+		{name: "parent", links: map[string]string{"a/b/link": "../file"}, link: "a/b/link", want: "a/file"},
+		{name: "dot components", links: map[string]string{"a/link": "./b/../c//file"}, link: "a/link", want: "a/c/file"},
+		{name: "up to the root", links: map[string]string{"a/link": ".."}, link: "a/link", want: ""},
+		{name: "escaping the root", links: map[string]string{"a/link": "../../file"}, link: "a/link", wantErr: errOutsideRoot},
+		{name: "escaping and coming back", links: map[string]string{"link": "../root/file"}, link: "link", wantErr: errOutsideRoot},
+		{name: "absolute", links: map[string]string{"link": "/etc/passwd"}, link: "link", wantErr: errOutsideRoot},
+		{
+			name:  "chained",
+			links: map[string]string{"first": "second", "second": "dir/third", "dir/third": "../file"},
+			link:  "first", want: "file",
+		},
+		{
+			name:  "chained out of the root",
+			links: map[string]string{"first": "dir/second", "dir/second": "../../file"},
+			link:  "first", wantErr: errOutsideRoot,
+		},
+		{
+			name:  "chained to an absolute target",
+			links: map[string]string{"first": "second", "second": "/tmp"},
+			link:  "first", wantErr: errOutsideRoot,
+		},
+		{
+			// The .. applies to the target of dirlink, not to dirlink itself.
+			name:  "through a linked directory",
+			links: map[string]string{"dirlink": "a/b", "link": "dirlink/../file"},
+			link:  "link", want: "a/file",
+		},
+		{
+			name:  "through a linked directory out of the root",
+			links: map[string]string{"a/up": "..", "a/link": "up/../../file"},
+			link:  "a/link", wantErr: errOutsideRoot,
+		},
+		{name: "to itself", links: map[string]string{"link": "link"}, link: "link", wantErr: errLoop},
+		{name: "cycle", links: map[string]string{"a": "b", "b": "c", "c": "a"}, link: "a", wantErr: errLoop},
+		{name: "directory cycle", links: map[string]string{"d/loop": "../d/loop/x"}, link: "d/loop", wantErr: errLoop},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveSymlink(tt.link, tt.links)
+			switch {
+			case tt.wantErr == nil:
+				if err != nil || got != tt.want {
+					t.Errorf("resolveSymlink = %q, %v, want %q", got, err, tt.want)
+				}
+			case tt.wantErr == errLoop:
+				if err == nil || errors.Is(err, errOutsideRoot) {
+					t.Errorf("resolveSymlink = %q, %v, want too many levels of symlinks", got, err)
+				}
+			case !errors.Is(err, tt.wantErr):
+				t.Errorf("resolveSymlink = %q, %v, want %v", got, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateSymlinks(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		"lib/a.txt":        "a\n",
+		"lib/dir/b.txt":    "b\n",
+		"lib/link":         "a.txt",
+		"lib/dir/up":       "../a.txt",
+		"lib/dirlink":      "dir",
+		"lib/escape":       "../../outside",
+		"lib/absolute":     "/etc/passwd",
+		"lib/loop":         "loop",
+		"lib/other":        "../other/c.txt",
+		"other/c.txt":      "c\n",
+		"lib/dir/selflink": "..",
+	})
+	for _, link := range []string{"lib/link", "lib/dir/up", "lib/dirlink", "lib/escape", "lib/absolute", "lib/loop", "lib/other", "lib/dir/selflink"} {
+		f.setMode(link, ModeSymlink)
+	}
+	failures := func(result *Result, err error) map[string]string {
+		t.Helper()
+		var fetchErr *FetchError
+		if !errors.As(err, &fetchErr) {
+			t.Fatalf("Fetch = %v, want a FetchError", err)
+		}
+		failed := map[string]string{}
+		for _, failure := range result.Failed {
+			failed[failure.Path] = failure.Err.Error()
+		}
+		return failed
+	}
+
+	t.Run("links", func(t *testing.T) {
+		rootDir := t.TempDir()
+		opts := f.options(rootDir)
+		opts.Subfolder = "lib"
+		failed := failures(f.fetch(t, opts))
+		for link, want := range map[string]string{
+			"lib/escape":   errOutsideRoot.Error(),
+			"lib/absolute": errOutsideRoot.Error(),
+			"lib/loop":     "too many levels of symlinks",
+		} {
+			if !strings.Contains(failed[link], want) {
+				t.Errorf("%s failed with %q, want %q", link, failed[link], want)
+			}
+			if _, err := os.Lstat(filepath.Join(rootDir, link)); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s was created", link)
+			}
+		}
+		if len(failed) != 3 {
+			t.Errorf("failed = %v, want only the links out of the root and the loop", failed)
+		}
+		for link, want := range map[string]string{
+			"lib/link":         "a.txt",
+			"lib/dir/up":       "../a.txt",
+			"lib/dirlink":      "dir",
+			"lib/other":        "../other/c.txt", // Dangling, but inside root_dir
+			"lib/dir/selflink": "..",
+		} {
+			if target, err := os.Readlink(filepath.Join(rootDir, link)); err != nil || target != filepath.FromSlash(want) {
+				t.Errorf("%s points to %q, %v, want %q", link, target, err, want)
+			}
+		}
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		rootDir := t.TempDir()
+		opts := f.options(rootDir)
+		opts.Subfolder = "lib"
+		opts.CopySymlinks = true
+		failed := failures(f.fetch(t, opts))
+		for link, want := range map[string]string{
+			"lib/escape":       errOutsideRoot.Error(),
+			"lib/absolute":     errOutsideRoot.Error(),
+			"lib/loop":         "too many levels of symlinks",
+			"lib/other":        "target other/c.txt was not fetched",
+			"lib/dir/selflink": "link points to its own parent",
+		} {
+			if !strings.Contains(failed[link], want) {
+				t.Errorf("%s failed with %q, want %q", link, failed[link], want)
+			}
+		}
+		if len(failed) != 5 {
+			t.Errorf("failed = %v, want 5 links", failed)
+		}
+		checkFiles(t, rootDir, map[string]string{
+			"lib/link":          "a\n",
+			"lib/dir/up":        "a\n",
+			"lib/dirlink/b.txt": "b\n",
+			"lib/other":         "",
+			"other/c.txt":       "",
+		})
+		if info, err := os.Lstat(filepath.Join(rootDir, "lib", "dirlink")); err != nil || !info.IsDir() {
+			t.Errorf("dirlink = %v, %v, want a copied directory", info, err)
+		}
+	})
+}
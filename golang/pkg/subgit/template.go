@@ -0,0 +1,299 @@
+package subgit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TemplateFileName is the configuration RenderTemplate reads from the root
+// of the template. It is not copied.
+const TemplateFileName = "subgit-template.yaml"
+
+// TemplateConfig is the content of subgit-template.yaml.
+type TemplateConfig struct {
+	Prompts []TemplatePrompt `yaml:"prompts"`
+	Exclude []string         `yaml:"exclude"` // Patterns of files copied without rendering
+}
+
+// TemplatePrompt declares a variable of the template.
+type TemplatePrompt struct {
+	Name    string  `yaml:"name"`
+	Message string  `yaml:"message"` // Question to ask, Name if empty
+	Default *string `yaml:"default"` // The variable is required if there is none
+}
+
+// TemplateOptions configures RenderTemplate.
+type TemplateOptions struct {
+	Values map[string]string // Variables given up front, e.g. from -set
+
+	// Prompt asks for a declared variable that is not in Values. If nil,
+	// defaults are used and variables without one are an error.
+	Prompt func(prompt TemplatePrompt) (string, error)
+}
+
+// TemplateResult is the outcome of RenderTemplate.
+type TemplateResult struct {
+	Commit   string            // The commit the template was read from
+	Values   map[string]string // The variables the files were rendered with
+	Files    []string          // Files written, relative to RootDir
+	Rendered int               // Files whose content was rendered rather than copied
+}
+
+// RenderTemplate fetches the subfolder as a project template into RootDir,
+// which must be empty or missing. File contents and file and directory
+// names are rendered as Go templates, so {{ .Name }} is replaced with the
+// variable Name. Binary files and those matching an exclude pattern of
+// subgit-template.yaml are copied as they are. A file or directory whose
+// name renders empty is left out.
+func (gf *GithubFetcher) RenderTemplate(ctx context.Context, opts TemplateOptions) (*TemplateResult, error) {
+	if dirEntries, err := os.ReadDir(gf.RootDir); err == nil && len(dirEntries) > 0 {
+		return nil, fmt.Errorf("error rendering template: %s is not empty", gf.RootDir)
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("error reading %s: %w", gf.RootDir, err)
+	}
+
+	fsys, err := gf.FS(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	config := &TemplateConfig{}
+	if entry, ok := fsys.files[TemplateFileName]; ok {
+		data, err := fsys.readBlob(entry)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("error parsing %s: %w", TemplateFileName, err)
+		}
+	}
+	values, err := templateValues(config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for name := range fsys.files {
+		if name != TemplateFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	// Render the names first, so that a mistake in one fails before
+	// anything is downloaded.
+	outNames := make([]string, len(names))
+	for i, name := range names {
+		if outNames[i], err = renderPath(name, values); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &TemplateResult{Commit: fsys.Commit(), Values: values}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	slots := make(chan struct{}, gf.Jobs)
+	for i, name := range names {
+		if outNames[i] == "" {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(name, outName string) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			rendered, err := gf.renderTemplateFile(fsys, name, outName, values, config.Exclude)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			result.Files = append(result.Files, outName)
+			if rendered {
+				result.Rendered++
+			}
+		}(name, outNames[i])
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return result, firstErr
+	}
+
+	sort.Strings(result.Files)
+	return result, nil
+}
+
+// renderTemplateFile writes the file name of the template to outName,
+// reporting whether its content was rendered.
+func (gf *GithubFetcher) renderTemplateFile(fsys *FS, name, outName string, values map[string]string, exclude []string) (bool, error) {
+	entry := fsys.files[name]
+	if entry.IsSymlink() && !gf.CopySymlinks {
+		return false, gf.renderTemplateLink(fsys, name, outName, values)
+	}
+
+	// Copied symlinks are read through the link, like os.DirFS would.
+	content, err := fsys.ReadFile(name)
+	if err != nil {
+		return false, err
+	}
+	mode := entry.FileMode()
+	if entry.IsSymlink() {
+		info, err := fsys.Stat(name)
+		if err != nil {
+			return false, err
+		}
+		mode = info.Mode().Perm()
+	}
+
+	render := !isBinary(content) && !excluded(name, exclude)
+	if render {
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(string(content))
+		if err != nil {
+			return false, fmt.Errorf("error parsing template %s: %w", name, err)
+		}
+		var out bytes.Buffer
+		if err := tmpl.Execute(&out, values); err != nil {
+			return false, fmt.Errorf("error rendering template %s: %w", name, err)
+		}
+		content = out.Bytes()
+	}
+	return render, gf.SaveFileContent(filepath.FromSlash(outName), string(content), mode)
+}
+
+// renderTemplateLink creates the symlink name of the template at outName.
+// Like CreateSymlinks it refuses links that leave the root, and it renders
+// the components of the target, which may name a renamed directory.
+func (gf *GithubFetcher) renderTemplateLink(fsys *FS, name, outName string, values map[string]string) error {
+	fsys.linksOnce.Do(fsys.loadLinks)
+	if fsys.linksErr != nil {
+		return fsys.linksErr
+	}
+	target := fsys.links[name]
+	if _, err := resolveSymlink(name, fsys.links); err != nil {
+		return fmt.Errorf("error creating symlink %s to %s: %w", outName, target, err)
+	}
+	outTarget, err := renderPath(target, values)
+	if err != nil {
+		return err
+	}
+	if outTarget == "" {
+		return fmt.Errorf("error creating symlink %s: target %s renders empty", outName, target)
+	}
+	return gf.SaveSymlink(filepath.FromSlash(outName), outTarget)
+}
+
+// ReadTemplateAnswers reads template variables from a YAML or JSON file
+// mapping names to values.
+func ReadTemplateAnswers(answersPath string) (map[string]string, error) {
+	data, err := os.ReadFile(answersPath)
+	if err != nil {
+		return nil, fmt.Errorf("error reading answers file: %w", err)
+	}
+	var answers map[string]any
+	if err := yaml.Unmarshal(data, &answers); err != nil {
+		return nil, fmt.Errorf("error parsing answers file %s: %w", answersPath, err)
+	}
+	values := map[string]string{}
+	for key, value := range answers {
+		if value != nil {
+			values[key] = fmt.Sprint(value)
+		}
+	}
+	return values, nil
+}
+
+// templateValues combines opts.Values with the answers to the prompts of
+// config.
+func templateValues(config *TemplateConfig, opts TemplateOptions) (map[string]string, error) {
+	values := map[string]string{}
+	for key, value := range opts.Values {
+		values[key] = value
+	}
+	for _, prompt := range config.Prompts {
+		if _, ok := values[prompt.Name]; ok {
+			continue
+		}
+		switch {
+		case opts.Prompt != nil:
+			value, err := opts.Prompt(prompt)
+			if err != nil {
+				return nil, err
+			}
+			values[prompt.Name] = value
+		case prompt.Default != nil:
+			values[prompt.Name] = *prompt.Default
+		default:
+			return nil, fmt.Errorf("no value for template variable %s", prompt.Name)
+		}
+	}
+	return values, nil
+}
+
+// renderPath renders the components of name that contain an action. It
+// returns "" if one of them renders empty.
+func renderPath(name string, values map[string]string) (string, error) {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		if !strings.Contains(part, "{{") {
+			continue
+		}
+		tmpl, err := template.New(name).Option("missingkey=error").Parse(part)
+		if err != nil {
+			return "", fmt.Errorf("error parsing file name %s: %w", name, err)
+		}
+		var out strings.Builder
+		if err := tmpl.Execute(&out, values); err != nil {
+			return "", fmt.Errorf("error rendering file name %s: %w", name, err)
+		}
+		rendered := strings.TrimSpace(out.String())
+		if rendered == "" {
+			return "", nil
+		}
+		if rendered == "." || rendered == ".." || strings.ContainsAny(rendered, `/\`) {
+			return "", fmt.Errorf("error rendering file name %s: %q is not a valid name", name, rendered)
+		}
+		parts[i] = rendered
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// excluded reports whether name matches one of the patterns. Patterns
+// without a slash match the base name, others the whole path; a trailing
+// /** matches everything below a directory.
+func excluded(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "/")
+		var matched bool
+		switch {
+		case strings.HasSuffix(pattern, "/**"):
+			dir := strings.TrimSuffix(pattern, "/**")
+			matched, _ = path.Match(dir, name)
+			for d := path.Dir(name); !matched && d != "."; d = path.Dir(d) {
+				matched, _ = path.Match(dir, d)
+			}
+		case !strings.Contains(pattern, "/"):
+			matched, _ = path.Match(pattern, path.Base(name))
+		default:
+			matched, _ = path.Match(pattern, name)
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
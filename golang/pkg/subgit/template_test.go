@@ -0,0 +1,226 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testTemplateConfig = `prompts:
+  - name: Name
+  - name: Title
+    default: Untitled
+  - name: Extra
+    default: ""
+exclude:
+  - "*.bin"
+  - static/**
+`
+
+// renderTemplate renders the files of a fake repository into a new root
+// directory.
+func renderTemplate(t *testing.T, f *fakeGitHub, opts TemplateOptions) (string, *TemplateResult, error) {
+	t.Helper()
+	rootDir := filepath.Join(t.TempDir(), "out")
+	gf, err := NewGithubFetcher(f.options(rootDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := gf.RenderTemplate(context.Background(), opts)
+	return rootDir, result, err
+}
+
+func TestRenderTemplate(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		TemplateFileName:                        testTemplateConfig,
+		"README.md":                             "# {{ .Title }}\n",
+		"{{ .Name }}/main.go":                   "package {{ .Name }}\n",
+		"{{ .Name }}/{{ .Extra }}extra.go":      "package extra\n",
+		"{{ if .Extra }}optional{{ end }}/a.go": "package optional\n",
+		"static/{{ .Name }}.html":               "<p>{{ .Name }}</p>\n",
+		"logo.bin":                              "{{ .Name }}",
+		"data.dat":                              "\x00{{ .Name }}",
+		"link":                                  "{{ .Name }}/main.go",
+	})
+	f.setMode("link", ModeSymlink)
+
+	rootDir, result, err := renderTemplate(t, f, TemplateOptions{Values: map[string]string{"Name": "app"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantFiles := []string{"README.md", "app/extra.go", "app/main.go", "data.dat", "link", "logo.bin", "static/app.html"}
+	if !reflect.DeepEqual(result.Files, wantFiles) || result.Rendered != 3 {
+		t.Errorf("Files = %v, %d rendered, want %v, 3 rendered", result.Files, result.Rendered, wantFiles)
+	}
+	if want := map[string]string{"Name": "app", "Title": "Untitled", "Extra": ""}; !reflect.DeepEqual(result.Values, want) {
+		t.Errorf("Values = %v, want %v", result.Values, want)
+	}
+	checkFiles(t, rootDir, map[string]string{
+		"README.md":       "# Untitled\n",
+		"app/main.go":     "package app\n",
+		"app/extra.go":    "package extra\n",
+		"static/app.html": "<p>{{ .Name }}</p>\n", // Excluded below a directory
+		"logo.bin":        "{{ .Name }}",          // Excluded by name
+		"data.dat":        "\x00{{ .Name }}",      // Binary
+		TemplateFileName:  "",
+		"optional/a.go":   "",
+	})
+	if target, err := os.Readlink(filepath.Join(rootDir, "link")); err != nil || target != filepath.FromSlash("app/main.go") {
+		t.Errorf("link points to %q, %v, want the renamed app/main.go", target, err)
+	}
+}
+
+func TestRenderTemplatePrompt(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{
+		TemplateFileName: testTemplateConfig,
+		"name.txt":       "{{ .Name }} {{ .Title }}\n",
+	})
+	asked := []string{}
+	rootDir, _, err := renderTemplate(t, f, TemplateOptions{
+		Values: map[string]string{"Extra": "given"},
+		Prompt: func(prompt TemplatePrompt) (string, error) {
+			asked = append(asked, prompt.Name)
+			return "answer", nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(asked, []string{"Name", "Title"}) {
+		t.Errorf("asked for %v, want Name and Title", asked)
+	}
+	checkFiles(t, rootDir, map[string]string{"name.txt": "answer answer\n"})
+}
+
+func TestRenderTemplateErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string]string
+		link   string // Made a symlink
+		values map[string]string
+		want   string
+	}{
+		{
+			name:  "missing variable",
+			files: map[string]string{TemplateFileName: testTemplateConfig, "a.txt": "a\n"},
+			want:  "no value for template variable Name",
+		},
+		{
+			name:   "parent directory in a name",
+			files:  map[string]string{"{{ .Name }}/a.txt": "a\n"},
+			values: map[string]string{"Name": ".."},
+			want:   `".." is not a valid name`,
+		},
+		{
+			name:   "slash in a name",
+			files:  map[string]string{"{{ .Name }}.txt": "a\n"},
+			values: map[string]string{"Name": "../escape"},
+			want:   "is not a valid name",
+		},
+		{
+			name:  "undeclared variable in content",
+			files: map[string]string{"a.txt": "{{ .Missing }}\n"},
+			want:  "error rendering template a.txt",
+		},
+		{
+			name:  "symlink out of the root",
+			files: map[string]string{"a.txt": "a\n", "link": "../../escape"},
+			link:  "link",
+			want:  errOutsideRoot.Error(),
+		},
+		{
+			name:  "absolute symlink",
+			files: map[string]string{"a.txt": "a\n", "dir/link": "/etc/passwd"},
+			link:  "dir/link",
+			want:  errOutsideRoot.Error(),
+		},
+		{
+			name:   "symlink to a name that renders empty",
+			files:  map[string]string{"{{ .Name }}/a.txt": "a\n", "link": "{{ .Name }}/a.txt"},
+			link:   "link",
+			values: map[string]string{"Name": ""},
+			want:   "renders empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFakeGitHub(t, tt.files)
+			if tt.link != "" {
+				f.setMode(tt.link, ModeSymlink)
+			}
+			rootDir, _, err := renderTemplate(t, f, TemplateOptions{Values: tt.values})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("RenderTemplate = %v, want an error containing %q", err, tt.want)
+			}
+			if _, err := os.Lstat(filepath.Join(rootDir, tt.link)); tt.link != "" && !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s was written", tt.link)
+			}
+		})
+	}
+}
+
+func TestRenderTemplateNotEmpty(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"a.txt": "a\n"})
+	rootDir := t.TempDir()
+	writeTestFile(t, rootDir, "existing.txt", "mine\n")
+	gf, err := NewGithubFetcher(f.options(rootDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gf.RenderTemplate(context.Background(), TemplateOptions{}); err == nil || !strings.Contains(err.Error(), "is not empty") {
+		t.Fatalf("RenderTemplate = %v, want an error for a non-empty root", err)
+	}
+	if f.requests("/raw/o/r/"+f.commit+"/a.txt") != 0 {
+		t.Error("a.txt was downloaded")
+	}
+}
+
+func TestRenderPath(t *testing.T) {
+	values := map[string]string{"Name": "app", "Empty": "", "Space": " "}
+	tests := []struct {
+		name, want string
+	}{
+		{"plain/file.txt", "plain/file.txt"},
+		{"{{ .Name }}/{{ .Name }}.go", "app/app.go"},
+		{"dir/{{ .Empty }}", ""},
+		{"{{ .Space }}/file", ""},
+		{"{{ if .Empty }}x{{ end }}/file", ""},
+		{"{{ .Name }}-{{ .Empty }}", "app-"},
+	}
+	for _, tt := range tests {
+		if got, err := renderPath(tt.name, values); err != nil || got != tt.want {
+			t.Errorf("renderPath(%q) = %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+	for _, name := range []string{"{{ .Missing }}", "{{ .Name", "{{ \".\" }}", `{{ "a\\b" }}`} {
+		if got, err := renderPath(name, values); err == nil {
+			t.Errorf("renderPath(%q) = %q, want an error", name, got)
+		}
+	}
+}
+
+func TestExcluded(t *testing.T) {
+	patterns := []string{"*.bin", "static/**", "/docs/*.md", "a/*/c"}
+	tests := map[string]bool{
+		"logo.bin":         true,
+		"deep/dir/x.bin":   true,
+		"x.bin.txt":        false,
+		"static":           true,
+		"static/a.html":    true,
+		"static/css/a.css": true,
+		"src/static/a":     false,
+		"docs/README.md":   true,
+		"docs/sub/x.md":    false,
+		"a/b/c":            true,
+		"a/b/c/d":          false,
+	}
+	for name, want := range tests {
+		if got := excluded(name, patterns); got != want {
+			t.Errorf("excluded(%q) = %v, want %v", name, got, want)
+		}
+	}
+}
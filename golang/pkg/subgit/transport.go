@@ -0,0 +1,313 @@
+package subgit
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Default timeouts, chosen to tolerate slow links while still failing a
+// stalled CI job in minutes rather than hours.
+const (
+	DefaultConnectTimeout        = 30 * time.Second
+	DefaultTLSHandshakeTimeout   = 10 * time.Second
+	DefaultResponseHeaderTimeout = 30 * time.Second
+	DefaultStallTimeout          = 60 * time.Second
+)
+
+// Phases reported by TimeoutError.
+const (
+	PhaseConnect        = "connect"
+	PhaseTLSHandshake   = "TLS handshake"
+	PhaseResponseHeader = "response header"
+	PhaseBodyStall      = "body stall"
+	PhaseDeadline       = "deadline"
+)
+
+// ClientOptions configures the HTTP client shared by all requests. A zero
+// timeout disables the corresponding limit.
+type ClientOptions struct {
+	VerifySSL             bool
+	CABundle              string // PEM file of CAs trusted in addition to the system pool
+	ClientCert            string // PEM certificate for mutual TLS
+	ClientKey             string // PEM key for ClientCert, if not in the same file
+	Proxy                 string // http, https, socks5 or socks5h proxy URL; empty uses the environment
+	ConnectTimeout        time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	StallTimeout          time.Duration // Longest a response body may go without delivering data
+}
+
+func NewHTTPClient(opts ClientOptions) (*http.Client, error) {
+	// Configure the HTTP client with TLS verification options.
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: !opts.VerifySSL, // Disable verification if verifySSL is false
+	}
+
+	if opts.CABundle != "" {
+		pool, err := loadCABundle(opts.CABundle)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.ClientCert != "" {
+		keyFile := opts.ClientKey
+		if keyFile == "" {
+			keyFile = opts.ClientCert
+		}
+		cert, err := tls.LoadX509KeyPair(opts.ClientCert, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	} else if opts.ClientKey != "" {
+		return nil, fmt.Errorf("a client key requires a client certificate")
+	}
+
+	proxy, err := proxyFunc(opts.Proxy)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   opts.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+
+	// Create a transport with the TLS configuration.
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		TLSClientConfig:       tlsConfig,
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   opts.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: opts.ResponseHeaderTimeout,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConnsPerHost:   DefaultMaxJobs,
+		IdleConnTimeout:       90 * time.Second,
+	}
+
+	// Create a new HTTP client using the transport.
+	return &http.Client{
+		Transport: transport,
+	}, nil
+}
+
+// loadCABundle returns the system pool with the certificates from path
+// appended, so that an internal CA is trusted alongside the public ones.
+func loadCABundle(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CA bundle: %w", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+	}
+	return pool, nil
+}
+
+// proxyFunc returns the proxy selector for the transport. Without an
+// explicit proxy it falls back to HTTPS_PROXY, HTTP_PROXY and NO_PROXY.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	if proxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+
+	proxyURL, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use http, https, socks5 or socks5h)", proxyURL.Scheme)
+	}
+
+	noProxy := os.Getenv("NO_PROXY")
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if bypassProxy(req.URL, noProxy) {
+			return nil, nil
+		}
+		return proxyURL, nil
+	}, nil
+}
+
+// bypassProxy reports whether target matches NO_PROXY, which holds comma
+// separated hosts, domains (matching their subdomains, with or without a
+// leading dot), IPs or CIDRs, each optionally with a port, or "*".
+func bypassProxy(target *url.URL, noProxy string) bool {
+	host := strings.ToLower(target.Hostname())
+	port := target.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[target.Scheme]
+	}
+	ip := net.ParseIP(host)
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return true
+		}
+
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return true
+			}
+			continue
+		}
+
+		entryHost, entryPort, err := net.SplitHostPort(entry)
+		if err != nil {
+			entryHost, entryPort = entry, ""
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		entryHost = strings.TrimPrefix(strings.Trim(entryHost, "[]"), "*")
+		if entryIP := net.ParseIP(entryHost); entryIP != nil {
+			if ip != nil && entryIP.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		domain := strings.TrimPrefix(entryHost, ".")
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// TimeoutError reports which phase of a request ran out of time.
+type TimeoutError struct {
+	Phase   string
+	Timeout time.Duration
+	URL     string
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	if e.URL == "" {
+		return fmt.Sprintf("%s timeout after %s", e.Phase, e.Timeout)
+	}
+	return fmt.Sprintf("%s timeout after %s for %s", e.Phase, e.Timeout, e.URL)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// classifyTimeout turns timeouts reported by net/http into a TimeoutError
+// naming the phase that timed out. Other errors are returned unchanged.
+func (gf *GithubFetcher) classifyTimeout(err error, url string) error {
+	var timeoutErr *TimeoutError
+	if err == nil || errors.As(err, &timeoutErr) {
+		return err
+	}
+
+	var opErr *net.OpError
+	switch {
+	// net/http does not export these errors, only their messages.
+	case strings.Contains(err.Error(), "TLS handshake timeout"):
+		return &TimeoutError{Phase: PhaseTLSHandshake, Timeout: gf.ClientOptions.TLSHandshakeTimeout, URL: url, Err: err}
+	case strings.Contains(err.Error(), "timeout awaiting response headers"):
+		return &TimeoutError{Phase: PhaseResponseHeader, Timeout: gf.ClientOptions.ResponseHeaderTimeout, URL: url, Err: err}
+	case errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout():
+		return &TimeoutError{Phase: PhaseConnect, Timeout: gf.ClientOptions.ConnectTimeout, URL: url, Err: err}
+	case errors.Is(err, context.DeadlineExceeded):
+		return &TimeoutError{Phase: PhaseDeadline, Timeout: gf.Deadline, URL: url, Err: err}
+	}
+	return err
+}
+
+// stallReader cancels the request it reads from when no data arrives for
+// the stall timeout, which catches connections that stay open but idle.
+type stallReader struct {
+	r       io.Reader
+	timer   *time.Timer
+	timeout time.Duration
+	url     string
+	stalled atomic.Bool
+}
+
+// newStallReader wraps body; cancel must cancel the request's context.
+func newStallReader(body io.Reader, timeout time.Duration, url string, cancel context.CancelFunc) *stallReader {
+	sr := &stallReader{r: body, timeout: timeout, url: url}
+	sr.timer = time.AfterFunc(timeout, func() {
+		sr.stalled.Store(true)
+		cancel()
+	})
+	return sr
+}
+
+func (sr *stallReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && sr.stalled.Load() {
+		return n, &TimeoutError{Phase: PhaseBodyStall, Timeout: sr.timeout, URL: sr.url, Err: err}
+	}
+	if n > 0 {
+		sr.timer.Reset(sr.timeout)
+	}
+	return n, err
+}
+
+func (sr *stallReader) Stop() {
+	sr.timer.Stop()
+}
+
+// progressReader reports the bytes read from a download as they arrive.
+type progressReader struct {
+	io.ReadCloser
+	gf   *GithubFetcher
+	path string
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.ReadCloser.Read(p)
+	if n > 0 {
+		pr.gf.emit(Event{Type: EventFileBytes, Path: pr.path, Size: int64(n)})
+	}
+	return n, err
+}
+
+// readBody reads a response body, failing with a TimeoutError if it
+// stalls for longer than the stall timeout.
+func (gf *GithubFetcher) readBody(resp *http.Response, url string, cancel context.CancelFunc) ([]byte, error) {
+	if gf.ClientOptions.StallTimeout <= 0 {
+		return io.ReadAll(resp.Body)
+	}
+	sr := newStallReader(resp.Body, gf.ClientOptions.StallTimeout, url, cancel)
+	defer sr.Stop()
+	return io.ReadAll(sr)
+}
+
+// do sends req, classifying timeouts.
+func (gf *GithubFetcher) do(req *http.Request) (*http.Response, error) {
+	resp, err := gf.Client.Do(req)
+	if err != nil {
+		return nil, gf.classifyTimeout(err, req.URL.String())
+	}
+	return resp, nil
+}
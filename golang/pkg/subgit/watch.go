@@ -0,0 +1,144 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"time"
+)
+
+// DefaultWatchInterval is the time between polls if WatchOptions has none.
+const DefaultWatchInterval = time.Minute
+
+// WatchOptions configures Watch.
+type WatchOptions struct {
+	Interval time.Duration // Time between polls of the branch head
+	Jitter   time.Duration // Up to this much is added to each interval at random
+
+	OnSync  func(result *Result, err error) // Called after each sync
+	OnError func(err error)                 // Called when a poll fails; Watch polls again after the interval
+}
+
+// Watch polls the head of Branch every Interval and runs Fetch and
+// RunHooks whenever the subfolder's tree changes, until ctx is done. The
+// first poll always syncs, and each sync fetches the commit its poll saw.
+// Polls are conditional requests, so they do not count against the rate
+// limit while the branch does not move. A failed sync is retried at the
+// next poll; errors polling again cannot fix, such as a rejected token or
+// a missing repository, end the watch.
+func (gf *GithubFetcher) Watch(ctx context.Context, opts WatchOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultWatchInterval
+	}
+
+	var etag, head, syncedTree string
+	synced := false
+	for {
+		delay := opts.Interval
+		err := func() error {
+			commit, newETag, err := gf.pollHead(ctx, etag, head)
+			if err != nil {
+				return err
+			}
+			if commit == head {
+				etag = newETag
+				return nil
+			}
+			_, tree, _, err := gf.listTree(ctx, commit)
+			if err != nil {
+				return err
+			}
+			etag, head = newETag, commit
+			if synced && tree == syncedTree {
+				return nil
+			}
+
+			// Fetch the commit that was polled, even if the branch moved
+			// since; the next poll picks up the new head.
+			gf.polled = commit
+			result, err := gf.Fetch(ctx)
+			gf.polled = ""
+			if err != nil {
+				if opts.OnSync != nil {
+					opts.OnSync(result, err)
+				}
+				if !isTransient(err) {
+					return err
+				}
+				// Poll without the ETag next time, so that the sync is
+				// tried again. This includes local changes and conflicts,
+				// which the user may resolve meanwhile.
+				etag, head = "", ""
+				return nil
+			}
+			synced, syncedTree = true, tree
+
+			// A failed hook is reported, but the files are in sync.
+			err = gf.RunHooks(ctx, result)
+			if opts.OnSync != nil {
+				opts.OnSync(result, err)
+			}
+			return nil
+		}()
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			if !isTransient(err) {
+				return err
+			}
+			if opts.OnError != nil {
+				opts.OnError(err)
+			}
+			var httpErr *HTTPError
+			if errors.As(err, &httpErr) && httpErr.RetryAfter > delay {
+				delay = httpErr.RetryAfter
+			}
+		}
+
+		if opts.Jitter > 0 {
+			delay += rand.N(opts.Jitter)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// pollHead returns the commit Branch points to, or head if it has not
+// moved since the response etag came with.
+func (gf *GithubFetcher) pollHead(ctx context.Context, etag, head string) (string, string, error) {
+	if gf.local != nil {
+		commit, err := gf.local.resolve(gf.Branch)
+		return commit, "", err
+	}
+	url := fmt.Sprintf("%s/repos/%s/commits/%s", gf.APIURL(), gf.RepoName, gf.Branch)
+
+	var commitResponse struct {
+		Sha string `json:"sha"`
+	}
+	newETag, modified, err := gf.getJSONIfNoneMatch(ctx, url, etag, &commitResponse)
+	if err != nil || !modified {
+		return head, newETag, err
+	}
+	return commitResponse.Sha, newETag, nil
+}
+
+// isTransient reports whether err may go away by itself, unlike
+// authentication failures and missing repositories or branches.
+func isTransient(err error) bool {
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) && !httpErr.RateLimited {
+		switch httpErr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,204 @@
+package subgit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// watcher runs Watch on a fetcher for lib in f until stopped.
+type watcher struct {
+	t       *testing.T
+	f       *fakeGitHub
+	rootDir string
+	cancel  context.CancelFunc
+	done    chan error
+
+	mu    sync.Mutex
+	syncs []*Result
+	errs  []error
+}
+
+func startWatch(t *testing.T, f *fakeGitHub) *watcher {
+	t.Helper()
+	w := &watcher{t: t, f: f, rootDir: t.TempDir(), done: make(chan error, 1)}
+	opts := f.options(w.rootDir)
+	opts.Subfolder = "lib"
+	gf, err := NewGithubFetcher(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	w.cancel = cancel
+	t.Cleanup(w.stop)
+	go func() {
+		w.done <- gf.Watch(ctx, WatchOptions{
+			Interval: 5 * time.Millisecond,
+			OnSync: func(result *Result, err error) {
+				w.mu.Lock()
+				defer w.mu.Unlock()
+				w.syncs = append(w.syncs, result)
+				w.errs = append(w.errs, err)
+			},
+		})
+	}()
+	return w
+}
+
+// stop ends the watch.
+func (w *watcher) stop() {
+	w.cancel()
+}
+
+// wait waits until cond holds.
+func (w *watcher) wait(what string, cond func() bool) {
+	w.t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			w.t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// polls returns the number of polls of the branch head so far.
+func (w *watcher) polls() int {
+	return w.f.requests("/repos/o/r/commits/main")
+}
+
+func (w *watcher) results() ([]*Result, []error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]*Result(nil), w.syncs...), append([]error(nil), w.errs...)
+}
+
+func TestWatch(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"lib/a.txt": "a\n", "other/b.txt": "b\n"})
+	var notModified atomic.Int32
+	f.intercept = func(rw http.ResponseWriter, r *http.Request) bool {
+		if r.Header.Get("If-None-Match") != "" {
+			f.mu.Lock()
+			if r.Header.Get("If-None-Match") == `"`+f.commit+`"` {
+				notModified.Add(1)
+			}
+			f.mu.Unlock()
+		}
+		return false
+	}
+	w := startWatch(t, f)
+
+	w.wait("the first sync", func() bool { syncs, _ := w.results(); return len(syncs) == 1 })
+	syncs, errs := w.results()
+	if errs[0] != nil || syncs[0].Commit != f.commit {
+		t.Fatalf("first sync = %+v, %v", syncs[0], errs[0])
+	}
+	checkFiles(t, w.rootDir, map[string]string{"lib/a.txt": "a\n"})
+
+	// While the branch does not move, polls are answered with 304 and
+	// nothing else is requested.
+	trees := f.requests("/repos/o/r/git/trees/" + f.commit)
+	w.wait("unchanged polls", func() bool { return notModified.Load() >= 3 })
+	if n := f.requests("/repos/o/r/git/trees/" + f.commit); n != trees {
+		t.Errorf("the tree was listed %d more times while the branch did not move", n-trees)
+	}
+
+	// A commit outside the subfolder leaves its tree unchanged.
+	f.setFiles(map[string]string{"lib/a.txt": "a\n", "other/b.txt": "b2\n"})
+	w.wait("the new commit to be listed", func() bool { return f.requests("/repos/o/r/git/trees/"+f.commit) == 1 })
+	polls := w.polls()
+	w.wait("more polls", func() bool { return w.polls() >= polls+3 })
+	if syncs, _ := w.results(); len(syncs) != 1 {
+		t.Errorf("%d syncs after a commit outside the subfolder, want still 1", len(syncs))
+	}
+
+	f.setFiles(map[string]string{"lib/a.txt": "a2\n", "other/b.txt": "b2\n"})
+	w.wait("the second sync", func() bool { syncs, _ := w.results(); return len(syncs) == 2 })
+	syncs, errs = w.results()
+	if errs[1] != nil || syncs[1].Commit != f.commit || len(syncs[1].Changed) != 1 {
+		t.Errorf("second sync = %+v, %v, want lib/a.txt changed", syncs[1], errs[1])
+	}
+	checkFiles(t, w.rootDir, map[string]string{"lib/a.txt": "a2\n"})
+
+	w.stop()
+	if err := <-w.done; !errors.Is(err, context.Canceled) {
+		t.Errorf("Watch = %v, want context.Canceled", err)
+	}
+}
+
+// TestWatchPinned moves the branch right after a poll and checks that the
+// sync still fetches the polled commit.
+func TestWatchPinned(t *testing.T) {
+	first := map[string]string{"lib/a.txt": "a\n"}
+	f := newFakeGitHub(t, first)
+	firstCommit := f.commit
+	var moved atomic.Bool
+	f.intercept = func(rw http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/repos/o/r/commits/main" || moved.Swap(true) {
+			return false
+		}
+		rw.Header().Set("ETag", `"`+firstCommit+`"`)
+		io.WriteString(rw, `{"sha": "`+firstCommit+`"}`)
+		f.setFiles(map[string]string{"lib/a.txt": "moved\n"})
+		return true
+	}
+	w := startWatch(t, f)
+
+	w.wait("two syncs", func() bool { syncs, _ := w.results(); return len(syncs) == 2 })
+	syncs, errs := w.results()
+	if errs[0] != nil || syncs[0].Commit != firstCommit {
+		t.Errorf("first sync = %+v, %v, want commit %s", syncs[0], errs[0], firstCommit)
+	}
+	f.mu.Lock()
+	head := f.commit
+	f.mu.Unlock()
+	if errs[1] != nil || syncs[1].Commit != head || head == firstCommit {
+		t.Errorf("second sync = %+v, %v, want commit %s", syncs[1], errs[1], head)
+	}
+	checkFiles(t, w.rootDir, map[string]string{"lib/a.txt": "moved\n"})
+}
+
+// TestWatchFatal checks that Watch ends when a sync fails in a way polling
+// cannot fix, but keeps going after transient failures.
+func TestWatchFatal(t *testing.T) {
+	f := newFakeGitHub(t, map[string]string{"lib/a.txt": "a\n"})
+	var listings atomic.Int32
+	f.intercept = func(rw http.ResponseWriter, r *http.Request) bool {
+		if r.URL.Path != "/repos/o/r/git/trees/"+f.commit {
+			return false
+		}
+		// Watch lists the tree, then Fetch does.
+		switch listings.Add(1) {
+		case 2:
+			http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+			return true
+		case 4:
+			http.Error(rw, `{"message": "Bad credentials"}`, http.StatusUnauthorized)
+			return true
+		}
+		return false
+	}
+	w := startWatch(t, f)
+
+	var err error
+	select {
+	case err = <-w.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Watch did not return")
+	}
+	var httpErr *HTTPError
+	if !errors.As(err, &httpErr) || httpErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Watch = %v, want the 401", err)
+	}
+	if _, errs := w.results(); len(errs) != 2 || !isTransient(errs[0]) || errs[1] != err {
+		t.Errorf("syncs failed with %v, want the 503 and then the 401", errs)
+	}
+	if _, statErr := os.Stat(filepath.Join(w.rootDir, "lib", "a.txt")); !errors.Is(statErr, os.ErrNotExist) {
+		t.Errorf("lib/a.txt was written: %v", statErr)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/cheggaaa/pb/v3"
+	"github.com/mattn/go-isatty"
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+const (
+	// largeFileSize is the size from which a completed file gets a line of
+	// its own.
+	largeFileSize = 1 << 20
+
+	// progressInterval is how often progress is printed without a terminal.
+	progressInterval = 10 * time.Second
+)
+
+// progressReporter tracks the bytes received against the total size from
+// the tree listing. On a terminal it draws a progress bar, otherwise it
+// prints a plain line every progressInterval so that CI logs stay readable.
+type progressReporter struct {
+	out io.Writer
+	tty bool
+
+	mu         sync.Mutex
+	bar        *pb.ProgressBar
+	start      time.Time
+	total      int64
+	done       int64
+	files      int
+	totalFiles int
+	received   map[string]int64 // Bytes of files still in flight
+	stop       chan struct{}
+	stopped    sync.WaitGroup
+}
+
+func newProgressReporter(out *os.File) *progressReporter {
+	return &progressReporter{
+		out:      out,
+		tty:      isatty.IsTerminal(out.Fd()) || isatty.IsCygwinTerminal(out.Fd()),
+		received: map[string]int64{},
+	}
+}
+
+func (p *progressReporter) Event(event subgit.Event) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch event.Type {
+	case subgit.EventListDone:
+		if event.Total > 0 {
+			p.begin(event.Total, event.Size)
+		}
+	case subgit.EventFileBytes:
+		p.received[event.Path] += event.Size
+		p.add(event.Size)
+	case subgit.EventFileDone:
+		// Count the size from the listing whatever was received, so that
+		// the total adds up, and all of it for files already up to date.
+		p.add(event.Size - p.received[event.Path])
+		delete(p.received, event.Path)
+		p.files++
+		if p.bar != nil {
+			p.bar.Set("prefix", p.filesLabel())
+		}
+		if !event.UpToDate && event.Size >= largeFileSize {
+			p.println(fmt.Sprintf("%s: %s in %s (%s/s)", event.Path, formatBytes(event.Size), event.Duration.Round(time.Millisecond), formatBytes(rate(event.Size, event.Duration))))
+		}
+	case subgit.EventRetryWait, subgit.EventFileFailed:
+		// Bytes from a failed attempt will be received again, or never.
+		p.add(-p.received[event.Path])
+		delete(p.received, event.Path)
+	}
+}
+
+// begin must be called with p.mu held.
+func (p *progressReporter) begin(totalFiles int, total int64) {
+	p.start = time.Now()
+	p.total = total
+	p.totalFiles = totalFiles
+
+	if p.tty {
+		p.bar = pb.New64(total).SetTemplate(pb.Full)
+		p.bar.SetWriter(p.out)
+		p.bar.Set(pb.Bytes, true)
+		p.bar.Set(pb.SIBytesPrefix, true)
+		p.bar.Set("prefix", p.filesLabel())
+		p.bar.Start()
+		return
+	}
+
+	p.stop = make(chan struct{})
+	p.stopped.Add(1)
+	go func() {
+		defer p.stopped.Done()
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.mu.Lock()
+				p.printLine()
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// add must be called with p.mu held.
+func (p *progressReporter) add(n int64) {
+	p.done += n
+	if p.bar != nil {
+		p.bar.Add64(n)
+	}
+}
+
+// Finish stops the bar or the periodic lines, printing a final line.
+func (p *progressReporter) Finish() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stopped.Wait()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bar != nil {
+		p.bar.Finish()
+	} else if p.totalFiles > 0 {
+		p.printLine()
+	}
+}
+
+// println prints a line above the bar, which is redrawn on its next
+// refresh. It must be called with p.mu held.
+func (p *progressReporter) println(line string) {
+	if p.bar != nil {
+		fmt.Fprintf(p.out, "\r\033[K%s\n", line)
+		return
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+// printLine must be called with p.mu held.
+func (p *progressReporter) printLine() {
+	elapsed := time.Since(p.start)
+	line := fmt.Sprintf("Progress: %s, %s / %s", p.filesLabel(), formatBytes(p.done), formatBytes(p.total))
+	if p.total > 0 {
+		line += fmt.Sprintf(" (%.0f%%)", 100*float64(p.done)/float64(p.total))
+	}
+	speed := rate(p.done, elapsed)
+	line += fmt.Sprintf(", %s/s", formatBytes(speed))
+	if speed > 0 && p.done < p.total {
+		eta := time.Duration(float64(p.total-p.done) / float64(speed) * float64(time.Second))
+		line += fmt.Sprintf(", ETA %s", eta.Round(time.Second))
+	}
+	fmt.Fprintln(p.out, line)
+}
+
+func (p *progressReporter) filesLabel() string {
+	return fmt.Sprintf("%d/%d files", p.files, p.totalFiles)
+}
+
+// rate returns bytes per second.
+func rate(n int64, d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(float64(n) / d.Seconds())
+}
+
+// formatBytes formats n with an SI prefix, like the progress bar.
+func formatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, prefix := float64(n)/unit, 0
+	for value >= unit && prefix < 4 {
+		value /= unit
+		prefix++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "kMGTP"[prefix])
+}
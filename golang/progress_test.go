@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// TestProgressLines checks the plain lines printed without a terminal, and
+// that bytes of failed attempts are taken back.
+func TestProgressLines(t *testing.T) {
+	var out bytes.Buffer
+	p := &progressReporter{out: &out, received: map[string]int64{}}
+	for _, event := range []subgit.Event{
+		{Type: subgit.EventListDone, Total: 3, Size: 4_000_050},
+		{Type: subgit.EventFileBytes, Path: "big.bin", Size: 1_000_000},
+		{Type: subgit.EventRetryWait, Path: "big.bin", Attempt: 1, Delay: time.Second},
+		{Type: subgit.EventFileBytes, Path: "big.bin", Size: 3_000_000},
+		{Type: subgit.EventFileDone, Path: "big.bin", Size: 3_000_000, Duration: 2 * time.Second},
+		{Type: subgit.EventFileBytes, Path: "a.bin", Size: 500_000},
+		{Type: subgit.EventFileFailed, Path: "a.bin", Size: 1_000_000},
+		{Type: subgit.EventFileDone, Path: "b.txt", Size: 50, UpToDate: true},
+	} {
+		p.Event(event)
+	}
+	if p.done != 3_000_050 || p.files != 2 || len(p.received) != 0 {
+		t.Errorf("done = %d bytes and %d files, %v in flight, want 3000050 bytes and 2 files", p.done, p.files, p.received)
+	}
+	p.Finish()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("output = %q, want a line for big.bin and the final one", lines)
+	}
+	if want := "big.bin: 3.0 MB in 2s (1.5 MB/s)"; lines[0] != want {
+		t.Errorf("line = %q, want %q", lines[0], want)
+	}
+	if prefix := "Progress: 2/3 files, 3.0 MB / 4.0 MB (75%), "; !strings.HasPrefix(lines[1], prefix) || !strings.Contains(lines[1], "/s, ETA ") {
+		t.Errorf("final line = %q, want %q with speed and ETA", lines[1], prefix)
+	}
+}
+
+// TestProgressNothingListed checks that an empty listing prints nothing.
+func TestProgressNothingListed(t *testing.T) {
+	var out bytes.Buffer
+	p := &progressReporter{out: &out, received: map[string]int64{}}
+	p.Event(subgit.Event{Type: subgit.EventListStart})
+	p.Event(subgit.Event{Type: subgit.EventListDone})
+	p.Finish()
+	if out.Len() != 0 {
+		t.Errorf("output = %q, want none", out.String())
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:                 "0 B",
+		999:               "999 B",
+		1000:              "1.0 kB",
+		1_500_000:         "1.5 MB",
+		2_000_000_000:     "2.0 GB",
+		3_000_000_000_000: "3.0 TB",
+		5e18:              "5000.0 PB",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, got, want)
+		}
+	}
+	if got := rate(3_000_000, 2*time.Second); got != 1_500_000 {
+		t.Errorf("rate = %d, want 1500000", got)
+	}
+	if got := rate(100, 0); got != 0 {
+		t.Errorf("rate over no time = %d, want 0", got)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// keyValueFlag collects repeated -set key=value flags.
+type keyValueFlag map[string]string
+
+func (f keyValueFlag) String() string {
+	return ""
+}
+
+func (f keyValueFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected key=value")
+	}
+	f[key] = val
+	return nil
+}
+
+// newPrompter returns a TemplateOptions.Prompt that asks on out and reads
+// the answers from in, using the default for an empty answer.
+func newPrompter(in io.Reader, out io.Writer) func(subgit.TemplatePrompt) (string, error) {
+	reader := bufio.NewReader(in)
+	return func(prompt subgit.TemplatePrompt) (string, error) {
+		message := prompt.Message
+		if message == "" {
+			message = prompt.Name
+		}
+		for {
+			if prompt.Default != nil {
+				fmt.Fprintf(out, "%s [%s]: ", message, *prompt.Default)
+			} else {
+				fmt.Fprintf(out, "%s: ", message)
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil && (err != io.EOF || line == "") {
+				return "", fmt.Errorf("error reading value for %s: %w", prompt.Name, err)
+			}
+			answer := strings.TrimSpace(line)
+			switch {
+			case answer != "":
+				return answer, nil
+			case prompt.Default != nil:
+				return *prompt.Default, nil
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pranjalya/subgit/golang/pkg/subgit"
+)
+
+// printSync prints the line subgit watch writes after each sync.
+func printSync(w io.Writer, result *subgit.Result) {
+	fmt.Fprintf(w, "%s Synced %s: %d files, %d changed (%s)\n", time.Now().Format(time.DateTime), shortSha(result.Commit), len(result.Files), len(result.Changed), formatBytes(result.Bytes))
+}
+
+// runCommand runs the -exec command of subgit watch through the shell in
+// dir, with the commit that was synced in SUBGIT_COMMIT.
+func runCommand(ctx context.Context, out io.Writer, command string, dir string, commit string) error {
+	cmd := subgit.ShellCommand(ctx, command)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "SUBGIT_COMMIT="+commit)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	return cmd.Run()
+}